@@ -0,0 +1,153 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/BieggerM/userservice/pkg/adapter/out/database"
+	"github.com/BieggerM/userservice/pkg/service/auth"
+	"os"
+	"strings"
+	"time"
+)
+
+const usage = `usage: userservice [command]
+
+Without a command the service is started.
+
+Commands:
+  keys generate   create a new signing key for JWT_SIGNING_ALGORITHM in JWT_KEY_DIR, it signs tokens after 10 minutes
+  keys rotate     create a new signing key and remove keys whose tokens have all expired
+  passwords migrate
+                  hash all passwords that are still stored in plaintext
+  clients create -name <name> -scopes <roles> [-audiences <audiences>] [-grants <grant types>]
+                  register an OAuth2 client and print its id and secret`
+
+// runCommand executes a management command given on the command line
+func runCommand(args []string) error {
+	switch {
+	case len(args) == 2 && args[0] == "keys" && args[1] == "generate":
+		return generateKey()
+	case len(args) == 2 && args[0] == "keys" && args[1] == "rotate":
+		return rotateKeys()
+	case len(args) == 2 && args[0] == "passwords" && args[1] == "migrate":
+		return migratePasswords()
+	case len(args) >= 2 && args[0] == "clients" && args[1] == "create":
+		return createClient(args[2:])
+	default:
+		fmt.Println(usage)
+		return errors.New("unknown command")
+	}
+}
+
+func generateKey() error {
+	config := authConfig()
+	key, err := auth.GenerateKey(config.KeyDir, config.SigningAlgorithm, time.Now())
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Generated signing key %s in %s\n", key.ID, config.KeyDir)
+	return nil
+}
+
+func rotateKeys() error {
+	config := authConfig()
+	key, removed, err := auth.RotateKeys(config.KeyDir, config.SigningAlgorithm, config.TokenTTL+config.Leeway, time.Now())
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Generated signing key %s in %s\n", key.ID, config.KeyDir)
+	for _, kid := range removed {
+		fmt.Printf("Removed expired signing key %s\n", kid)
+	}
+	return nil
+}
+
+// migratePasswords hashes legacy plaintext passwords. Rows that are not migrated
+// by this command are upgraded on the next successful login of the user.
+func migratePasswords() error {
+	db, err := connectDatabase()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	migrated := 0
+	for _, listed := range db.ListUsers() {
+		user, err := db.GetUser(listed.Username)
+		if err != nil {
+			return err
+		}
+		if user.Password == "" || auth.IsHashed(user.Password) {
+			continue
+		}
+		hash, err := auth.HashPassword(user.Password, auth.DefaultArgon2Params)
+		if err != nil {
+			return err
+		}
+		if err := db.UpdatePassword(user.Username, hash); err != nil {
+			return fmt.Errorf("failed to update password of %s: %w", user.Username, err)
+		}
+		migrated++
+	}
+	fmt.Printf("Hashed %d plaintext passwords\n", migrated)
+	return nil
+}
+
+// createClient registers an OAuth2 client. The secret is printed once and only its hash is stored.
+func createClient(args []string) error {
+	config := authConfig()
+	flags := flag.NewFlagSet("clients create", flag.ContinueOnError)
+	name := flags.String("name", "", "name of the client")
+	scopes := flags.String("scopes", auth.RoleService, "comma separated roles the client may request")
+	audiences := flags.String("audiences", strings.Join(config.Audiences, ","), "comma separated audiences the client may request")
+	grants := flags.String("grants", auth.GrantClientCredentials, "comma separated grant types the client may use")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *name == "" {
+		return errors.New("a client name is required")
+	}
+	for _, audience := range strings.Split(*audiences, ",") {
+		if !contains(config.Audiences, audience) {
+			return fmt.Errorf("audience %q is not configured in JWT_AUDIENCES", audience)
+		}
+	}
+	client, secret, err := auth.NewOAuthClient(*name, strings.Split(*scopes, ","), strings.Split(*audiences, ","), strings.Split(*grants, ","))
+	if err != nil {
+		return err
+	}
+
+	db, err := connectDatabase()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if err := db.SaveOAuthClient(client); err != nil {
+		return fmt.Errorf("failed to save client: %w", err)
+	}
+	fmt.Printf("Created client %s\nclient_id:     %s\nclient_secret: %s\n", client.Name, client.ClientID, secret)
+	return nil
+}
+
+func connectDatabase() (*database.Postgres, error) {
+	db := &database.Postgres{}
+	if err := db.Connect(
+		os.Getenv("DB_HOST"),
+		os.Getenv("DB_PORT"),
+		os.Getenv("DB_USER"),
+		os.Getenv("DB_PASSWORD"),
+		os.Getenv("DB_NAME")); err != nil {
+		return nil, fmt.Errorf("failed to connect to database: %w", err)
+	}
+	return db, nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
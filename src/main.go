@@ -1,6 +1,11 @@
 package main
 
 import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
 	"github.com/BieggerM/userservice/pkg/adapter/in/grpcserver"
 	"github.com/BieggerM/userservice/pkg/adapter/in/restserver"
 	"github.com/BieggerM/userservice/pkg/adapter/out/broker"
@@ -11,6 +16,8 @@ import (
 	"github.com/sirupsen/logrus"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 )
 
 // Levels defines which log levels trigger the hook.
@@ -23,11 +30,22 @@ var rlog logger.Logger
 var authService auth.AuthService
 
 func main() {
+	// Run management commands such as "keys rotate" instead of the service
+	if len(os.Args) > 1 {
+		if err := runCommand(os.Args[1:]); err != nil {
+			logrus.Fatal(err)
+		}
+		return
+	}
+
 	// Initialize Implementations
 	rlog = &logger.RemoteLogger{}
 	DB = &database.Postgres{}
 	MB = &broker.RabbitMQ{}
-	RS = &restserver.GinServer{}
+	RS = &restserver.GinServer{
+		LegacyAuthHeaders: os.Getenv("AUTH_LEGACY_HEADERS") == "true",
+		TrustedProxies:    trustedProxies(os.Getenv("TRUSTED_PROXIES")),
+	}
 	GS = &grpcserver.UserServiceServer{}
 	authService = &auth.Auth{}
 
@@ -35,9 +53,6 @@ func main() {
 	setupRemoteLogging()
 	defer rlog.Close()
 
-	// Setup AuthService
-	authService.SetupRSAKeys()
-
 	// Check Connection to Message Broker
 	prepareBroker()
 	defer MB.Close()
@@ -47,8 +62,16 @@ func main() {
 	prepareDatabase()
 	defer DB.Close()
 
-	// Create demo users
-	createDemoUsers()
+	// Setup AuthService
+	if err := authService.Setup(DB, MB, authConfig()); err != nil {
+		rlog.Fatal("Failed to setup AuthService", "error", err)
+	}
+
+	// Create demo users, only for local development
+	if os.Getenv("DEMO_USERS") == "true" {
+		createDemoUsers(os.Getenv("DEMO_USERS_PASSWORD"), os.Getenv("DEMO_ADMIN") == "true")
+	}
+	lockPublishedDemoPasswords(authConfig().PasswordPolicy.BreachedListFile)
 
 	// Start the Gin server
 	go RS.StartRestServer(MB, DB, rlog, authService)
@@ -70,6 +93,128 @@ func setupRemoteLogging() {
 	}
 }
 
+func authConfig() auth.Config {
+	return auth.Config{
+		KeyDir:               envOrDefault("JWT_KEY_DIR", "keys"),
+		KeyRotationInterval:  durationFromEnv("JWT_KEY_ROTATION_INTERVAL", 30*24*time.Hour),
+		KeyRotationLeader:    os.Getenv("JWT_KEY_ROTATION_LEADER") == "true",
+		KeyWaitTimeout:       durationFromEnv("JWT_KEY_WAIT_TIMEOUT", time.Minute),
+		SigningAlgorithm:     envOrDefault("JWT_SIGNING_ALGORITHM", auth.AlgRS256),
+		TokenTTL:             durationFromEnv("JWT_TOKEN_TTL", 15*time.Minute),
+		RefreshTokenTTL:      durationFromEnv("JWT_REFRESH_TOKEN_TTL", 30*24*time.Hour),
+		Issuer:               envOrDefault("JWT_ISSUER", envOrDefault("PUBLIC_URL", "http://localhost:8082")),
+		PublicURL:            envOrDefault("PUBLIC_URL", "http://localhost:8082"),
+		Audiences:            strings.Split(envOrDefault("JWT_AUDIENCES", "recipemanagement"), ","),
+		Leeway:               durationFromEnv("JWT_LEEWAY", 30*time.Second),
+		PasswordResetTTL:     durationFromEnv("PASSWORD_RESET_TTL", time.Hour),
+		EmailVerificationTTL: durationFromEnv("EMAIL_VERIFICATION_TTL", 24*time.Hour),
+		ImpersonationTTL:     durationFromEnv("IMPERSONATION_TOKEN_TTL", 10*time.Minute),
+		MagicLinkTTL:         durationFromEnv("MAGIC_LINK_TTL", 15*time.Minute),
+		PasswordPolicy: auth.PasswordPolicy{
+			MinLength:        intFromEnv("PASSWORD_MIN_LENGTH", auth.DefaultPasswordPolicy.MinLength),
+			MaxLength:        intFromEnv("PASSWORD_MAX_LENGTH", auth.DefaultPasswordPolicy.MaxLength),
+			MinCharClasses:   intFromEnv("PASSWORD_MIN_CHAR_CLASSES", auth.DefaultPasswordPolicy.MinCharClasses),
+			DisallowUsername: os.Getenv("PASSWORD_ALLOW_USERNAME") != "true",
+			BreachedListFile: envOrDefault("PASSWORD_BREACHED_LIST", "config/breached-passwords.txt"),
+		},
+		CredentialVerifiers: credentialVerifiers(),
+	}
+}
+
+// credentialVerifiers configures the external credential backends, LDAP is enabled by setting LDAP_URL
+func credentialVerifiers() []auth.CredentialVerifier {
+	if os.Getenv("LDAP_URL") == "" {
+		return nil
+	}
+	roleGroups := map[string]string{}
+	if group := os.Getenv("LDAP_ADMIN_GROUP"); group != "" {
+		roleGroups[auth.RoleAdmin] = group
+	}
+	if group := os.Getenv("LDAP_SERVICE_GROUP"); group != "" {
+		roleGroups[auth.RoleService] = group
+	}
+	tlsConfig, err := ldapTLSConfig(os.Getenv("LDAP_CA_FILE"))
+	if err != nil {
+		logrus.Fatalf("Invalid LDAP configuration: %v", err)
+	}
+	verifier, err := auth.NewLDAPVerifier(auth.LDAPConfig{
+		URL:                os.Getenv("LDAP_URL"),
+		StartTLS:           os.Getenv("LDAP_START_TLS") == "true",
+		AllowPlaintext:     os.Getenv("LDAP_ALLOW_PLAINTEXT") == "true",
+		TLSConfig:          tlsConfig,
+		BindDN:             os.Getenv("LDAP_BIND_DN"),
+		BindPassword:       os.Getenv("LDAP_BIND_PASSWORD"),
+		BaseDN:             os.Getenv("LDAP_BASE_DN"),
+		UserFilter:         os.Getenv("LDAP_USER_FILTER"),
+		UsernameAttribute:  os.Getenv("LDAP_USERNAME_ATTRIBUTE"),
+		FirstNameAttribute: os.Getenv("LDAP_FIRSTNAME_ATTRIBUTE"),
+		LastNameAttribute:  os.Getenv("LDAP_LASTNAME_ATTRIBUTE"),
+		EmailAttribute:     os.Getenv("LDAP_EMAIL_ATTRIBUTE"),
+		GroupAttribute:     os.Getenv("LDAP_GROUP_ATTRIBUTE"),
+		RoleGroups:         roleGroups,
+		Timeout:            durationFromEnv("LDAP_TIMEOUT", 5*time.Second),
+	})
+	if err != nil {
+		logrus.Fatalf("Invalid LDAP configuration: %v", err)
+	}
+	return []auth.CredentialVerifier{verifier}
+}
+
+// ldapTLSConfig trusts the certificates in the PEM file for LDAP connections, the system roots if no file is given
+func ldapTLSConfig(caFile string) (*tls.Config, error) {
+	if caFile == "" {
+		return nil, nil
+	}
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", caFile)
+	}
+	return &tls.Config{RootCAs: roots}, nil
+}
+
+// trustedProxies parses a comma separated list of proxy addresses or networks, none if empty
+func trustedProxies(value string) []string {
+	if value == "" {
+		return nil
+	}
+	return strings.Split(value, ",")
+}
+
+func envOrDefault(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
+
+func durationFromEnv(key string, fallback time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		logrus.Fatalf("Invalid duration for %s: %v", key, err)
+	}
+	return duration
+}
+
+func intFromEnv(key string, fallback int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	number, err := strconv.Atoi(value)
+	if err != nil {
+		logrus.Fatalf("Invalid number for %s: %v", key, err)
+	}
+	return number
+}
+
 func prepareBroker() {
 	if err := MB.Connect(
 		os.Getenv("RABBIT_USER"),
@@ -101,18 +246,114 @@ func prepareDatabase() {
 	}
 }
 
-func createDemoUsers() {
+// createDemoUsers creates the demo users with the given password, which has to pass the password policy.
+// user1 is only made an admin if asked for.
+func createDemoUsers(password string, admin bool) {
+	if password == "" {
+		logrus.Warn("DEMO_USERS_PASSWORD is not set, no demo users are created")
+		return
+	}
 	demoUsers := []models.User{
-		{Username: "user1", FirstName: "John", LastName: "Doe", Password: "password"},
-		{Username: "user2", FirstName: "Jane", LastName: "Doe", Password: "password"},
-		{Username: "user3", FirstName: "Jim", LastName: "Beam", Password: "password"},
+		{Username: "user1", FirstName: "John", LastName: "Doe", Roles: []string{auth.RoleUser}},
+		{Username: "user2", FirstName: "Jane", LastName: "Doe", Roles: []string{auth.RoleUser}},
+		{Username: "user3", FirstName: "Jim", LastName: "Beam", Roles: []string{auth.RoleUser}},
+	}
+	if admin {
+		demoUsers[0].Roles = []string{auth.RoleAdmin}
 	}
 
 	for _, user := range demoUsers {
+		if err := authService.CheckPassword(user.Username, password); err != nil {
+			logrus.Warnf("Not creating demo user %s: %v", user.Username, err)
+			continue
+		}
+		hash, err := authService.HashPassword(password)
+		if err != nil {
+			logrus.Warnf("Failed to hash password of demo user %s: %v", user.Username, err)
+			continue
+		}
+		user.Password = hash
 		if err := DB.SaveUser(user); err != nil {
-			logrus.Warn("Failed to create demo user", "", "")
+			logrus.Warnf("Failed to create demo user %s: %v", user.Username, err)
 		} else {
 			logrus.Infof("Created demo user %s", user.Username)
 		}
 	}
 }
+
+// publishedDemoPasswords holds the SHA-256 digests of the passwords earlier versions, which created the
+// demo users unconditionally, gave each demo user; the first versions used the same one for all.
+// The passwords themselves are looked up on the breached password list.
+var publishedDemoPasswords = map[string][]string{
+	"user1": {"5e884898da28047151d0e56f8dc6292773603d0d6aabbdd62a11ef721d1542d8", "8f4a5901869266825db7543a5377d95e6636a13f0d50ac52ac53479200044056"},
+	"user2": {"5e884898da28047151d0e56f8dc6292773603d0d6aabbdd62a11ef721d1542d8", "939ef4ee5cc4d9690e5308d7ad662457a7e3c8812fa938818d58d71e9b0b79f5"},
+	"user3": {"5e884898da28047151d0e56f8dc6292773603d0d6aabbdd62a11ef721d1542d8", "e1c10d4137577da8a6e62eca274c3aca7633e120c7efedc74292207fcaf80acc"},
+}
+
+// lockPublishedDemoPasswords locks demo users that still have a published password until it is reset.
+// Anyone may have logged in with it, so their sessions, tokens and API keys are revoked as well.
+func lockPublishedDemoPasswords(breachedListFile string) {
+	passwords, err := passwordsByDigest(breachedListFile)
+	if err != nil {
+		logrus.Errorf("Failed to check demo users for published passwords: %v", err)
+		return
+	}
+	for username, digests := range publishedDemoPasswords {
+		user, err := DB.GetUser(username)
+		if err != nil || !hasPasswordOf(user, digests, passwords) {
+			continue
+		}
+		if err := DB.LockUser(username, time.Now().AddDate(100, 0, 0), true); err != nil {
+			logrus.Errorf("Failed to lock demo user %s with published password: %v", username, err)
+			continue
+		}
+		if err := authService.RevokeUserTokens(username); err != nil {
+			logrus.Errorf("Failed to revoke tokens of demo user %s with published password: %v", username, err)
+		}
+		keys, err := authService.ListAPIKeys(username)
+		if err != nil {
+			logrus.Errorf("Failed to list api keys of demo user %s with published password: %v", username, err)
+		}
+		for _, key := range keys {
+			if key.Revoked {
+				continue
+			}
+			if err := authService.RevokeAPIKey(username, key.ID); err != nil {
+				logrus.Errorf("Failed to revoke api key %s of demo user %s: %v", key.ID, username, err)
+			}
+		}
+		logrus.Warnf("Locked demo user %s and revoked its tokens, its password is published; reset the password to unlock it", username)
+	}
+}
+
+// hasPasswordOf reports whether the user has one of the passwords with the given digests
+func hasPasswordOf(user models.User, digests []string, passwords map[string]string) bool {
+	for _, digest := range digests {
+		password, ok := passwords[digest]
+		if !ok {
+			continue
+		}
+		if match, _ := auth.VerifyPassword(password, user.Password, auth.DefaultArgon2Params); match {
+			return true
+		}
+	}
+	return false
+}
+
+// passwordsByDigest reads a password list, one password per line, and maps the SHA-256 digest of each to it
+func passwordsByDigest(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	passwords := map[string]string{}
+	for _, line := range strings.Split(string(data), "\n") {
+		password := strings.TrimSpace(line)
+		if password == "" || strings.HasPrefix(password, "#") {
+			continue
+		}
+		sum := sha256.Sum256([]byte(password))
+		passwords[hex.EncodeToString(sum[:])] = password
+	}
+	return passwords, nil
+}
@@ -1,8 +1,13 @@
 package main
 
 import (
+	"github.com/BieggerM/userservice/pkg/adapter/out/broker/brokertest"
+	"github.com/BieggerM/userservice/pkg/adapter/out/database/databasetest"
+	"github.com/BieggerM/userservice/pkg/models"
+	"github.com/BieggerM/userservice/pkg/service/auth"
 	"github.com/stretchr/testify/assert"
 	"testing"
+	"time"
 )
 
 func TestListUsers(t *testing.T) {
@@ -12,3 +17,97 @@ func TestListUsers(t *testing.T) {
 func TestGetUser(t *testing.T) {
 	assert.True(t, true)
 }
+
+// setupDemo points the globals at an in-memory database and a service checking the shipped breached password list
+func setupDemo(t *testing.T) *databasetest.Memory {
+	db := databasetest.NewMemory()
+	service := &auth.Auth{}
+	policy := auth.DefaultPasswordPolicy
+	policy.BreachedListFile = "config/breached-passwords.txt"
+	assert.NoError(t, service.Setup(db, &brokertest.Recorder{}, auth.Config{
+		KeyDir:            t.TempDir(),
+		KeyRotationLeader: true,
+		TokenTTL:          15 * time.Minute,
+		RefreshTokenTTL:   time.Hour,
+		Audiences:         []string{"recipemanagement"},
+		PasswordParams:    auth.Argon2Params{Memory: 1024, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32},
+		PasswordPolicy:    policy,
+	}))
+	DB = db
+	authService = service
+	return db
+}
+
+// publishedPassword returns the password the demo user was created with by the versions before the first one
+// with a password policy, found on the breached password list by its digest
+func publishedPassword(t *testing.T, username string) string {
+	passwords, err := passwordsByDigest("config/breached-passwords.txt")
+	assert.NoError(t, err)
+	digests := publishedDemoPasswords[username]
+	password, ok := passwords[digests[len(digests)-1]]
+	assert.True(t, ok, "published password of %s is not on the breached password list", username)
+	return password
+}
+
+func TestDemoUsersNeedAPolicyCompliantPassword(t *testing.T) {
+	db := setupDemo(t)
+	for _, password := range []string{"", "short", publishedPassword(t, "user1")} {
+		createDemoUsers(password, false)
+		assert.Empty(t, db.ListUsers(), password)
+	}
+
+	createDemoUsers("Local demo passphrase 7", false)
+	users := db.ListUsers()
+	assert.Len(t, users, 3)
+	for _, user := range users {
+		assert.Equal(t, []string{auth.RoleUser}, user.Roles, user.Username)
+	}
+}
+
+func TestDemoAdminIsOptIn(t *testing.T) {
+	db := setupDemo(t)
+	createDemoUsers("Local demo passphrase 7", true)
+	user, err := db.GetUser("user1")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{auth.RoleAdmin}, user.Roles)
+}
+
+func TestPublishedDemoPasswordsAreLocked(t *testing.T) {
+	db := setupDemo(t)
+	service := authService.(*auth.Auth)
+	for username, password := range map[string]string{"user1": publishedPassword(t, "user1"), "user2": "Local demo passphrase 7"} {
+		hash, err := service.HashPassword(password)
+		assert.NoError(t, err)
+		assert.NoError(t, db.SaveUser(models.User{Username: username, Password: hash, Roles: []string{auth.RoleUser}}))
+	}
+	// the first versions stored the same password for all demo users in plain text
+	assert.NoError(t, db.SaveUser(models.User{Username: "user3", Password: "password", Roles: []string{auth.RoleUser}}))
+
+	issued := map[string]auth.TokenPair{}
+	keys := map[string]string{}
+	for _, username := range []string{"user1", "user2", "user3"} {
+		user, err := db.GetUser(username)
+		assert.NoError(t, err)
+		issued[username], err = service.IssueTokens(user, "", auth.ClientInfo{})
+		assert.NoError(t, err)
+		_, keys[username], err = service.CreateAPIKey(username, "batch", nil, time.Time{})
+		assert.NoError(t, err)
+	}
+	time.Sleep(2 * time.Millisecond)
+
+	lockPublishedDemoPasswords("config/breached-passwords.txt")
+	for username, locked := range map[string]bool{"user1": true, "user2": false, "user3": true} {
+		state, err := db.GetLoginState(username)
+		assert.NoError(t, err)
+		assert.Equal(t, locked, state.LockedUntil.After(time.Now().AddDate(1, 0, 0)), username)
+		_, err = service.ValidateToken(issued[username].AccessToken)
+		assert.Equal(t, locked, err != nil, username)
+		_, err = service.RefreshTokens(issued[username].RefreshToken, auth.ClientInfo{})
+		assert.Equal(t, locked, err != nil, username)
+		_, err = service.ValidateToken(keys[username])
+		assert.Equal(t, locked, err != nil, username)
+		apiKeys, err := db.ListAPIKeys(username)
+		assert.NoError(t, err)
+		assert.Equal(t, locked, apiKeys[0].Revoked, username)
+	}
+}
@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS revoked_tokens (
+    jti VARCHAR(64) PRIMARY KEY,
+    username VARCHAR(255) NOT NULL,
+    expires_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS user_token_revocations (
+    username VARCHAR(255) PRIMARY KEY,
+    revoked_at TIMESTAMPTZ NOT NULL
+);
\ No newline at end of file
@@ -0,0 +1,2 @@
+ALTER TABLE refresh_tokens
+DROP COLUMN audience;
\ No newline at end of file
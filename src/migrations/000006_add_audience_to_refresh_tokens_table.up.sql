@@ -0,0 +1,2 @@
+ALTER TABLE refresh_tokens
+ADD COLUMN audience VARCHAR(255) NOT NULL DEFAULT '';
\ No newline at end of file
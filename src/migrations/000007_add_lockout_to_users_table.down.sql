@@ -0,0 +1,3 @@
+ALTER TABLE users
+DROP COLUMN failed_logins,
+DROP COLUMN locked_until;
\ No newline at end of file
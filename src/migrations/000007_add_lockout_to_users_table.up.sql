@@ -0,0 +1,3 @@
+ALTER TABLE users
+ADD COLUMN failed_logins INTEGER NOT NULL DEFAULT 0,
+ADD COLUMN locked_until TIMESTAMPTZ;
\ No newline at end of file
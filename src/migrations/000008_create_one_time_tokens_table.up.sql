@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS one_time_tokens (
+    token_hash VARCHAR(64) PRIMARY KEY,
+    purpose VARCHAR(32) NOT NULL,
+    username VARCHAR(255) NOT NULL REFERENCES users(username) ON DELETE CASCADE,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    expires_at TIMESTAMPTZ NOT NULL,
+    used_at TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS one_time_tokens_username_purpose_idx ON one_time_tokens (username, purpose);
\ No newline at end of file
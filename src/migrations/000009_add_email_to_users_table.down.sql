@@ -0,0 +1,5 @@
+DROP INDEX IF EXISTS users_email_idx;
+
+ALTER TABLE users
+DROP COLUMN email,
+DROP COLUMN email_verified;
\ No newline at end of file
@@ -0,0 +1,5 @@
+ALTER TABLE users
+ADD COLUMN email VARCHAR(255),
+ADD COLUMN email_verified BOOLEAN NOT NULL DEFAULT false;
+
+CREATE UNIQUE INDEX IF NOT EXISTS users_email_idx ON users (lower(email));
\ No newline at end of file
@@ -0,0 +1,14 @@
+CREATE TABLE IF NOT EXISTS totp_secrets (
+    username VARCHAR(255) PRIMARY KEY REFERENCES users(username) ON DELETE CASCADE,
+    secret VARCHAR(64) NOT NULL,
+    confirmed BOOLEAN NOT NULL DEFAULT false,
+    last_counter BIGINT NOT NULL DEFAULT 0,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS recovery_codes (
+    username VARCHAR(255) NOT NULL REFERENCES users(username) ON DELETE CASCADE,
+    code_hash VARCHAR(64) NOT NULL,
+    used_at TIMESTAMPTZ,
+    PRIMARY KEY (username, code_hash)
+);
\ No newline at end of file
@@ -0,0 +1,5 @@
+ALTER TABLE refresh_tokens
+DROP COLUMN client_id,
+DROP COLUMN scope;
+
+DROP TABLE IF EXISTS oauth_clients;
\ No newline at end of file
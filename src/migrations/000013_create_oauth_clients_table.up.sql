@@ -0,0 +1,13 @@
+CREATE TABLE IF NOT EXISTS oauth_clients (
+    client_id VARCHAR(64) PRIMARY KEY,
+    name VARCHAR(255) NOT NULL,
+    secret_hash VARCHAR(64) NOT NULL,
+    scopes TEXT[] NOT NULL,
+    audiences TEXT[] NOT NULL,
+    grant_types TEXT[] NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+ALTER TABLE refresh_tokens
+ADD COLUMN client_id VARCHAR(64) NOT NULL DEFAULT '',
+ADD COLUMN scope TEXT NOT NULL DEFAULT '';
\ No newline at end of file
@@ -0,0 +1,2 @@
+ALTER TABLE users
+ADD COLUMN source VARCHAR(32) NOT NULL DEFAULT 'local';
\ No newline at end of file
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS users_email_idx;
+
+CREATE UNIQUE INDEX IF NOT EXISTS users_email_idx ON users (lower(email));
\ No newline at end of file
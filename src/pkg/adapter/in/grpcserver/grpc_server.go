@@ -2,10 +2,15 @@ package grpcserver
 
 import (
 	"context"
+	"errors"
 	"github.com/BieggerM/userservice/pkg/service/auth"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
 	"net"
+	"strings"
+	"time"
 
 	"github.com/BieggerM/userservice/pkg/adapter/out/broker"
 	"github.com/BieggerM/userservice/pkg/adapter/out/database"
@@ -17,6 +22,9 @@ import (
 	"google.golang.org/grpc/reflection"
 )
 
+// jwksCacheControl lets clients cache the key set while still picking up rotated keys quickly
+const jwksCacheControl = "public, max-age=300"
+
 type GrpcServer interface {
 	StartGRPCServer(MB broker.MessageBroker, DB database.Database, rlog logger.Logger, auth auth.AuthService)
 }
@@ -37,7 +45,7 @@ func (s *UserServiceServer) StartGRPCServer(MB broker.MessageBroker, DB database
 	if err != nil {
 		logrus.Fatalf("Failed to listen: %v", err)
 	}
-	server := grpc.NewServer()
+	server := grpc.NewServer(grpc.UnaryInterceptor(s.authorize))
 	user.RegisterUserServiceServer(server, s)
 	reflection.Register(server)
 	logrus.Infoln("GRPC Server started")
@@ -51,23 +59,32 @@ func (s *UserServiceServer) ListUsers(ctx context.Context, req *user.Empty) (*us
 	var userList []*user.User
 	for _, u := range users {
 		userList = append(userList, &user.User{
-			Username:  u.Username,
-			Firstname: u.FirstName,
-			Lastname:  u.LastName,
+			Username:      u.Username,
+			Firstname:     u.FirstName,
+			Lastname:      u.LastName,
+			Roles:         u.Roles,
+			Email:         u.Email,
+			EmailVerified: u.EmailVerified,
 		})
 	}
 	return &user.UserListResponse{Users: userList}, nil
 }
 
 func (s *UserServiceServer) GetUser(ctx context.Context, req *user.GetUserRequest) (*user.UserResponse, error) {
+	if err := s.canRead(ctx, req.Username); err != nil {
+		return nil, err
+	}
 	u, err := s.DB.GetUser(req.Username)
 	if err != nil {
 		return nil, status.Errorf(codes.NotFound, "user not found")
 	}
 	return &user.UserResponse{User: &user.User{
-		Username:  u.Username,
-		Firstname: u.FirstName,
-		Lastname:  u.LastName,
+		Username:      u.Username,
+		Firstname:     u.FirstName,
+		Lastname:      u.LastName,
+		Roles:         u.Roles,
+		Email:         u.Email,
+		EmailVerified: u.EmailVerified,
 	}}, nil
 }
 
@@ -76,26 +93,106 @@ func (s *UserServiceServer) CreateUser(ctx context.Context, req *user.User) (*us
 		Username:  req.Username,
 		FirstName: req.Firstname,
 		LastName:  req.Lastname,
+		Roles:     req.Roles,
+		Email:     req.Email,
+	}
+	if err := auth.ValidateUsername(newUser.Username); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "Username must not start with a client id prefix")
+	}
+	if len(newUser.Roles) == 0 {
+		newUser.Roles = auth.DefaultRoles
+	}
+	for _, role := range newUser.Roles {
+		if !auth.IsKnownRole(role) {
+			return nil, status.Errorf(codes.InvalidArgument, "Unknown role %s", role)
+		}
+		if role != auth.RoleUser && !callerClaims(ctx).HasAnyRole(auth.RoleAdmin) {
+			return nil, status.Errorf(codes.PermissionDenied, "Only admins may assign roles")
+		}
 	}
+	if newUser.Email != "" {
+		if err := auth.ValidateEmail(newUser.Email); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "Invalid email address")
+		}
+	}
+	if err := s.auth.CheckPassword(req.Username, req.Password); err != nil {
+		return nil, passwordRejected("password", err)
+	}
+	hash, err := s.auth.HashPassword(req.Password)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Failed to hash password")
+	}
+	newUser.Password = hash
 	if err := s.DB.SaveUser(newUser); err != nil {
+		if errors.Is(err, database.ErrEmailExists) {
+			return nil, status.Errorf(codes.AlreadyExists, "Email address already in use")
+		}
 		return nil, err
 	}
+	if newUser.Email != "" {
+		if err := s.auth.RequestEmailVerification(newUser.Username); err != nil {
+			s.rlog.Error("Failed to request email verification", "username", newUser.Username, "error", err)
+		}
+	}
 	s.rlog.Info("User created", "username", newUser.Username)
+	// the password is write-only and never returned
+	req.Password = ""
+	req.Roles = newUser.Roles
+	req.EmailVerified = false
 	return &user.UserResponse{User: req}, nil
 }
 
 func (s *UserServiceServer) UpdateUser(ctx context.Context, req *user.User) (*user.UserResponse, error) {
+	if err := s.canModify(ctx, req.Username); err != nil {
+		return nil, err
+	}
 	updatedUser := models.User{
 		Username:  req.Username,
 		FirstName: req.Firstname,
 		LastName:  req.Lastname,
 	}
+	if req.Email != "" {
+		old, err := s.DB.GetUser(req.Username)
+		if err != nil {
+			return nil, status.Errorf(codes.NotFound, "user not found")
+		}
+		if !strings.EqualFold(req.Email, old.Email) {
+			if err := s.notImpersonated(ctx, "change email"); err != nil {
+				return nil, err
+			}
+			if err := s.auth.ChangeEmail(req.Username, req.Email); err != nil {
+				switch {
+				case errors.Is(err, auth.ErrInvalidEmail):
+					return nil, status.Errorf(codes.InvalidArgument, "Invalid email address")
+				case errors.Is(err, database.ErrEmailExists):
+					return nil, status.Errorf(codes.AlreadyExists, "Email address already in use")
+				default:
+					return nil, status.Errorf(codes.Internal, "Failed to update email address")
+				}
+			}
+		}
+	}
 	s.DB.UpdateUser(updatedUser)
+	req.Password = ""
+	// the address is unverified after a change, an unchanged one keeps its state
+	if current, err := s.DB.GetUser(req.Username); err == nil {
+		req.Email = current.Email
+		req.EmailVerified = current.EmailVerified
+	}
 	return &user.UserResponse{User: req}, nil
 }
 
 func (s *UserServiceServer) DeleteUser(ctx context.Context, req *user.DeleteUserRequest) (*user.DeleteUserResponse, error) {
+	if err := s.canModify(ctx, req.Username); err != nil {
+		return nil, err
+	}
+	if err := s.notImpersonated(ctx, "delete user"); err != nil {
+		return nil, err
+	}
 	s.DB.DeleteUser(req.Username)
+	if err := s.auth.RevokeUserTokens(req.Username); err != nil {
+		s.rlog.Error("Failed to revoke tokens of deleted user", "username", req.Username, "error", err)
+	}
 	return &user.DeleteUserResponse{Message: "user deleted"}, nil
 }
 
@@ -105,13 +202,515 @@ func (s *UserServiceServer) Auth(ctx context.Context, req *user.AuthRequest) (*u
 		return nil, status.Errorf(codes.Unauthenticated, "Authorization token not provided")
 	}
 
-	valid, err := s.auth.ValidateJWT(token)
+	claims, err := s.auth.ValidateToken(token)
 	if err != nil {
 		return nil, status.Errorf(codes.Unauthenticated, "Failed to validate JWT: %v", err)
 	}
-	if !valid {
-		return nil, status.Errorf(codes.Unauthenticated, "Invalid JWT")
+
+	response := &user.AuthResponse{
+		Message:   "valid JWT",
+		Subject:   claims.Subject,
+		Roles:     claims.Roles,
+		IssuedAt:  claims.IssuedAt,
+		ExpiresAt: claims.ExpiresAt,
+		TokenId:   claims.Id,
+		Audience:  claims.Audience,
+	}
+	if claims.Actor != nil {
+		response.Actor = claims.Actor.Subject
+	}
+	return response, nil
+}
+
+// Login has the same semantics as the REST login: it checks the password and returns an access and refresh token
+func (s *UserServiceServer) Login(ctx context.Context, req *user.LoginRequest) (*user.TokenResponse, error) {
+	if req.Username == "" || req.Password == "" {
+		return nil, status.Errorf(codes.Unauthenticated, "Credentials not provided")
+	}
+	u, err := s.auth.Authenticate(req.Username, req.Password, clientIP(ctx))
+	var locked *auth.LockedError
+	if errors.As(err, &locked) {
+		return nil, status.Errorf(codes.ResourceExhausted, "Too many failed login attempts, retry in %s", locked.RetryAfter(time.Now()))
+	}
+	if errors.Is(err, auth.ErrCredentialBackendUnavailable) {
+		return nil, status.Errorf(codes.Unavailable, "Credential backend unavailable")
+	}
+	if err != nil {
+		s.rlog.Warn("Failed login", "username", req.Username, "ip", clientIP(ctx))
+		return nil, status.Errorf(codes.Unauthenticated, "Invalid credentials")
+	}
+	return s.issueTokens(ctx, u, req.Audience)
+}
+
+// VerifyMFA completes a login of a user with two-factor authentication
+func (s *UserServiceServer) VerifyMFA(ctx context.Context, req *user.VerifyMFARequest) (*user.TokenResponse, error) {
+	if req.MfaToken == "" || req.Code == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "MFA token and code must be provided")
+	}
+	tokens, err := s.auth.VerifyMFA(req.MfaToken, req.Code, req.Audience, clientInfo(ctx))
+	var locked *auth.LockedError
+	if errors.As(err, &locked) {
+		return nil, status.Errorf(codes.ResourceExhausted, "Too many failed login attempts, retry in %s", locked.RetryAfter(time.Now()))
+	}
+	if errors.Is(err, auth.ErrInvalidAudience) {
+		return nil, status.Errorf(codes.InvalidArgument, "Audience is not allowed")
+	}
+	if err != nil {
+		s.rlog.Warn("Failed two-factor login", "ip", clientIP(ctx))
+		return nil, status.Errorf(codes.Unauthenticated, "Invalid two-factor code, log in again")
+	}
+	return &user.TokenResponse{
+		AccessToken:  tokens.AccessToken,
+		RefreshToken: tokens.RefreshToken,
+		ExpiresIn:    tokens.ExpiresIn,
+	}, nil
+}
+
+// issueTokens answers a successful login with an access and refresh token,
+// or with an mfa token for users who still have to provide their second factor
+func (s *UserServiceServer) issueTokens(ctx context.Context, u models.User, audience string) (*user.TokenResponse, error) {
+	tokens, err := s.auth.IssueTokens(u, audience, clientInfo(ctx))
+	var mfa *auth.MFARequiredError
+	if errors.As(err, &mfa) {
+		return &user.TokenResponse{MfaRequired: true, MfaToken: mfa.MFAToken}, nil
+	}
+	if errors.Is(err, auth.ErrInvalidAudience) {
+		return nil, status.Errorf(codes.InvalidArgument, "Audience is not allowed")
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "Failed to authenticate user")
+	}
+	return &user.TokenResponse{
+		AccessToken:  tokens.AccessToken,
+		RefreshToken: tokens.RefreshToken,
+		ExpiresIn:    tokens.ExpiresIn,
+	}, nil
+}
+
+// EnrollTOTP creates a TOTP secret for the authenticator app of the caller
+func (s *UserServiceServer) EnrollTOTP(ctx context.Context, req *user.EnrollTOTPRequest) (*user.EnrollTOTPResponse, error) {
+	if err := s.checkOwnership(ctx, req.Username, "enroll mfa", callerClaims(ctx).Subject == req.Username); err != nil {
+		return nil, err
+	}
+	if err := s.notImpersonated(ctx, "enroll mfa"); err != nil {
+		return nil, err
+	}
+	enrollment, err := s.auth.EnrollTOTP(req.Username)
+	if errors.Is(err, auth.ErrMFAAlreadyEnabled) {
+		return nil, status.Errorf(codes.FailedPrecondition, "Two-factor authentication is already enabled")
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Failed to enroll two-factor authentication")
+	}
+	return &user.EnrollTOTPResponse{Secret: enrollment.Secret, OtpauthUri: enrollment.URI}, nil
+}
+
+// ConfirmTOTP enables two-factor authentication with a first code and returns the recovery codes
+func (s *UserServiceServer) ConfirmTOTP(ctx context.Context, req *user.ConfirmTOTPRequest) (*user.ConfirmTOTPResponse, error) {
+	if err := s.checkOwnership(ctx, req.Username, "enroll mfa", callerClaims(ctx).Subject == req.Username); err != nil {
+		return nil, err
+	}
+	if err := s.notImpersonated(ctx, "enroll mfa"); err != nil {
+		return nil, err
+	}
+	recoveryCodes, err := s.auth.ConfirmTOTP(req.Username, req.Code)
+	switch {
+	case errors.Is(err, auth.ErrInvalidMFACode):
+		return nil, status.Errorf(codes.InvalidArgument, "Invalid two-factor code")
+	case errors.Is(err, auth.ErrMFANotEnrolled), errors.Is(err, auth.ErrMFAAlreadyEnabled):
+		return nil, status.Errorf(codes.FailedPrecondition, "%v", err)
+	case err != nil:
+		return nil, status.Errorf(codes.Internal, "Failed to enable two-factor authentication")
+	}
+	s.rlog.Info("Two-factor authentication enabled", "username", req.Username)
+	return &user.ConfirmTOTPResponse{Message: "two-factor authentication enabled", RecoveryCodes: recoveryCodes}, nil
+}
+
+// ResetMFA removes the second factor of a user
+func (s *UserServiceServer) ResetMFA(ctx context.Context, req *user.ResetMFARequest) (*user.ResetMFAResponse, error) {
+	if err := s.notImpersonated(ctx, "reset mfa"); err != nil {
+		return nil, err
 	}
+	if err := s.auth.ResetMFA(req.Username); err != nil {
+		if errors.Is(err, auth.ErrUserNotFound) {
+			return nil, status.Errorf(codes.NotFound, "user not found")
+		}
+		return nil, status.Errorf(codes.Internal, "Failed to reset two-factor authentication")
+	}
+	s.rlog.Info("Two-factor authentication reset", "username", req.Username, "caller", callerClaims(ctx).Subject)
+	return &user.ResetMFAResponse{Message: "two-factor authentication reset"}, nil
+}
 
-	return &user.AuthResponse{Message: "valid JWT"}, nil
+// ChangePassword sets a new password and revokes all tokens of the user.
+// The current password is required unless an admin changes the password of another user.
+func (s *UserServiceServer) ChangePassword(ctx context.Context, req *user.ChangePasswordRequest) (*user.ChangePasswordResponse, error) {
+	if err := s.canModify(ctx, req.Username); err != nil {
+		return nil, err
+	}
+	if err := s.notImpersonated(ctx, "change password"); err != nil {
+		return nil, err
+	}
+	if req.NewPassword == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "New password not provided")
+	}
+	if err := s.auth.CheckPassword(req.Username, req.NewPassword); err != nil {
+		return nil, passwordRejected("new_password", err)
+	}
+	if callerClaims(ctx).Subject == req.Username {
+		if _, err := s.auth.Authenticate(req.Username, req.OldPassword, clientIP(ctx)); err != nil {
+			return nil, status.Errorf(codes.PermissionDenied, "Incorrect password")
+		}
+	}
+	if err := s.auth.ChangePassword(req.Username, req.NewPassword); err != nil {
+		if errors.Is(err, auth.ErrExternalCredentials) {
+			return nil, status.Errorf(codes.FailedPrecondition, "Password is managed by an external directory")
+		}
+		return nil, status.Errorf(codes.Internal, "Failed to update password")
+	}
+	s.rlog.Info("Password changed", "username", req.Username, "caller", callerClaims(ctx).Subject)
+	return &user.ChangePasswordResponse{Message: "password changed"}, nil
+}
+
+// UnlockUser lifts a lockout after too many failed logins
+func (s *UserServiceServer) UnlockUser(ctx context.Context, req *user.UnlockUserRequest) (*user.UnlockUserResponse, error) {
+	if err := s.auth.Unlock(req.Username); err != nil {
+		return nil, status.Errorf(codes.NotFound, "user not found")
+	}
+	s.rlog.Info("User unlocked", "username", req.Username, "caller", callerClaims(ctx).Subject)
+	return &user.UnlockUserResponse{Message: "user unlocked"}, nil
+}
+
+// ImpersonateUser issues a short-lived token for the user to an admin, carrying the admin as actor
+func (s *UserServiceServer) ImpersonateUser(ctx context.Context, req *user.ImpersonateUserRequest) (*user.ImpersonateUserResponse, error) {
+	caller := callerClaims(ctx)
+	tokens, err := s.auth.Impersonate(caller, req.Username, req.Audience, req.Reason, clientInfo(ctx))
+	switch {
+	case errors.Is(err, auth.ErrUserNotFound):
+		return nil, status.Errorf(codes.NotFound, "user not found")
+	case errors.Is(err, auth.ErrNestedImpersonation), errors.Is(err, auth.ErrSelfImpersonation):
+		return nil, status.Errorf(codes.PermissionDenied, "%v", err)
+	case errors.Is(err, auth.ErrInvalidAudience):
+		return nil, status.Errorf(codes.InvalidArgument, "Audience is not allowed")
+	case err != nil:
+		s.rlog.Error("Failed to impersonate user", "username", req.Username, "caller", caller.Subject, "error", err)
+		return nil, status.Errorf(codes.Internal, "Failed to impersonate user")
+	}
+	s.rlog.Warn("User impersonated", "username", req.Username, "caller", caller.Subject, "ip", clientIP(ctx))
+	return &user.ImpersonateUserResponse{
+		AccessToken: tokens.AccessToken,
+		ExpiresIn:   tokens.ExpiresIn,
+		Actor:       caller.Subject,
+	}, nil
+}
+
+func (s *UserServiceServer) RefreshToken(ctx context.Context, req *user.RefreshTokenRequest) (*user.TokenResponse, error) {
+	if req.RefreshToken == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "Refresh token not provided")
+	}
+	tokens, err := s.auth.RefreshTokens(req.RefreshToken, clientInfo(ctx))
+	if errors.Is(err, auth.ErrRefreshTokenReused) {
+		s.rlog.Warn("Refresh token reuse detected, token family revoked")
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "Invalid refresh token")
+	}
+	return &user.TokenResponse{
+		AccessToken:  tokens.AccessToken,
+		RefreshToken: tokens.RefreshToken,
+		ExpiresIn:    tokens.ExpiresIn,
+	}, nil
+}
+
+func (s *UserServiceServer) Logout(ctx context.Context, req *user.LogoutRequest) (*user.LogoutResponse, error) {
+	if req.Token == "" {
+		return nil, status.Errorf(codes.Unauthenticated, "Authorization token not provided")
+	}
+	if err := s.auth.Logout(req.Token, req.RefreshToken); err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "Failed to log out: %v", err)
+	}
+	return &user.LogoutResponse{Message: "logged out"}, nil
+}
+
+// RequestPasswordReset sends a reset token to the user via the mail service.
+// The answer is the same whether the user exists or not.
+func (s *UserServiceServer) RequestPasswordReset(ctx context.Context, req *user.PasswordResetRequest) (*user.PasswordResetResponse, error) {
+	if req.Username == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "Username not provided")
+	}
+	err := s.auth.RequestPasswordReset(req.Username, clientIP(ctx))
+	var throttled *auth.ThrottledError
+	if errors.As(err, &throttled) {
+		return nil, status.Errorf(codes.ResourceExhausted, "Too many requests, retry in %s", throttled.RetryAfter(time.Now()))
+	}
+	if err != nil {
+		s.rlog.Error("Failed to request password reset", "username", req.Username, "error", err)
+	}
+	return &user.PasswordResetResponse{Message: "if the user exists, a password reset has been sent"}, nil
+}
+
+// ResetPassword sets a new password with a reset token
+func (s *UserServiceServer) ResetPassword(ctx context.Context, req *user.ResetPasswordRequest) (*user.PasswordResetResponse, error) {
+	if req.Token == "" || req.NewPassword == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "Token and new password must be provided")
+	}
+	username, err := s.auth.ResetPassword(req.Token, req.NewPassword)
+	if errors.Is(err, auth.ErrInvalidResetToken) {
+		return nil, status.Errorf(codes.InvalidArgument, "Invalid or expired reset token")
+	}
+	var policyErr *auth.PolicyError
+	if errors.As(err, &policyErr) {
+		return nil, passwordRejected("new_password", err)
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Failed to reset password")
+	}
+	s.rlog.Info("Password reset", "username", username)
+	return &user.PasswordResetResponse{Message: "password reset"}, nil
+}
+
+// RequestMagicLink sends a login link to the verified email address of the user via the mail service.
+// The answer is the same whether the user exists or not.
+func (s *UserServiceServer) RequestMagicLink(ctx context.Context, req *user.MagicLinkRequest) (*user.MagicLinkResponse, error) {
+	if req.Username == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "Username not provided")
+	}
+	err := s.auth.RequestMagicLink(req.Username, clientIP(ctx))
+	var throttled *auth.ThrottledError
+	if errors.As(err, &throttled) {
+		return nil, status.Errorf(codes.ResourceExhausted, "Too many requests, retry in %s", throttled.RetryAfter(time.Now()))
+	}
+	if err != nil {
+		s.rlog.Error("Failed to request login link", "username", req.Username, "error", err)
+	}
+	return &user.MagicLinkResponse{Message: "if the user exists, a login link has been sent"}, nil
+}
+
+// RedeemMagicLink has the same semantics as Login, with the token of a login link instead of a password
+func (s *UserServiceServer) RedeemMagicLink(ctx context.Context, req *user.RedeemMagicLinkRequest) (*user.TokenResponse, error) {
+	if req.Token == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "Token not provided")
+	}
+	u, err := s.auth.RedeemMagicLink(req.Token)
+	var locked *auth.LockedError
+	if errors.As(err, &locked) {
+		return nil, status.Errorf(codes.ResourceExhausted, "Too many failed login attempts, retry in %s", locked.RetryAfter(time.Now()))
+	}
+	if err != nil {
+		s.rlog.Warn("Failed login link", "ip", clientIP(ctx))
+		return nil, status.Errorf(codes.Unauthenticated, "Invalid or expired login link")
+	}
+	return s.issueTokens(ctx, u, req.Audience)
+}
+
+// RequestEmailVerification sends a new verification token to the email address of the user
+func (s *UserServiceServer) RequestEmailVerification(ctx context.Context, req *user.EmailVerificationRequest) (*user.EmailVerificationResponse, error) {
+	if err := s.canModify(ctx, req.Username); err != nil {
+		return nil, err
+	}
+	err := s.auth.RequestEmailVerification(req.Username)
+	switch {
+	case errors.Is(err, auth.ErrUserNotFound):
+		return nil, status.Errorf(codes.NotFound, "user not found")
+	case errors.Is(err, auth.ErrInvalidEmail), errors.Is(err, auth.ErrEmailAlreadyVerified):
+		return nil, status.Errorf(codes.FailedPrecondition, "%v", err)
+	case err != nil:
+		return nil, status.Errorf(codes.Internal, "Failed to request email verification")
+	}
+	return &user.EmailVerificationResponse{Message: "verification sent", Username: req.Username}, nil
+}
+
+// VerifyEmail confirms an email address with the token sent to it
+func (s *UserServiceServer) VerifyEmail(ctx context.Context, req *user.VerifyEmailRequest) (*user.EmailVerificationResponse, error) {
+	if req.Token == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "Token not provided")
+	}
+	username, err := s.auth.VerifyEmail(req.Token)
+	if errors.Is(err, auth.ErrInvalidVerificationToken) {
+		return nil, status.Errorf(codes.InvalidArgument, "Invalid or expired verification token")
+	}
+	if errors.Is(err, database.ErrEmailExists) {
+		return nil, status.Errorf(codes.AlreadyExists, "Email address already in use")
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Failed to verify email address")
+	}
+	s.rlog.Info("Email verified", "username", username)
+	return &user.EmailVerificationResponse{Message: "email verified", Username: username}, nil
+}
+
+// CreateAPIKey creates a named, scoped key for the user. The key is only returned once.
+func (s *UserServiceServer) CreateAPIKey(ctx context.Context, req *user.CreateAPIKeyRequest) (*user.CreateAPIKeyResponse, error) {
+	if err := s.canModify(ctx, req.Username); err != nil {
+		return nil, err
+	}
+	// keys cannot be used to mint further keys, which would outlive a revoked key
+	if callerClaims(ctx).APIKeyID != "" {
+		return nil, status.Errorf(codes.PermissionDenied, "API keys cannot create API keys")
+	}
+	// nor may support staff leave a key behind in an account they impersonate
+	if err := s.notImpersonated(ctx, "create api key"); err != nil {
+		return nil, err
+	}
+	if req.Name == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "Name not provided")
+	}
+	var expiresAt time.Time
+	if req.ExpiresAt != 0 {
+		expiresAt = time.Unix(req.ExpiresAt, 0)
+		if !expiresAt.After(time.Now()) {
+			return nil, status.Errorf(codes.InvalidArgument, "Expiry must be in the future")
+		}
+	}
+	key, secret, err := s.auth.CreateAPIKey(req.Username, req.Name, req.Scopes, expiresAt)
+	switch {
+	case errors.Is(err, auth.ErrUserNotFound):
+		return nil, status.Errorf(codes.NotFound, "user not found")
+	case errors.Is(err, auth.ErrInvalidScope):
+		return nil, status.Errorf(codes.InvalidArgument, "%v", err)
+	case err != nil:
+		return nil, status.Errorf(codes.Internal, "Failed to create API key")
+	}
+	s.rlog.Info("API key created", "username", req.Username, "key", key.ID, "caller", callerClaims(ctx).Subject)
+	return &user.CreateAPIKeyResponse{ApiKey: apiKeyMessage(key), Key: secret}, nil
+}
+
+func (s *UserServiceServer) ListAPIKeys(ctx context.Context, req *user.ListAPIKeysRequest) (*user.ListAPIKeysResponse, error) {
+	if err := s.canModify(ctx, req.Username); err != nil {
+		return nil, err
+	}
+	keys, err := s.auth.ListAPIKeys(req.Username)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Failed to list API keys")
+	}
+	var apiKeys []*user.ApiKey
+	for _, key := range keys {
+		apiKeys = append(apiKeys, apiKeyMessage(key))
+	}
+	return &user.ListAPIKeysResponse{ApiKeys: apiKeys}, nil
+}
+
+func (s *UserServiceServer) RevokeAPIKey(ctx context.Context, req *user.RevokeAPIKeyRequest) (*user.RevokeAPIKeyResponse, error) {
+	if err := s.canModify(ctx, req.Username); err != nil {
+		return nil, err
+	}
+	if err := s.notImpersonated(ctx, "revoke api key"); err != nil {
+		return nil, err
+	}
+	if err := s.auth.RevokeAPIKey(req.Username, req.Id); err != nil {
+		return nil, status.Errorf(codes.NotFound, "API key not found")
+	}
+	s.rlog.Info("API key revoked", "username", req.Username, "key", req.Id, "caller", callerClaims(ctx).Subject)
+	return &user.RevokeAPIKeyResponse{Message: "api key revoked"}, nil
+}
+
+// apiKeyMessage describes a key without its secret, unset times are 0
+func apiKeyMessage(key models.APIKey) *user.ApiKey {
+	message := &user.ApiKey{
+		Id:        key.ID,
+		Name:      key.Name,
+		Username:  key.Username,
+		Scopes:    key.Scopes,
+		CreatedAt: key.CreatedAt.Unix(),
+		Revoked:   key.Revoked,
+	}
+	if !key.ExpiresAt.IsZero() {
+		message.ExpiresAt = key.ExpiresAt.Unix()
+	}
+	if !key.LastUsedAt.IsZero() {
+		message.LastUsedAt = key.LastUsedAt.Unix()
+	}
+	return message
+}
+
+// ListSessions lists the active logins of a user, of the caller if no username is given
+func (s *UserServiceServer) ListSessions(ctx context.Context, req *user.ListSessionsRequest) (*user.ListSessionsResponse, error) {
+	username := req.Username
+	if username == "" {
+		username = callerClaims(ctx).Subject
+	}
+	if err := s.canModify(ctx, username); err != nil {
+		return nil, err
+	}
+	sessions, err := s.auth.ListSessions(username)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Failed to list sessions")
+	}
+	var response []*user.Session
+	for _, session := range sessions {
+		response = append(response, &user.Session{
+			Id:         session.ID,
+			Audience:   session.Audience,
+			Ip:         session.IP,
+			UserAgent:  session.UserAgent,
+			CreatedAt:  session.CreatedAt.Unix(),
+			LastUsedAt: session.LastUsedAt.Unix(),
+			ExpiresAt:  session.ExpiresAt.Unix(),
+			Current:    session.ID == callerClaims(ctx).SessionID,
+		})
+	}
+	return &user.ListSessionsResponse{Sessions: response}, nil
+}
+
+// RevokeSession ends a login of a user, of the caller if no username is given
+func (s *UserServiceServer) RevokeSession(ctx context.Context, req *user.RevokeSessionRequest) (*user.RevokeSessionResponse, error) {
+	username := req.Username
+	if username == "" {
+		username = callerClaims(ctx).Subject
+	}
+	if err := s.canModify(ctx, username); err != nil {
+		return nil, err
+	}
+	if err := s.notImpersonated(ctx, "revoke session"); err != nil {
+		return nil, err
+	}
+	if err := s.auth.RevokeSession(username, req.Id); err != nil {
+		if errors.Is(err, auth.ErrSessionNotFound) {
+			return nil, status.Errorf(codes.NotFound, "session not found")
+		}
+		return nil, status.Errorf(codes.Internal, "Failed to revoke session")
+	}
+	s.rlog.Info("Session revoked", "username", username, "session", req.Id, "caller", callerClaims(ctx).Subject)
+	return &user.RevokeSessionResponse{Message: "session revoked"}, nil
+}
+
+func (s *UserServiceServer) GetJWKS(ctx context.Context, req *user.Empty) (*user.JwksResponse, error) {
+	if err := grpc.SetHeader(ctx, metadata.Pairs("cache-control", jwksCacheControl)); err != nil {
+		s.rlog.Warn("Failed to set cache header", "error", err)
+	}
+	var keys []*user.JsonWebKey
+	for _, k := range s.auth.JWKS().Keys {
+		keys = append(keys, &user.JsonWebKey{
+			Kty: k.Kty,
+			Kid: k.Kid,
+			Alg: k.Alg,
+			Use: k.Use,
+			N:   k.N,
+			E:   k.E,
+			Crv: k.Crv,
+			X:   k.X,
+			Y:   k.Y,
+		})
+	}
+	return &user.JwksResponse{Keys: keys}, nil
+}
+
+// passwordRejected returns an InvalidArgument status listing the violated password rules
+// of the given request field as BadRequest details
+func passwordRejected(field string, err error) error {
+	var policyErr *auth.PolicyError
+	if !errors.As(err, &policyErr) {
+		return status.Errorf(codes.Internal, "Failed to check password")
+	}
+	badRequest := &errdetails.BadRequest{}
+	for _, violation := range policyErr.Violations {
+		badRequest.FieldViolations = append(badRequest.FieldViolations, &errdetails.BadRequest_FieldViolation{
+			Field:       field,
+			Description: violation,
+		})
+	}
+	st, detailErr := status.New(codes.InvalidArgument, "Password does not meet the policy").WithDetails(badRequest)
+	if detailErr != nil {
+		return status.Errorf(codes.InvalidArgument, "%v", policyErr)
+	}
+	return st.Err()
 }
@@ -0,0 +1,165 @@
+package grpcserver
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/BieggerM/userservice/pkg/adapter/out/broker/brokertest"
+	"github.com/BieggerM/userservice/pkg/adapter/out/database/databasetest"
+	"github.com/BieggerM/userservice/pkg/models"
+	"github.com/BieggerM/userservice/pkg/service/auth"
+	"github.com/BieggerM/userservice/proto/user"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"testing"
+	"time"
+)
+
+type nopLogger struct{}
+
+func (nopLogger) Setup(fluentHost string, fluentPort int, tag string) error { return nil }
+func (nopLogger) Close() error                                              { return nil }
+func (nopLogger) Info(message string, fields ...interface{})                {}
+func (nopLogger) Warn(message string, fields ...interface{})                {}
+func (nopLogger) Error(message string, fields ...interface{})               {}
+func (nopLogger) Debug(message string, fields ...interface{})               {}
+func (nopLogger) Fatal(message string, fields ...interface{})               {}
+
+type testServer struct {
+	*UserServiceServer
+	db      *databasetest.Memory
+	mb      *brokertest.Recorder
+	service *auth.Auth
+}
+
+func setupServer(t *testing.T) *testServer {
+	db := databasetest.NewMemory()
+	mb := &brokertest.Recorder{}
+	service := &auth.Auth{}
+	assert.NoError(t, service.Setup(db, mb, auth.Config{
+		KeyDir:            t.TempDir(),
+		KeyRotationLeader: true,
+		TokenTTL:          15 * time.Minute,
+		Issuer:            "http://localhost:8082",
+		PublicURL:         "http://localhost:8082",
+		Audiences:         []string{"recipemanagement"},
+		Leeway:            30 * time.Second,
+		PasswordParams:    auth.Argon2Params{Memory: 1024, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32},
+	}))
+	s := &UserServiceServer{DB: db, MB: mb, rlog: nopLogger{}, auth: service}
+	return &testServer{UserServiceServer: s, db: db, mb: mb, service: service}
+}
+
+// tokenFor issues an access token of the user with the given roles
+func (s *testServer) tokenFor(t *testing.T, username string, roles ...string) string {
+	token, err := s.service.GenerateJWT(models.User{Username: username, Roles: roles}, "")
+	assert.NoError(t, err)
+	return token
+}
+
+// withToken returns the context of an incoming call carrying the token like clients send it
+func withToken(token string) context.Context {
+	if token == "" {
+		return context.Background()
+	}
+	return metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", "Bearer "+token))
+}
+
+// callerContext returns the context a handler sees after the interceptor accepted the token
+func (s *testServer) callerContext(t *testing.T, username string, roles ...string) context.Context {
+	claims, err := s.service.ValidateToken(s.tokenFor(t, username, roles...))
+	assert.NoError(t, err)
+	return context.WithValue(withToken("unused"), claimsKey{}, claims)
+}
+
+func TestUpdateUserReportsEmailVerification(t *testing.T) {
+	s := setupServer(t)
+	assert.NoError(t, s.db.SaveUser(models.User{Username: "user1", Email: "jane@example.com", Roles: []string{auth.RoleUser}}))
+	assert.NoError(t, s.db.MarkEmailVerified("user1"))
+	ctx := s.callerContext(t, "user1", auth.RoleUser)
+
+	res, err := s.UpdateUser(ctx, &user.User{Username: "user1", Firstname: "Jane", Email: "jane@example.com"})
+	assert.NoError(t, err)
+	assert.True(t, res.User.EmailVerified)
+
+	res, err = s.UpdateUser(ctx, &user.User{Username: "user1", Firstname: "Jane", Email: "jane.doe@example.com"})
+	assert.NoError(t, err)
+	assert.Equal(t, "jane.doe@example.com", res.User.Email)
+	assert.False(t, res.User.EmailVerified)
+}
+
+func TestClientIDsAreNotUsernames(t *testing.T) {
+	s := setupServer(t)
+	_, err := s.CreateUser(s.callerContext(t, "admin1", auth.RoleAdmin), &user.User{Username: "cl_0123456789abcdef", Password: "Brand new passphrase 42"})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = s.db.GetUser("cl_0123456789abcdef")
+	assert.Error(t, err)
+}
+
+func TestMagicLinkLogsIn(t *testing.T) {
+	s := setupServer(t)
+	assert.NoError(t, s.db.SaveUser(models.User{Username: "user1", Email: "user1@example.com", Roles: []string{auth.RoleUser}}))
+	assert.NoError(t, s.db.MarkEmailVerified("user1"))
+	ctx := withToken("")
+
+	_, err := s.RequestMagicLink(ctx, &user.MagicLinkRequest{})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	// unknown users get the same answer
+	for _, username := range []string{"user1", "nobody"} {
+		_, err = s.RequestMagicLink(ctx, &user.MagicLinkRequest{Username: username})
+		assert.NoError(t, err)
+	}
+	assert.Eventually(t, func() bool {
+		return len(s.mb.Messages("users.magic_link_requested")) > 0
+	}, time.Second, 10*time.Millisecond)
+	messages := s.mb.Messages("users.magic_link_requested")
+	assert.Len(t, messages, 1)
+	var event struct {
+		Token string `json:"token"`
+	}
+	assert.NoError(t, json.Unmarshal(messages[0].Body, &event))
+
+	_, err = s.RedeemMagicLink(ctx, &user.RedeemMagicLinkRequest{})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	res, err := s.RedeemMagicLink(ctx, &user.RedeemMagicLinkRequest{Token: event.Token})
+	assert.NoError(t, err)
+	claims, err := s.service.ValidateToken(res.AccessToken)
+	assert.NoError(t, err)
+	assert.Equal(t, "user1", claims.Subject)
+
+	// links can be used once
+	_, err = s.RedeemMagicLink(ctx, &user.RedeemMagicLinkRequest{Token: event.Token})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+}
+
+func TestImpersonationCannotTakeOverAccount(t *testing.T) {
+	s := setupServer(t)
+	assert.NoError(t, s.db.SaveUser(models.User{Username: "user1", Email: "user1@example.com", Roles: []string{auth.RoleUser}}))
+	admin, err := s.service.ValidateToken(s.tokenFor(t, "admin1", auth.RoleAdmin))
+	assert.NoError(t, err)
+	tokens, err := s.service.Impersonate(admin, "user1", "", "ticket 4711", auth.ClientInfo{})
+	assert.NoError(t, err)
+	claims, err := s.service.ValidateToken(tokens.AccessToken)
+	assert.NoError(t, err)
+	ctx := context.WithValue(withToken("unused"), claimsKey{}, claims)
+
+	_, err = s.ChangePassword(ctx, &user.ChangePasswordRequest{Username: "user1", NewPassword: "Brand new passphrase 42"})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = s.UpdateUser(ctx, &user.User{Username: "user1", Email: "attacker@example.com"})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = s.EnrollTOTP(ctx, &user.EnrollTOTPRequest{Username: "user1"})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = s.ResetMFA(ctx, &user.ResetMFARequest{Username: "user1"})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = s.RevokeSession(ctx, &user.RevokeSessionRequest{Id: "s1"})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = s.CreateAPIKey(ctx, &user.CreateAPIKeyRequest{Username: "user1", Name: "backdoor"})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = s.DeleteUser(ctx, &user.DeleteUserRequest{Username: "user1"})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	stored, err := s.db.GetUser("user1")
+	assert.NoError(t, err)
+	assert.Equal(t, "user1@example.com", stored.Email)
+}
@@ -0,0 +1,142 @@
+package grpcserver
+
+import (
+	"context"
+	"github.com/BieggerM/userservice/pkg/service/auth"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"net"
+	"strings"
+)
+
+// claimsKey is the context key of the claims of the authenticated caller
+type claimsKey struct{}
+
+// public marks RPCs that can be called without a token
+var public = []string{}
+
+// RPCRoles maps each RPC to the roles allowed to call it.
+// RPCs missing from the table are denied. Routes doing the same must allow the same roles.
+var RPCRoles = map[string][]string{
+	"/user.UserService/ListUsers":                {auth.RoleAdmin, auth.RoleService},
+	"/user.UserService/GetUser":                  {auth.RoleAdmin, auth.RoleService, auth.RoleUser},
+	"/user.UserService/CreateUser":               {auth.RoleAdmin, auth.RoleService},
+	"/user.UserService/UpdateUser":               {auth.RoleAdmin, auth.RoleUser},
+	"/user.UserService/DeleteUser":               {auth.RoleAdmin, auth.RoleUser},
+	"/user.UserService/ChangePassword":           {auth.RoleAdmin, auth.RoleUser},
+	"/user.UserService/UnlockUser":               {auth.RoleAdmin},
+	"/user.UserService/ImpersonateUser":          {auth.RoleAdmin},
+	"/user.UserService/RequestEmailVerification": {auth.RoleAdmin, auth.RoleUser},
+	"/user.UserService/EnrollTOTP":               {auth.RoleAdmin, auth.RoleUser},
+	"/user.UserService/ConfirmTOTP":              {auth.RoleAdmin, auth.RoleUser},
+	"/user.UserService/ResetMFA":                 {auth.RoleAdmin},
+	"/user.UserService/CreateAPIKey":             {auth.RoleAdmin, auth.RoleUser, auth.RoleService},
+	"/user.UserService/ListAPIKeys":              {auth.RoleAdmin, auth.RoleUser, auth.RoleService},
+	"/user.UserService/ListSessions":             {auth.RoleAdmin, auth.RoleUser, auth.RoleService},
+	"/user.UserService/RevokeSession":            {auth.RoleAdmin, auth.RoleUser, auth.RoleService},
+	"/user.UserService/RevokeAPIKey":             {auth.RoleAdmin, auth.RoleUser, auth.RoleService},
+	"/user.UserService/Auth":                     public,
+	"/user.UserService/Login":                    public,
+	"/user.UserService/GetJWKS":                  public,
+	"/user.UserService/RefreshToken":             public,
+	"/user.UserService/Logout":                   public,
+	"/user.UserService/RequestPasswordReset":     public,
+	"/user.UserService/ResetPassword":            public,
+	"/user.UserService/RequestMagicLink":         public,
+	"/user.UserService/RedeemMagicLink":          public,
+	"/user.UserService/VerifyEmail":              public,
+	"/user.UserService/VerifyMFA":                public,
+}
+
+// authorize is a unary interceptor enforcing the permission table for every RPC
+func (s *UserServiceServer) authorize(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	roles, ok := RPCRoles[info.FullMethod]
+	if !ok {
+		return nil, status.Errorf(codes.PermissionDenied, "Access denied")
+	}
+	if len(roles) == 0 {
+		return handler(ctx, req)
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	tokens := md.Get("authorization")
+	if len(tokens) == 0 || tokens[0] == "" {
+		return nil, status.Errorf(codes.Unauthenticated, "Authorization token not provided")
+	}
+	// accept "Bearer <token>" like the REST API as well as the bare token
+	token := tokens[0]
+	if scheme, value, found := strings.Cut(token, " "); found && strings.EqualFold(scheme, "Bearer") {
+		token = value
+	}
+	// API keys are accepted wherever a JWT is
+	claims, err := s.auth.ValidateToken(token)
+	if err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "Invalid token")
+	}
+	if !claims.HasAnyRole(roles...) {
+		s.rlog.Warn("Access denied", "username", claims.UserID, "method", info.FullMethod)
+		return nil, status.Errorf(codes.PermissionDenied, "Access denied")
+	}
+	return handler(context.WithValue(ctx, claimsKey{}, claims), req)
+}
+
+// callerClaims returns the claims of the authenticated caller
+func callerClaims(ctx context.Context) *auth.Claims {
+	claims, _ := ctx.Value(claimsKey{}).(*auth.Claims)
+	return claims
+}
+
+// canRead checks that the caller may read the account of target
+func (s *UserServiceServer) canRead(ctx context.Context, target string) error {
+	return s.checkOwnership(ctx, target, "read", callerClaims(ctx).CanRead(target))
+}
+
+// canModify checks that the caller may change the account of target
+func (s *UserServiceServer) canModify(ctx context.Context, target string) error {
+	return s.checkOwnership(ctx, target, "modify", callerClaims(ctx).CanModify(target))
+}
+
+// notImpersonated fails with PermissionDenied if the caller acts on behalf of another user
+func (s *UserServiceServer) notImpersonated(ctx context.Context, action string) error {
+	claims := callerClaims(ctx)
+	if err := claims.CheckNotImpersonated(); err != nil {
+		method, _ := grpc.Method(ctx)
+		s.rlog.Warn("Change by impersonation token denied", "caller", claims.UserID, "actor", claims.Actor.Subject, "action", action, "method", method)
+		return status.Errorf(codes.PermissionDenied, "Impersonation tokens cannot change credentials, email addresses or sessions")
+	}
+	return nil
+}
+
+func (s *UserServiceServer) checkOwnership(ctx context.Context, target, action string, allowed bool) error {
+	if allowed {
+		return nil
+	}
+	method, _ := grpc.Method(ctx)
+	s.rlog.Warn("Access to foreign account denied", "caller", callerClaims(ctx).UserID, "target", target, "action", action, "method", method)
+	return status.Errorf(codes.PermissionDenied, "Access denied")
+}
+
+// clientInfo describes the calling client for the session inventory
+func clientInfo(ctx context.Context) auth.ClientInfo {
+	info := auth.ClientInfo{IP: clientIP(ctx)}
+	md, _ := metadata.FromIncomingContext(ctx)
+	if userAgent := md.Get("user-agent"); len(userAgent) > 0 {
+		info.UserAgent = userAgent[0]
+	}
+	return info
+}
+
+// clientIP returns the address of the caller for per address login throttling
+func clientIP(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(p.Addr.String())
+	if err != nil {
+		return p.Addr.String()
+	}
+	return host
+}
@@ -0,0 +1,209 @@
+package grpcserver
+
+import (
+	"context"
+	"github.com/BieggerM/userservice/pkg/adapter/in/restserver"
+	"github.com/BieggerM/userservice/pkg/models"
+	"github.com/BieggerM/userservice/pkg/service/auth"
+	"github.com/BieggerM/userservice/proto/user"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"testing"
+	"time"
+)
+
+func TestRPCRoles(t *testing.T) {
+	s := setupServer(t)
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) { return "called", nil }
+
+	methods := []string{"/user.UserService/Unlisted"}
+	for method := range RPCRoles {
+		methods = append(methods, method)
+	}
+	for _, method := range methods {
+		allowed, listed := RPCRoles[method]
+		for _, role := range []string{"", auth.RoleUser, auth.RoleService, auth.RoleAdmin} {
+			t.Run(method+" as "+role, func(t *testing.T) {
+				token := ""
+				if role != "" {
+					token = s.tokenFor(t, "user1", role)
+				}
+				want := codes.OK
+				switch {
+				case !listed:
+					want = codes.PermissionDenied
+				case len(allowed) == 0:
+				case role == "":
+					want = codes.Unauthenticated
+				case !containsString(allowed, role):
+					want = codes.PermissionDenied
+				}
+				_, err := s.authorize(withToken(token), nil, &grpc.UnaryServerInfo{FullMethod: method}, handler)
+				assert.Equal(t, want, status.Code(err))
+			})
+		}
+	}
+}
+
+// TestTransportsAgree checks that every RPC allows the same roles as the route doing the same
+func TestTransportsAgree(t *testing.T) {
+	routes := map[string]string{
+		"ListUsers":                "GET /api/v1/users",
+		"GetUser":                  "GET /api/v1/users/:username",
+		"CreateUser":               "POST /api/v1/users",
+		"UpdateUser":               "PATCH /api/v1/users",
+		"DeleteUser":               "DELETE /api/v1/users",
+		"UnlockUser":               "POST /api/v1/users/:username/unlock",
+		"ImpersonateUser":          "POST /api/v1/users/:username/impersonate",
+		"RequestEmailVerification": "POST /api/v1/users/:username/email-verification",
+		"EnrollTOTP":               "POST /api/v1/users/:username/mfa/totp",
+		"ConfirmTOTP":              "POST /api/v1/users/:username/mfa/totp/confirm",
+		"ResetMFA":                 "DELETE /api/v1/users/:username/mfa",
+		"CreateAPIKey":             "POST /api/v1/users/:username/api-keys",
+		"ListAPIKeys":              "GET /api/v1/users/:username/api-keys",
+		"RevokeAPIKey":             "DELETE /api/v1/users/:username/api-keys/:id",
+		"ListSessions":             "GET /api/v1/auth/sessions",
+		"RevokeSession":            "DELETE /api/v1/auth/sessions/:id",
+		"Auth":                     "GET /api/v1/auth",
+		"Login":                    "POST /api/v1/auth",
+		"VerifyMFA":                "POST /api/v1/auth/mfa",
+		"RefreshToken":             "POST /api/v1/auth/refresh",
+		"Logout":                   "POST /api/v1/auth/logout",
+		"RequestPasswordReset":     "POST /api/v1/auth/password-reset",
+		"ResetPassword":            "POST /api/v1/auth/password-reset/confirm",
+		"RequestMagicLink":         "POST /api/v1/auth/magic-link",
+		"RedeemMagicLink":          "POST /api/v1/auth/magic-link/confirm",
+		"VerifyEmail":              "POST /api/v1/auth/verify-email",
+		"GetJWKS":                  "GET /.well-known/jwks.json",
+		// passwords are changed with PATCH over REST, which also changes the profile
+		"ChangePassword": "PATCH /api/v1/users",
+	}
+	for method, allowed := range RPCRoles {
+		name := method[len("/user.UserService/"):]
+		route, ok := routes[name]
+		if !assert.True(t, ok, "%s has no route assigned", name) {
+			continue
+		}
+		assert.ElementsMatch(t, allowed, restserver.RouteRoles[route], "%s and %s", name, route)
+	}
+}
+
+func TestOwnershipIsChecked(t *testing.T) {
+	s := setupServer(t)
+	assert.NoError(t, s.db.SaveUser(models.User{Username: "user2", FirstName: "Jane", Roles: []string{auth.RoleUser}}))
+
+	calls := map[string]func(ctx context.Context) error{
+		"GetUser": func(ctx context.Context) error {
+			_, err := s.GetUser(ctx, &user.GetUserRequest{Username: "user2"})
+			return err
+		},
+		"UpdateUser": func(ctx context.Context) error {
+			_, err := s.UpdateUser(ctx, &user.User{Username: "user2", Firstname: "Mallory"})
+			return err
+		},
+		"DeleteUser": func(ctx context.Context) error {
+			_, err := s.DeleteUser(ctx, &user.DeleteUserRequest{Username: "user2"})
+			return err
+		},
+		"ChangePassword": func(ctx context.Context) error {
+			_, err := s.ChangePassword(ctx, &user.ChangePasswordRequest{Username: "user2", NewPassword: "a new long password"})
+			return err
+		},
+		"RequestEmailVerification": func(ctx context.Context) error {
+			_, err := s.RequestEmailVerification(ctx, &user.EmailVerificationRequest{Username: "user2"})
+			return err
+		},
+		"EnrollTOTP": func(ctx context.Context) error {
+			_, err := s.EnrollTOTP(ctx, &user.EnrollTOTPRequest{Username: "user2"})
+			return err
+		},
+		"ConfirmTOTP": func(ctx context.Context) error {
+			_, err := s.ConfirmTOTP(ctx, &user.ConfirmTOTPRequest{Username: "user2", Code: "123456"})
+			return err
+		},
+		"CreateAPIKey": func(ctx context.Context) error {
+			_, err := s.CreateAPIKey(ctx, &user.CreateAPIKeyRequest{Username: "user2", Name: "ci"})
+			return err
+		},
+		"ListAPIKeys": func(ctx context.Context) error {
+			_, err := s.ListAPIKeys(ctx, &user.ListAPIKeysRequest{Username: "user2"})
+			return err
+		},
+		"RevokeAPIKey": func(ctx context.Context) error {
+			_, err := s.RevokeAPIKey(ctx, &user.RevokeAPIKeyRequest{Username: "user2", Id: "id1"})
+			return err
+		},
+		"ListSessions": func(ctx context.Context) error {
+			_, err := s.ListSessions(ctx, &user.ListSessionsRequest{Username: "user2"})
+			return err
+		},
+		"RevokeSession": func(ctx context.Context) error {
+			_, err := s.RevokeSession(ctx, &user.RevokeSessionRequest{Username: "user2", Id: "id1"})
+			return err
+		},
+	}
+	for name, call := range calls {
+		for _, role := range []string{auth.RoleUser, auth.RoleService} {
+			t.Run(name+" as "+role, func(t *testing.T) {
+				err := call(s.callerContext(t, "user1", role))
+				if name == "GetUser" && role == auth.RoleService {
+					// services read any account
+					assert.NoError(t, err)
+					return
+				}
+				assert.Equal(t, codes.PermissionDenied, status.Code(err))
+			})
+		}
+	}
+
+	u, err := s.db.GetUser("user2")
+	assert.NoError(t, err)
+	assert.Equal(t, "Jane", u.FirstName)
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func TestAPIKeysAuthenticateRPCs(t *testing.T) {
+	s := setupServer(t)
+	assert.NoError(t, s.db.SaveUser(models.User{Username: "user1", Roles: []string{auth.RoleUser, auth.RoleService}}))
+	key, secret, err := s.service.CreateAPIKey("user1", "batch", []string{auth.RoleService}, time.Time{})
+	assert.NoError(t, err)
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) { return "called", nil }
+	call := func(method, token string) codes.Code {
+		_, err := s.authorize(withToken(token), nil, &grpc.UnaryServerInfo{FullMethod: method}, handler)
+		return status.Code(err)
+	}
+
+	assert.Equal(t, codes.OK, call("/user.UserService/ListUsers", secret))
+	assert.Equal(t, codes.PermissionDenied, call("/user.UserService/UpdateUser", secret))
+
+	assert.NoError(t, s.service.RevokeAPIKey("user1", key.ID))
+	assert.Equal(t, codes.Unauthenticated, call("/user.UserService/ListUsers", secret))
+}
+
+func TestRefreshTokenIsNoBearerToken(t *testing.T) {
+	s := setupServer(t)
+	assert.NoError(t, s.db.SaveUser(models.User{Username: "user1", Roles: []string{auth.RoleUser}}))
+	u, err := s.db.GetUser("user1")
+	assert.NoError(t, err)
+	pair, err := s.service.IssueTokens(u, "", auth.ClientInfo{})
+	assert.NoError(t, err)
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) { return "called", nil }
+	info := &grpc.UnaryServerInfo{FullMethod: "/user.UserService/GetUser"}
+
+	_, err = s.authorize(withToken(pair.AccessToken), nil, info, handler)
+	assert.NoError(t, err)
+	_, err = s.authorize(withToken(pair.RefreshToken), nil, info, handler)
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+	_, err = s.Auth(context.Background(), &user.AuthRequest{Token: pair.RefreshToken})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+}
@@ -0,0 +1,70 @@
+package restserver
+
+import (
+	"strings"
+
+	auth "github.com/BieggerM/userservice/pkg/service/auth"
+
+	"github.com/gin-gonic/gin"
+)
+
+// realm is announced in WWW-Authenticate challenges
+const realm = "user-service"
+
+// bearerToken reads the token of an "Authorization: Bearer <token>" header (RFC 6750).
+// With legacy headers enabled a bare token without scheme is accepted as well.
+func (g *GinServer) bearerToken(c *gin.Context) (string, bool) {
+	header := c.Request.Header.Get("Authorization")
+	scheme, token, found := strings.Cut(header, " ")
+	if found && strings.EqualFold(scheme, "Bearer") && token != "" {
+		return strings.TrimSpace(token), true
+	}
+	if !found && header != "" && g.LegacyAuthHeaders {
+		return header, true
+	}
+	return "", false
+}
+
+// loginCredentials reads username and password from an RFC 7617 Basic Authorization header
+// or a JSON body. With legacy headers enabled "Authorization: username:password" is accepted as well.
+func (g *GinServer) loginCredentials(c *gin.Context) (string, string, bool) {
+	if username, password, ok := c.Request.BasicAuth(); ok {
+		return username, password, true
+	}
+	header := c.Request.Header.Get("Authorization")
+	if g.LegacyAuthHeaders && header != "" && !strings.Contains(header, " ") {
+		if username, password, ok := strings.Cut(header, ":"); ok {
+			return username, password, true
+		}
+	}
+	var body struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}
+	if err := c.ShouldBindBodyWithJSON(&body); err == nil && body.Username != "" {
+		return body.Username, body.Password, true
+	}
+	return "", "", false
+}
+
+// clientInfo describes the calling client for the session inventory
+func clientInfo(c *gin.Context) auth.ClientInfo {
+	return auth.ClientInfo{IP: c.ClientIP(), UserAgent: c.Request.UserAgent()}
+}
+
+// basicChallenge answers with 401 and asks for Basic credentials
+func basicChallenge(c *gin.Context, message string) {
+	c.Header("WWW-Authenticate", `Basic realm="`+realm+`", charset="UTF-8"`)
+	c.AbortWithStatusJSON(401, gin.H{"error": message})
+}
+
+// bearerChallenge answers with 401 and asks for a bearer token. If a token was presented
+// the challenge carries the invalid_token error code of RFC 6750.
+func bearerChallenge(c *gin.Context, tokenPresented bool, message string) {
+	challenge := `Bearer realm="` + realm + `"`
+	if tokenPresented {
+		challenge += `, error="invalid_token", error_description="` + message + `"`
+	}
+	c.Header("WWW-Authenticate", challenge)
+	c.AbortWithStatusJSON(401, gin.H{"error": message})
+}
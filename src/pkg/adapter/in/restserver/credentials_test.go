@@ -0,0 +1,126 @@
+package restserver
+
+import (
+	"encoding/base64"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func testContext(authorization, body string) (*gin.Context, *httptest.ResponseRecorder) {
+	rec := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(rec)
+	c.Request = httptest.NewRequest("POST", "/", strings.NewReader(body))
+	if authorization != "" {
+		c.Request.Header.Set("Authorization", authorization)
+	}
+	if body != "" {
+		c.Request.Header.Set("Content-Type", "application/json")
+	}
+	return c, rec
+}
+
+func basic(credentials string) string {
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(credentials))
+}
+
+func TestLoginCredentials(t *testing.T) {
+	for _, tc := range []struct {
+		name          string
+		authorization string
+		body          string
+		legacy        bool
+		username      string
+		password      string
+		ok            bool
+	}{
+		{"basic", basic("johndoe:secret"), "", false, "johndoe", "secret", true},
+		{"basic password with colon", basic("johndoe:se:cret"), "", false, "johndoe", "se:cret", true},
+		{"basic lowercase scheme", "basic " + base64.StdEncoding.EncodeToString([]byte("johndoe:secret")), "", false, "johndoe", "secret", true},
+		{"basic malformed base64", "Basic !!!not-base64", "", false, "", "", false},
+		{"basic without colon", basic("johndoe"), "", false, "", "", false},
+		{"basic wins over body", basic("johndoe:secret"), `{"username":"other","password":"x"}`, false, "johndoe", "secret", true},
+		{"json body", "", `{"username":"johndoe","password":"secret"}`, false, "johndoe", "secret", true},
+		{"json body without username", "", `{"password":"secret"}`, false, "", "", false},
+		{"malformed json body", "", `{"username":`, false, "", "", false},
+		{"legacy header disabled", "johndoe:secret", "", false, "", "", false},
+		{"legacy header enabled", "johndoe:secret", "", true, "johndoe", "secret", true},
+		{"legacy header without colon", "johndoe", "", true, "", "", false},
+		{"nothing", "", "", true, "", "", false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			g := &GinServer{LegacyAuthHeaders: tc.legacy}
+			c, _ := testContext(tc.authorization, tc.body)
+			username, password, ok := g.loginCredentials(c)
+			assert.Equal(t, tc.ok, ok)
+			assert.Equal(t, tc.username, username)
+			assert.Equal(t, tc.password, password)
+		})
+	}
+}
+
+func TestBearerToken(t *testing.T) {
+	for _, tc := range []struct {
+		name          string
+		authorization string
+		legacy        bool
+		token         string
+		ok            bool
+	}{
+		{"bearer", "Bearer abc.def.ghi", false, "abc.def.ghi", true},
+		{"lowercase scheme", "bearer abc.def.ghi", false, "abc.def.ghi", true},
+		{"uppercase scheme", "BEARER abc.def.ghi", false, "abc.def.ghi", true},
+		{"surrounding whitespace", "Bearer  abc.def.ghi ", false, "abc.def.ghi", true},
+		{"empty token", "Bearer ", false, "", false},
+		{"other scheme", basic("johndoe:secret"), false, "", false},
+		{"missing", "", true, "", false},
+		{"bare token legacy disabled", "abc.def.ghi", false, "", false},
+		{"bare token legacy enabled", "abc.def.ghi", true, "abc.def.ghi", true},
+		{"other scheme legacy enabled", "Token abc.def.ghi", true, "", false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			g := &GinServer{LegacyAuthHeaders: tc.legacy}
+			c, _ := testContext(tc.authorization, "")
+			token, ok := g.bearerToken(c)
+			assert.Equal(t, tc.ok, ok)
+			assert.Equal(t, tc.token, token)
+		})
+	}
+}
+
+func TestChallenges(t *testing.T) {
+	c, rec := testContext("", "")
+	basicChallenge(c, "invalid credentials")
+	assert.Equal(t, 401, rec.Code)
+	assert.Equal(t, `Basic realm="user-service", charset="UTF-8"`, rec.Header().Get("WWW-Authenticate"))
+	assert.True(t, c.IsAborted())
+
+	c, rec = testContext("", "")
+	bearerChallenge(c, false, "bearer token not provided")
+	assert.Equal(t, 401, rec.Code)
+	// without a token there is no error code (RFC 6750 section 3.1)
+	assert.Equal(t, `Bearer realm="user-service"`, rec.Header().Get("WWW-Authenticate"))
+
+	c, rec = testContext("", "")
+	bearerChallenge(c, true, "invalid token")
+	assert.Equal(t, 401, rec.Code)
+	assert.Equal(t, `Bearer realm="user-service", error="invalid_token", error_description="invalid token"`, rec.Header().Get("WWW-Authenticate"))
+	assert.JSONEq(t, `{"error":"invalid token"}`, rec.Body.String())
+}
+
+func TestLoginAnswersWithChallenge(t *testing.T) {
+	s := setupServer(t)
+	rec := s.do("POST", "/api/v1/auth", "", "")
+	assert.Equal(t, 401, rec.Code)
+	assert.Contains(t, rec.Header().Get("WWW-Authenticate"), "Basic")
+
+	rec = s.do("GET", "/api/v1/users/user1", "", "")
+	assert.Equal(t, 401, rec.Code)
+	assert.Equal(t, `Bearer realm="user-service"`, rec.Header().Get("WWW-Authenticate"))
+
+	rec = s.do("GET", "/api/v1/users/user1", "forged", "")
+	assert.Equal(t, 401, rec.Code)
+	assert.Contains(t, rec.Header().Get("WWW-Authenticate"), `error="invalid_token"`)
+}
@@ -0,0 +1,122 @@
+package restserver
+
+import (
+	auth "github.com/BieggerM/userservice/pkg/service/auth"
+	"github.com/gin-gonic/gin"
+)
+
+// claimsKey is the gin context key of the claims of the authenticated caller
+const claimsKey = "claims"
+
+// public marks routes that can be called without a token
+var public = []string{}
+
+// RouteRoles maps each route to the roles allowed to call it.
+// Routes missing from the table are denied. RPCs doing the same must allow the same roles.
+var RouteRoles = map[string][]string{
+	"GET /api/v1/users":                               {auth.RoleAdmin, auth.RoleService},
+	"GET /api/v1/users/:username":                     {auth.RoleAdmin, auth.RoleService, auth.RoleUser},
+	"POST /api/v1/users":                              {auth.RoleAdmin, auth.RoleService},
+	"PATCH /api/v1/users":                             {auth.RoleAdmin, auth.RoleUser},
+	"DELETE /api/v1/users":                            {auth.RoleAdmin, auth.RoleUser},
+	"POST /api/v1/users/:username/unlock":             {auth.RoleAdmin},
+	"POST /api/v1/users/:username/impersonate":        {auth.RoleAdmin},
+	"POST /api/v1/users/:username/email-verification": {auth.RoleAdmin, auth.RoleUser},
+	"POST /api/v1/users/:username/mfa/totp":           {auth.RoleAdmin, auth.RoleUser},
+	"POST /api/v1/users/:username/mfa/totp/confirm":   {auth.RoleAdmin, auth.RoleUser},
+	"DELETE /api/v1/users/:username/mfa":              {auth.RoleAdmin},
+	"POST /api/v1/users/:username/api-keys":           {auth.RoleAdmin, auth.RoleUser, auth.RoleService},
+	"GET /api/v1/users/:username/api-keys":            {auth.RoleAdmin, auth.RoleUser, auth.RoleService},
+	"DELETE /api/v1/users/:username/api-keys/:id":     {auth.RoleAdmin, auth.RoleUser, auth.RoleService},
+	"POST /api/v1/auth":                               public,
+	"GET /api/v1/auth":                                public,
+	"POST /api/v1/auth/mfa":                           public,
+	"POST /api/v1/auth/refresh":                       public,
+	"POST /api/v1/auth/logout":                        public,
+	"POST /api/v1/auth/password-reset":                public,
+	"POST /api/v1/auth/password-reset/confirm":        public,
+	"POST /api/v1/auth/magic-link":                    public,
+	"POST /api/v1/auth/magic-link/confirm":            public,
+	"POST /api/v1/auth/verify-email":                  public,
+	"GET /api/v1/auth/sessions":                       {auth.RoleAdmin, auth.RoleUser, auth.RoleService},
+	"DELETE /api/v1/auth/sessions/:id":                {auth.RoleAdmin, auth.RoleUser, auth.RoleService},
+	"GET /api/v1/users/:username/sessions":            {auth.RoleAdmin},
+	"DELETE /api/v1/users/:username/sessions/:id":     {auth.RoleAdmin},
+	"GET /.well-known/jwks.json":                      public,
+	"GET /.well-known/openid-configuration":           public,
+	"POST /oauth/token":                               public,
+	"POST /oauth/introspect":                          public,
+	"GET /userinfo":                                   {auth.RoleAdmin, auth.RoleUser, auth.RoleService},
+	"POST /userinfo":                                  {auth.RoleAdmin, auth.RoleUser, auth.RoleService},
+}
+
+// authorize enforces the permission table for every matched route
+func (g *GinServer) authorize(c *gin.Context) {
+	if c.FullPath() == "" {
+		// unknown routes are answered with 404 by gin
+		c.Next()
+		return
+	}
+	roles, ok := RouteRoles[c.Request.Method+" "+c.FullPath()]
+	if !ok {
+		c.AbortWithStatusJSON(403, gin.H{"error": "access denied"})
+		return
+	}
+	if len(roles) == 0 {
+		c.Next()
+		return
+	}
+	token, ok := g.bearerToken(c)
+	if !ok {
+		bearerChallenge(c, false, "bearer token not provided")
+		return
+	}
+	// API keys are accepted wherever a JWT is
+	claims, err := g.auth.ValidateToken(token)
+	if err != nil {
+		bearerChallenge(c, true, "invalid token")
+		return
+	}
+	if !claims.HasAnyRole(roles...) {
+		g.rlog.Warn("Access denied", "username", claims.UserID, "route", c.FullPath(), "method", c.Request.Method)
+		c.AbortWithStatusJSON(403, gin.H{"error": "access denied"})
+		return
+	}
+	c.Set(claimsKey, claims)
+	c.Next()
+}
+
+// callerClaims returns the claims of the authenticated caller
+func callerClaims(c *gin.Context) *auth.Claims {
+	claims, _ := c.MustGet(claimsKey).(*auth.Claims)
+	return claims
+}
+
+// canRead checks that the caller may read the account of target and answers with 403 otherwise
+func (g *GinServer) canRead(c *gin.Context, target string) bool {
+	return g.checkOwnership(c, target, "read", callerClaims(c).CanRead(target))
+}
+
+// canModify checks that the caller may change the account of target and answers with 403 otherwise
+func (g *GinServer) canModify(c *gin.Context, target string) bool {
+	return g.checkOwnership(c, target, "modify", callerClaims(c).CanModify(target))
+}
+
+// notImpersonated answers 403 if the caller acts on behalf of another user
+func (g *GinServer) notImpersonated(c *gin.Context, action string) bool {
+	claims := callerClaims(c)
+	if err := claims.CheckNotImpersonated(); err != nil {
+		g.rlog.Warn("Change by impersonation token denied", "caller", claims.UserID, "actor", claims.Actor.Subject, "action", action, "route", c.FullPath())
+		c.JSON(403, gin.H{"error": err.Error()})
+		return false
+	}
+	return true
+}
+
+func (g *GinServer) checkOwnership(c *gin.Context, target, action string, allowed bool) bool {
+	if !allowed {
+		g.rlog.Warn("Access to foreign account denied", "caller", callerClaims(c).UserID, "target", target, "action", action, "route", c.FullPath())
+		c.JSON(403, gin.H{"error": "access denied"})
+	}
+	return allowed
+}
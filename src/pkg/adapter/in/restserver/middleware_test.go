@@ -0,0 +1,135 @@
+package restserver
+
+import (
+	"encoding/json"
+	"github.com/BieggerM/userservice/pkg/models"
+	"github.com/BieggerM/userservice/pkg/service/auth"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+// tokenFor issues an access token of the user with the given roles
+func (s *testServer) tokenFor(t *testing.T, username string, roles ...string) string {
+	token, err := s.service.GenerateJWT(models.User{Username: username, Roles: roles}, "")
+	assert.NoError(t, err)
+	return token
+}
+
+func TestRouteRoles(t *testing.T) {
+	s := setupServer(t)
+	r := gin.New()
+	r.Use(s.authorize)
+	for route := range RouteRoles {
+		method, path, _ := strings.Cut(route, " ")
+		r.Handle(method, path, func(c *gin.Context) { c.Status(204) })
+	}
+	r.GET("/unlisted", func(c *gin.Context) { c.Status(204) })
+	s.handler = r
+
+	for route, allowed := range RouteRoles {
+		method, path, _ := strings.Cut(route, " ")
+		path = strings.NewReplacer(":username", "user2", ":id", "id1").Replace(path)
+		for _, role := range []string{"", auth.RoleUser, auth.RoleService, auth.RoleAdmin} {
+			t.Run(route+" as "+role, func(t *testing.T) {
+				token := ""
+				if role != "" {
+					token = s.tokenFor(t, "user1", role)
+				}
+				want := 204
+				switch {
+				case len(allowed) == 0:
+				case role == "":
+					want = 401
+				case !containsString(allowed, role):
+					want = 403
+				}
+				assert.Equal(t, want, s.do(method, path, token, "").Code)
+			})
+		}
+	}
+
+	assert.Equal(t, 403, s.do("GET", "/unlisted", s.tokenFor(t, "user1", auth.RoleAdmin), "").Code)
+}
+
+func TestOwnershipIsChecked(t *testing.T) {
+	s := setupServer(t)
+	assert.NoError(t, s.db.SaveUser(models.User{Username: "user2", FirstName: "Jane", Roles: []string{auth.RoleUser}}))
+
+	for _, tc := range []struct {
+		role, method, path, body string
+		want                     int
+	}{
+		{auth.RoleUser, "GET", "/api/v1/users/user2", "", 403},
+		{auth.RoleUser, "PATCH", "/api/v1/users", `{"username":"user2","firstname":"Mallory"}`, 403},
+		{auth.RoleUser, "DELETE", "/api/v1/users", `{"username":"user2"}`, 403},
+		{auth.RoleUser, "POST", "/api/v1/users/user2/email-verification", "", 403},
+		{auth.RoleUser, "POST", "/api/v1/users/user2/mfa/totp", "", 403},
+		{auth.RoleUser, "POST", "/api/v1/users/user2/mfa/totp/confirm", `{"code":"123456"}`, 403},
+		{auth.RoleUser, "POST", "/api/v1/users/user2/api-keys", `{"name":"ci"}`, 403},
+		{auth.RoleUser, "GET", "/api/v1/users/user2/api-keys", "", 403},
+		{auth.RoleUser, "DELETE", "/api/v1/users/user2/api-keys/id1", "", 403},
+		{auth.RoleService, "GET", "/api/v1/users/user2", "", 200},
+		{auth.RoleService, "POST", "/api/v1/users/user2/api-keys", `{"name":"ci"}`, 403},
+		{auth.RoleService, "GET", "/api/v1/users/user2/api-keys", "", 403},
+		{auth.RoleAdmin, "GET", "/api/v1/users/user2", "", 200},
+		{auth.RoleAdmin, "GET", "/api/v1/users/user2/api-keys", "", 200},
+		// even admins cannot enroll a second factor for others
+		{auth.RoleAdmin, "POST", "/api/v1/users/user2/mfa/totp", "", 403},
+	} {
+		t.Run(tc.role+" "+tc.method+" "+tc.path, func(t *testing.T) {
+			rec := s.do(tc.method, tc.path, s.tokenFor(t, "user1", tc.role), tc.body)
+			assert.Equal(t, tc.want, rec.Code, rec.Body.String())
+		})
+	}
+
+	user, err := s.db.GetUser("user2")
+	assert.NoError(t, err)
+	assert.Equal(t, "Jane", user.FirstName)
+}
+
+func TestAPIKeysAuthenticateRequests(t *testing.T) {
+	s := setupServer(t)
+	assert.NoError(t, s.db.SaveUser(models.User{Username: "user1", Roles: []string{auth.RoleUser, auth.RoleService}}))
+	token := s.tokenFor(t, "user1", auth.RoleUser, auth.RoleService)
+	createKey := func(scopes string) (string, string) {
+		rec := s.do("POST", "/api/v1/users/user1/api-keys", token, `{"name":"batch","scopes":`+scopes+`}`)
+		assert.Equal(t, 201, rec.Code, rec.Body.String())
+		var created struct {
+			ID  string `json:"id"`
+			Key string `json:"key"`
+		}
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &created))
+		assert.True(t, strings.HasPrefix(created.Key, "usk_"+created.ID+"_"))
+		return created.ID, created.Key
+	}
+	serviceID, serviceKey := createKey(`["service"]`)
+	_, userKey := createKey(`["user"]`)
+
+	// keys carry their scopes, not all roles of the user
+	assert.Equal(t, 200, s.do("GET", "/api/v1/users", serviceKey, "").Code)
+	assert.Equal(t, 403, s.do("GET", "/api/v1/users", userKey, "").Code)
+	assert.Equal(t, 200, s.do("GET", "/api/v1/users/user1", userKey, "").Code)
+	assert.Equal(t, 403, s.do("POST", "/api/v1/users/user1/api-keys", userKey, `{"name":"more"}`).Code)
+
+	// the secret is shown once
+	rec := s.do("GET", "/api/v1/users/user1/api-keys", token, "")
+	assert.Equal(t, 200, rec.Code)
+	assert.NotContains(t, rec.Body.String(), serviceKey[len("usk_"+serviceID+"_"):])
+
+	assert.Equal(t, 200, s.do("DELETE", "/api/v1/users/user1/api-keys/"+serviceID, token, "").Code)
+	rec = s.do("GET", "/api/v1/users", serviceKey, "")
+	assert.Equal(t, 401, rec.Code)
+	assert.Contains(t, rec.Header().Get("WWW-Authenticate"), "Bearer")
+	assert.Equal(t, 401, s.do("GET", "/api/v1/users", serviceKey+"x", "").Code)
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,130 @@
+package restserver
+
+import (
+	"errors"
+	"net/url"
+
+	auth "github.com/BieggerM/userservice/pkg/service/auth"
+	"github.com/gin-gonic/gin"
+)
+
+// oauthToken is the OAuth2 token endpoint (RFC 6749 section 3.2). Parameters are form encoded,
+// clients authenticate with Basic credentials or client_id and client_secret parameters.
+func (g *GinServer) oauthToken(c *gin.Context) {
+	// responses carrying tokens must not be cached (RFC 6749 section 5.1)
+	c.Header("Cache-Control", "no-store")
+	c.Header("Pragma", "no-cache")
+
+	clientID, clientSecret, ok := oauthClientCredentials(c)
+	if !ok {
+		oauthError(c, &auth.OAuthError{Code: auth.ErrCodeInvalidRequest, Description: "only one client authentication method may be used"})
+		return
+	}
+	token, err := g.auth.Token(auth.TokenRequest{
+		GrantType:    c.PostForm("grant_type"),
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		Scope:        c.PostForm("scope"),
+		Audience:     c.PostForm("audience"),
+		Username:     c.PostForm("username"),
+		Password:     c.PostForm("password"),
+		RefreshToken: c.PostForm("refresh_token"),
+		Client:       clientInfo(c),
+	})
+	if errors.Is(err, auth.ErrRefreshTokenReused) {
+		g.rlog.Warn("Refresh token reuse detected, token family revoked", "ip", c.ClientIP(), "client", clientID)
+	}
+	var oauthErr *auth.OAuthError
+	if errors.As(err, &oauthErr) {
+		if oauthErr.Code == auth.ErrCodeInvalidClient {
+			g.rlog.Warn("OAuth client authentication failed", "client", clientID, "ip", c.ClientIP())
+		}
+		oauthError(c, oauthErr)
+		return
+	}
+	if errors.Is(err, auth.ErrCredentialBackendUnavailable) {
+		c.JSON(503, gin.H{"error": "temporarily_unavailable", "error_description": "credential backend unavailable"})
+		return
+	}
+	if err != nil {
+		g.rlog.Error("Failed to issue OAuth token", "client", clientID, "error", err)
+		c.JSON(500, gin.H{"error": "server_error"})
+		return
+	}
+	c.JSON(200, token)
+}
+
+// oauthIntrospect is the OAuth2 introspection endpoint (RFC 7662) for resource servers like the API gateway.
+// The token_type_hint parameter is not needed, the kind of token is told by its format.
+func (g *GinServer) oauthIntrospect(c *gin.Context) {
+	c.Header("Cache-Control", "no-store")
+	c.Header("Pragma", "no-cache")
+
+	clientID, clientSecret, ok := oauthClientCredentials(c)
+	if !ok {
+		oauthError(c, &auth.OAuthError{Code: auth.ErrCodeInvalidRequest, Description: "only one client authentication method may be used"})
+		return
+	}
+	introspection, err := g.auth.Introspect(clientID, clientSecret, c.PostForm("token"))
+	var oauthErr *auth.OAuthError
+	if errors.As(err, &oauthErr) {
+		if oauthErr.Code == auth.ErrCodeInvalidClient {
+			g.rlog.Warn("OAuth client authentication failed", "client", clientID, "ip", c.ClientIP())
+		}
+		oauthError(c, oauthErr)
+		return
+	}
+	if err != nil {
+		g.rlog.Error("Failed to introspect token", "client", clientID, "error", err)
+		c.JSON(500, gin.H{"error": "server_error"})
+		return
+	}
+	c.JSON(200, introspection)
+}
+
+// oauthClientCredentials reads the client credentials from an RFC 6749 section 2.3.1 Basic header,
+// whose parts are form encoded, or from the request body. It fails if both are present.
+func oauthClientCredentials(c *gin.Context) (string, string, bool) {
+	id, secret, basic := c.Request.BasicAuth()
+	if basic {
+		if c.PostForm("client_id") != "" || c.PostForm("client_secret") != "" {
+			return "", "", false
+		}
+		id, idErr := url.QueryUnescape(id)
+		secret, secretErr := url.QueryUnescape(secret)
+		return id, secret, idErr == nil && secretErr == nil
+	}
+	return c.PostForm("client_id"), c.PostForm("client_secret"), true
+}
+
+// oauthError answers with an RFC 6749 section 5.2 error response
+func oauthError(c *gin.Context, err *auth.OAuthError) {
+	status := 400
+	if err.Code == auth.ErrCodeInvalidClient {
+		status = 401
+		c.Header("WWW-Authenticate", `Basic realm="`+realm+`", charset="UTF-8"`)
+	}
+	c.AbortWithStatusJSON(status, gin.H{"error": err.Code, "error_description": err.Description})
+}
+
+// openIDConfiguration serves the OpenID Connect discovery document
+func (g *GinServer) openIDConfiguration(c *gin.Context) {
+	configuration, err := g.auth.OpenIDConfiguration()
+	if err != nil {
+		c.JSON(404, gin.H{"error": err.Error()})
+		return
+	}
+	c.Header("Cache-Control", jwksCacheControl)
+	c.JSON(200, configuration)
+}
+
+// userInfo returns the standard claims of the user the bearer token belongs to (OpenID Connect Core section 5.3)
+func (g *GinServer) userInfo(c *gin.Context) {
+	info, err := g.auth.UserInfo(callerClaims(c).UserID)
+	if err != nil {
+		// tokens issued to a client for itself have no user
+		bearerChallenge(c, true, "token does not belong to a user")
+		return
+	}
+	c.JSON(200, info)
+}
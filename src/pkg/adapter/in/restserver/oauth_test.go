@@ -0,0 +1,56 @@
+package restserver
+
+import (
+	"encoding/json"
+	"github.com/BieggerM/userservice/pkg/models"
+	"github.com/BieggerM/userservice/pkg/service/auth"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestOpenIDConfiguration(t *testing.T) {
+	s := setupServer(t)
+
+	rec := s.do("GET", "/.well-known/openid-configuration", "", "")
+	assert.Equal(t, 200, rec.Code)
+	var document map[string]interface{}
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &document))
+	assert.Equal(t, "http://localhost:8082", document["issuer"])
+	assert.Equal(t, "http://localhost:8082/oauth/token", document["token_endpoint"])
+	assert.Equal(t, "http://localhost:8082/oauth/introspect", document["introspection_endpoint"])
+	assert.Equal(t, "http://localhost:8082/.well-known/jwks.json", document["jwks_uri"])
+	assert.Equal(t, "http://localhost:8082/userinfo", document["userinfo_endpoint"])
+	assert.Contains(t, document["scopes_supported"], auth.ScopeOpenID)
+	assert.NotContains(t, document, "response_types_supported")
+	assert.NotContains(t, document, "id_token_signing_alg_values_supported")
+
+	// the issuer of the document is the issuer of the tokens
+	claims, err := s.service.ValidateJWT(s.tokenFor(t, "user1", auth.RoleUser))
+	assert.NoError(t, err)
+	assert.Equal(t, document["issuer"], claims.Issuer)
+}
+
+func TestUserInfo(t *testing.T) {
+	s := setupServer(t)
+	assert.NoError(t, s.db.SaveUser(models.User{Username: "user1", FirstName: "John", LastName: "Doe", Email: "john@example.com", Roles: []string{auth.RoleUser}}))
+	assert.NoError(t, s.db.MarkEmailVerified("user1"))
+	assert.NoError(t, s.db.SaveUser(models.User{Username: "user2", Roles: []string{auth.RoleUser}}))
+
+	rec := s.do("GET", "/userinfo", s.tokenFor(t, "user1", auth.RoleUser), "")
+	assert.Equal(t, 200, rec.Code)
+	assert.JSONEq(t, `{"sub":"user1","preferred_username":"user1","given_name":"John","family_name":"Doe","email":"john@example.com","email_verified":true}`, rec.Body.String())
+
+	rec = s.do("POST", "/userinfo", s.tokenFor(t, "user2", auth.RoleUser), "")
+	assert.Equal(t, 200, rec.Code)
+	assert.JSONEq(t, `{"sub":"user2","preferred_username":"user2"}`, rec.Body.String())
+
+	// tokens of a client for itself have no user
+	client, secret, err := auth.NewOAuthClient("reporting", []string{auth.RoleService}, []string{"recipemanagement"}, []string{auth.GrantClientCredentials})
+	assert.NoError(t, err)
+	assert.NoError(t, s.db.SaveOAuthClient(client))
+	token, err := s.service.Token(auth.TokenRequest{GrantType: auth.GrantClientCredentials, ClientID: client.ClientID, ClientSecret: secret, Scope: "openid"})
+	assert.NoError(t, err)
+	rec = s.do("GET", "/userinfo", token.AccessToken, "")
+	assert.Equal(t, 401, rec.Code)
+	assert.Contains(t, rec.Header().Get("WWW-Authenticate"), `error="invalid_token"`)
+}
@@ -2,8 +2,11 @@ package restserver
 
 import (
 	"encoding/json"
+	"errors"
 	auth "github.com/BieggerM/userservice/pkg/service/auth"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/BieggerM/userservice/pkg/adapter/out/broker"
 	"github.com/BieggerM/userservice/pkg/adapter/out/database"
@@ -13,6 +16,9 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
+// jwksCacheControl lets clients cache the key set while still picking up rotated keys quickly
+const jwksCacheControl = "public, max-age=300"
+
 type RestServer interface {
 	StartRestServer(
 		MB broker.MessageBroker,
@@ -25,6 +31,12 @@ type GinServer struct {
 	MB   broker.MessageBroker
 	rlog logger.Logger
 	auth auth.AuthService
+	// LegacyAuthHeaders accepts "Authorization: username:password" on login
+	// and tokens without Bearer scheme for clients of the first API version
+	LegacyAuthHeaders bool
+	// TrustedProxies are the addresses or networks of reverse proxies whose X-Forwarded-For header is used
+	// as client address. Without any, the address of the connection is used, as clients can forge the header.
+	TrustedProxies []string
 }
 
 func (g *GinServer) StartRestServer(MB broker.MessageBroker, DB database.Database, rlog logger.Logger, auth auth.AuthService) {
@@ -32,77 +44,323 @@ func (g *GinServer) StartRestServer(MB broker.MessageBroker, DB database.Databas
 	g.MB = MB
 	g.rlog = rlog
 	g.auth = auth
+	r, err := g.router()
+	if err != nil {
+		logrus.Fatalf("Invalid trusted proxies: %v", err)
+	}
+	logrus.Infof("Gin Server started on port %s", ":8082")
+	if err := r.Run(":8082"); err != nil {
+		logrus.Fatalf("Failed to run Gin server: %v", err)
+	}
+}
+
+// router registers all routes behind the authorization middleware
+func (g *GinServer) router() (*gin.Engine, error) {
 	r := gin.Default()
+	if err := r.SetTrustedProxies(g.TrustedProxies); err != nil {
+		return nil, err
+	}
+	r.Use(g.authorize)
 	userGroup := r.Group("/api/v1/users")
 	userGroup.GET("", g.listUsers)
 	userGroup.GET("/:username", g.getUser)
 	userGroup.POST("", g.createUser)
 	userGroup.PATCH("", g.updateUser)
 	userGroup.DELETE("", g.deleteUser)
+	userGroup.POST("/:username/unlock", g.unlockUser)
+	userGroup.POST("/:username/impersonate", g.impersonateUser)
+	userGroup.POST("/:username/email-verification", g.requestEmailVerification)
+	userGroup.POST("/:username/mfa/totp", g.enrollTOTP)
+	userGroup.POST("/:username/mfa/totp/confirm", g.confirmTOTP)
+	userGroup.DELETE("/:username/mfa", g.resetMFA)
+	userGroup.POST("/:username/api-keys", g.createAPIKey)
+	userGroup.GET("/:username/api-keys", g.listAPIKeys)
+	userGroup.DELETE("/:username/api-keys/:id", g.revokeAPIKey)
+	userGroup.GET("/:username/sessions", g.listUserSessions)
+	userGroup.DELETE("/:username/sessions/:id", g.revokeUserSession)
 
 	authGroup := r.Group("/api/v1/auth")
 	authGroup.POST("", g.login)
 	authGroup.GET("", g.validateJWT)
-	logrus.Infof("Gin Server started on port %s", ":8082")
-	if err := r.Run(":8082"); err != nil {
-		logrus.Fatalf("Failed to run Gin server: %v", err)
-	}
+	authGroup.POST("/mfa", g.verifyMFA)
+	authGroup.POST("/refresh", g.refresh)
+	authGroup.POST("/logout", g.logout)
+	authGroup.GET("/sessions", g.listOwnSessions)
+	authGroup.DELETE("/sessions/:id", g.revokeOwnSession)
+	authGroup.POST("/password-reset", g.requestPasswordReset)
+	authGroup.POST("/password-reset/confirm", g.resetPassword)
+	authGroup.POST("/magic-link", g.requestMagicLink)
+	authGroup.POST("/magic-link/confirm", g.redeemMagicLink)
+	authGroup.POST("/verify-email", g.verifyEmail)
+
+	r.GET("/.well-known/jwks.json", g.jwks)
+	r.GET("/.well-known/openid-configuration", g.openIDConfiguration)
+	r.POST("/oauth/token", g.oauthToken)
+	r.POST("/oauth/introspect", g.oauthIntrospect)
+	r.GET("/userinfo", g.userInfo)
+	r.POST("/userinfo", g.userInfo)
+	return r, nil
 }
 
 func (g *GinServer) login(c *gin.Context) {
-	authHeader := c.Request.Header.Get("Authorization")
-	if authHeader == "" {
-		c.JSON(401, gin.H{"error": "Authorization header not provided"})
+	username, password, ok := g.loginCredentials(c)
+	if !ok {
+		basicChallenge(c, "credentials not provided")
 		return
 	}
-	credentials := strings.SplitN(string(authHeader), ":", 2)
-	if len(credentials) != 2 {
-		c.JSON(401, gin.H{"error": "Invalid Authorization header format"})
+
+	user, err := g.auth.Authenticate(username, password, c.ClientIP())
+	var locked *auth.LockedError
+	if errors.As(err, &locked) {
+		c.Header("Retry-After", strconv.Itoa(int(locked.RetryAfter(time.Now()).Seconds())))
+		c.JSON(429, gin.H{"error": locked.Error()})
 		return
 	}
-	username, password := credentials[0], credentials[1]
+	if errors.Is(err, auth.ErrCredentialBackendUnavailable) {
+		c.JSON(503, gin.H{"error": "credential backend unavailable"})
+		return
+	}
+	if err != nil {
+		g.rlog.Warn("Failed login", "username", username, "ip", c.ClientIP())
+		basicChallenge(c, "invalid credentials")
+		return
+	}
+	g.issueTokens(c, user)
+}
 
-	user, err := g.DB.GetUser(username)
+// verifyMFA completes a login of a user with two-factor authentication
+func (g *GinServer) verifyMFA(c *gin.Context) {
+	var req struct {
+		MFAToken string `json:"mfa_token"`
+		Code     string `json:"code"`
+	}
+	if err := c.ShouldBindBodyWithJSON(&req); err != nil || req.MFAToken == "" || req.Code == "" {
+		c.JSON(400, gin.H{"error": "mfa_token and code must be provided"})
+		return
+	}
+	tokens, err := g.auth.VerifyMFA(req.MFAToken, req.Code, c.Query("audience"), clientInfo(c))
+	var locked *auth.LockedError
+	if errors.As(err, &locked) {
+		c.Header("Retry-After", strconv.Itoa(int(locked.RetryAfter(time.Now()).Seconds())))
+		c.JSON(429, gin.H{"error": locked.Error()})
+		return
+	}
+	if errors.Is(err, auth.ErrInvalidAudience) {
+		c.JSON(400, gin.H{"error": "audience is not allowed"})
+		return
+	}
 	if err != nil {
-		c.JSON(401, gin.H{"error": "user not found"})
+		g.rlog.Warn("Failed two-factor login", "ip", c.ClientIP())
+		c.JSON(401, gin.H{"error": "invalid two-factor code, log in again"})
 		return
 	}
+	c.JSON(200, tokens)
+}
 
-	if password != user.Password {
-		c.JSON(401, gin.H{"error": "incorrect password"})
+// issueTokens answers a successful login with an access and refresh token,
+// or with an mfa token for users who still have to provide their second factor
+func (g *GinServer) issueTokens(c *gin.Context, user models.User) {
+	// retrieve access and refresh token from authentication provider
+	tokens, err := g.auth.IssueTokens(user, c.Query("audience"), clientInfo(c))
+	var mfa *auth.MFARequiredError
+	if errors.As(err, &mfa) {
+		c.JSON(200, gin.H{
+			"mfa_required": true,
+			"mfa_token":    mfa.MFAToken,
+		})
+		return
+	}
+	if errors.Is(err, auth.ErrInvalidAudience) {
+		c.JSON(400, gin.H{"error": "audience is not allowed"})
 		return
 	}
-	// retrieve JWT from authentication provider
-	jwt, err := g.auth.GenerateJWT(username)
 	if err != nil {
 		c.JSON(401, gin.H{"error": "failed to authenticate user"})
 		return
 	}
+	c.JSON(200, tokens)
+}
+
+// refresh exchanges a refresh token for a new access and refresh token
+func (g *GinServer) refresh(c *gin.Context) {
+	var req struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := c.ShouldBindBodyWithJSON(&req); err != nil || req.RefreshToken == "" {
+		c.JSON(400, gin.H{"error": "refresh_token not provided"})
+		return
+	}
+	tokens, err := g.auth.RefreshTokens(req.RefreshToken, clientInfo(c))
+	if errors.Is(err, auth.ErrRefreshTokenReused) {
+		g.rlog.Warn("Refresh token reuse detected, token family revoked", "ip", c.ClientIP())
+	}
+	if err != nil {
+		c.JSON(401, gin.H{"error": "invalid refresh token"})
+		return
+	}
+	c.JSON(200, tokens)
+}
+
+// logout revokes the presented access token and optionally the refresh token of the same login
+func (g *GinServer) logout(c *gin.Context) {
+	token, ok := g.bearerToken(c)
+	if !ok {
+		bearerChallenge(c, false, "bearer token not provided")
+		return
+	}
+	var req struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	c.ShouldBindBodyWithJSON(&req)
+	if err := g.auth.Logout(token, req.RefreshToken); err != nil {
+		bearerChallenge(c, true, "failed to log out")
+		return
+	}
 	c.JSON(200, gin.H{
-		"jwt": jwt,
+		"message": "logged out",
 	})
 }
 
-func (g *GinServer) validateJWT(c *gin.Context) {
-	token := c.Request.Header.Get("Authorization")
-	if token == "" {
-		c.JSON(401, gin.H{"error": "Authorization header not provided"})
+// requestPasswordReset sends a reset token to the user via the mail service.
+// The answer is the same whether the user exists or not.
+func (g *GinServer) requestPasswordReset(c *gin.Context) {
+	var req struct {
+		Username string `json:"username"`
+	}
+	if err := c.ShouldBindBodyWithJSON(&req); err != nil || req.Username == "" {
+		c.JSON(400, gin.H{"error": "username not provided"})
+		return
+	}
+	err := g.auth.RequestPasswordReset(req.Username, c.ClientIP())
+	var throttled *auth.ThrottledError
+	if errors.As(err, &throttled) {
+		c.Header("Retry-After", strconv.Itoa(int(throttled.RetryAfter(time.Now()).Seconds())))
+		c.JSON(429, gin.H{"error": throttled.Error()})
 		return
 	}
-	valid, err := g.auth.ValidateJWT(token)
 	if err != nil {
-		c.JSON(401, gin.H{"error": "failed to validate JWT"})
+		g.rlog.Error("Failed to request password reset", "username", req.Username, "error", err)
+	}
+	c.JSON(202, gin.H{
+		"message": "if the user exists, a password reset has been sent",
+	})
+}
+
+// resetPassword sets a new password with a reset token
+func (g *GinServer) resetPassword(c *gin.Context) {
+	var req struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+	if err := c.ShouldBindBodyWithJSON(&req); err != nil || req.Token == "" || req.Password == "" {
+		c.JSON(400, gin.H{"error": "token and password must be provided"})
 		return
 	}
-	if !valid {
-		c.JSON(401, gin.H{"error": "invalid JWT"})
+	username, err := g.auth.ResetPassword(req.Token, req.Password)
+	if errors.Is(err, auth.ErrInvalidResetToken) {
+		c.JSON(400, gin.H{"error": err.Error()})
 		return
 	}
+	if passwordRejected(c, "password", err) {
+		return
+	}
+	if err != nil {
+		c.JSON(500, gin.H{"error": "failed to reset password"})
+		return
+	}
+	g.rlog.Info("Password reset", "username", username)
 	c.JSON(200, gin.H{
-		"message": "valid JWT",
+		"message": "password reset",
+	})
+}
+
+// requestMagicLink sends a login link to the verified email address of the user via the mail service.
+// The answer is the same whether the user exists or not.
+func (g *GinServer) requestMagicLink(c *gin.Context) {
+	var req struct {
+		Username string `json:"username"`
+	}
+	if err := c.ShouldBindBodyWithJSON(&req); err != nil || req.Username == "" {
+		c.JSON(400, gin.H{"error": "username not provided"})
+		return
+	}
+	err := g.auth.RequestMagicLink(req.Username, c.ClientIP())
+	var throttled *auth.ThrottledError
+	if errors.As(err, &throttled) {
+		c.Header("Retry-After", strconv.Itoa(int(throttled.RetryAfter(time.Now()).Seconds())))
+		c.JSON(429, gin.H{"error": throttled.Error()})
+		return
+	}
+	if err != nil {
+		g.rlog.Error("Failed to request login link", "username", req.Username, "error", err)
+	}
+	c.JSON(202, gin.H{
+		"message": "if the user exists, a login link has been sent",
 	})
 }
 
+// redeemMagicLink logs a user in with the token of a login link, answering like login
+func (g *GinServer) redeemMagicLink(c *gin.Context) {
+	var req struct {
+		Token string `json:"token"`
+	}
+	if err := c.ShouldBindBodyWithJSON(&req); err != nil || req.Token == "" {
+		c.JSON(400, gin.H{"error": "token not provided"})
+		return
+	}
+	user, err := g.auth.RedeemMagicLink(req.Token)
+	var locked *auth.LockedError
+	if errors.As(err, &locked) {
+		c.Header("Retry-After", strconv.Itoa(int(locked.RetryAfter(time.Now()).Seconds())))
+		c.JSON(429, gin.H{"error": locked.Error()})
+		return
+	}
+	if err != nil {
+		g.rlog.Warn("Failed login link", "ip", c.ClientIP())
+		c.JSON(401, gin.H{"error": auth.ErrInvalidMagicLink.Error()})
+		return
+	}
+	g.issueTokens(c, user)
+}
+
+func (g *GinServer) validateJWT(c *gin.Context) {
+	token, ok := g.bearerToken(c)
+	if !ok {
+		bearerChallenge(c, false, "bearer token not provided")
+		return
+	}
+	claims, err := g.auth.ValidateToken(token)
+	if err != nil {
+		bearerChallenge(c, true, "invalid JWT")
+		return
+	}
+	// identity headers can be forwarded by the API gateway as they are
+	c.Header("X-Auth-Subject", claims.Subject)
+	c.Header("X-Auth-Roles", strings.Join(claims.Roles, ","))
+	c.Header("X-Auth-Token-Id", claims.Id)
+	response := gin.H{
+		"message": "valid JWT",
+		"sub":     claims.Subject,
+		"iss":     claims.Issuer,
+		"roles":   claims.Roles,
+		"iat":     claims.IssuedAt,
+		"exp":     claims.ExpiresAt,
+		"jti":     claims.Id,
+		"aud":     claims.Audience,
+	}
+	if claims.Actor != nil {
+		c.Header("X-Auth-Actor", claims.Actor.Subject)
+		response["act"] = claims.Actor
+	}
+	c.JSON(200, response)
+}
+
+// jwks publishes the public signing keys so other services can validate tokens offline
+func (g *GinServer) jwks(c *gin.Context) {
+	c.Header("Cache-Control", jwksCacheControl)
+	c.JSON(200, g.auth.JWKS())
+}
+
 func (g *GinServer) listUsers(c *gin.Context) {
 	users := g.DB.ListUsers()
 	c.JSON(200, gin.H{
@@ -111,25 +369,76 @@ func (g *GinServer) listUsers(c *gin.Context) {
 }
 
 func (g *GinServer) getUser(c *gin.Context) {
+	if !g.canRead(c, c.Param("username")) {
+		return
+	}
 	user, err := g.DB.GetUser(c.Param("username"))
 	if err != nil {
 		c.JSON(404, gin.H{"error": "user not found"})
 		return
 	}
 	c.JSON(200, gin.H{
-		"username":  user.Username,
-		"firstname": user.FirstName,
-		"lastname":  user.LastName,
+		"username":       user.Username,
+		"firstname":      user.FirstName,
+		"lastname":       user.LastName,
+		"roles":          user.Roles,
+		"email":          user.Email,
+		"email_verified": user.EmailVerified,
 	})
 }
 
 func (g *GinServer) createUser(c *gin.Context) {
 	var user models.User
 	c.ShouldBindBodyWithJSON(&user)
+	if err := auth.ValidateUsername(user.Username); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	if len(user.Roles) == 0 {
+		user.Roles = auth.DefaultRoles
+	}
+	for _, role := range user.Roles {
+		if !auth.IsKnownRole(role) {
+			c.JSON(400, gin.H{"error": "unknown role " + role})
+			return
+		}
+		if role != auth.RoleUser && !callerClaims(c).HasAnyRole(auth.RoleAdmin) {
+			c.JSON(403, gin.H{"error": "only admins may assign roles"})
+			return
+		}
+	}
+	if user.Email != "" {
+		if err := auth.ValidateEmail(user.Email); err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	// addresses are verified by the user, never by the creator
+	user.EmailVerified = false
+	// accounts of external directories are only created on their first login
+	user.Source = auth.SourceLocal
+	if err := g.auth.CheckPassword(user.Username, user.Password); passwordRejected(c, "password", err) {
+		return
+	}
+	hash, err := g.auth.HashPassword(user.Password)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "failed to hash password"})
+		return
+	}
+	user.Password = hash
 	if err := g.DB.SaveUser(user); err != nil {
+		if errors.Is(err, database.ErrEmailExists) {
+			c.JSON(409, gin.H{"error": err.Error()})
+			return
+		}
 		c.JSON(500, gin.H{"error": "failed to save user to database - username exists"})
 		return
 	}
+	if user.Email != "" {
+		if err := g.auth.RequestEmailVerification(user.Username); err != nil {
+			g.rlog.Error("Failed to request email verification", "username", user.Username, "error", err)
+		}
+	}
 	if err := g.publishEvents(user, c); err != nil {
 		c.JSON(500, gin.H{"error": "failed to publish events to RabbitMQ"})
 		return
@@ -140,23 +449,76 @@ func (g *GinServer) createUser(c *gin.Context) {
 func (g *GinServer) updateUser(c *gin.Context) {
 	var user models.User
 	c.ShouldBindBodyWithJSON(&user)
+	if !g.canModify(c, user.Username) {
+		return
+	}
 	oldUser, err := g.DB.GetUser(user.Username)
 	if err != nil {
 		c.JSON(404, gin.H{"error": "user not found"})
 		return
 	}
+	if user.Password != "" && !g.notImpersonated(c, "change password") {
+		return
+	}
+	if user.Email != "" && !strings.EqualFold(user.Email, oldUser.Email) && !g.notImpersonated(c, "change email") {
+		return
+	}
+	if user.Password != "" {
+		if oldUser.Source != auth.SourceLocal {
+			c.JSON(409, gin.H{"error": auth.ErrExternalCredentials.Error()})
+			return
+		}
+		if err := g.auth.CheckPassword(user.Username, user.Password); passwordRejected(c, "password", err) {
+			return
+		}
+		// like ChangePassword over gRPC, only admins changing the password of another user skip the check
+		if callerClaims(c).Subject == user.Username {
+			var req struct {
+				CurrentPassword string `json:"current_password"`
+			}
+			c.ShouldBindBodyWithJSON(&req)
+			if req.CurrentPassword == "" {
+				c.JSON(400, gin.H{"error": "current_password not provided"})
+				return
+			}
+			if _, err := g.auth.Authenticate(user.Username, req.CurrentPassword, c.ClientIP()); err != nil {
+				c.JSON(403, gin.H{"error": "incorrect password"})
+				return
+			}
+		}
+	}
 
+	if user.Email != "" && !strings.EqualFold(user.Email, oldUser.Email) {
+		if err := g.auth.ChangeEmail(user.Username, user.Email); err != nil {
+			switch {
+			case errors.Is(err, auth.ErrInvalidEmail):
+				c.JSON(400, gin.H{"error": err.Error()})
+			case errors.Is(err, database.ErrEmailExists):
+				c.JSON(409, gin.H{"error": err.Error()})
+			default:
+				c.JSON(500, gin.H{"error": "failed to update email address"})
+			}
+			return
+		}
+	}
 	g.DB.UpdateUser(user)
+	if user.Password != "" {
+		if err := g.auth.ChangePassword(user.Username, user.Password); err != nil {
+			c.JSON(500, gin.H{"error": "failed to update password"})
+			return
+		}
+	}
 	c.JSON(200, gin.H{
 		"message":   "user updated",
 		"username":  user.Username,
 		"firstname": user.FirstName,
 		"lastname":  user.LastName,
+		"email":     user.Email,
 	})
 
 	msgBody, err := json.Marshal(map[string]interface{}{
-		"oldUser":     oldUser,
-		"updatedUser": user,
+		"oldUser":     oldUser.WithoutPassword(),
+		"updatedUser": user.WithoutPassword(),
 	})
 	if err != nil {
 		c.JSON(500, gin.H{"error": "failed to marshal user to JSON"})
@@ -169,7 +531,13 @@ func (g *GinServer) updateUser(c *gin.Context) {
 func (g *GinServer) deleteUser(c *gin.Context) {
 	var user models.User
 	c.ShouldBindBodyWithJSON(&user)
+	if !g.canModify(c, user.Username) || !g.notImpersonated(c, "delete user") {
+		return
+	}
 	g.DB.DeleteUser(user.Username)
+	if err := g.auth.RevokeUserTokens(user.Username); err != nil {
+		g.rlog.Error("Failed to revoke tokens of deleted user", "username", user.Username, "error", err)
+	}
 	c.JSON(200, gin.H{
 		"message":  "user deleted",
 		"username": user.Username,
@@ -177,12 +545,372 @@ func (g *GinServer) deleteUser(c *gin.Context) {
 	g.rlog.Info("User deleted", "username", user.Username)
 }
 
+// unlockUser lifts a lockout after too many failed logins
+func (g *GinServer) unlockUser(c *gin.Context) {
+	username := c.Param("username")
+	if err := g.auth.Unlock(username); err != nil {
+		c.JSON(404, gin.H{"error": "user not found"})
+		return
+	}
+	g.rlog.Info("User unlocked", "username", username, "caller", callerClaims(c).Subject)
+	c.JSON(200, gin.H{
+		"message":  "user unlocked",
+		"username": username,
+	})
+}
+
+// impersonateUser issues a short-lived token for the user to an admin, carrying the admin as actor
+func (g *GinServer) impersonateUser(c *gin.Context) {
+	username := c.Param("username")
+	var req struct {
+		Reason string `json:"reason"`
+	}
+	// the reason is optional, but a body that is not JSON is rejected rather than ignored
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindBodyWithJSON(&req); err != nil {
+			c.JSON(400, gin.H{"error": "invalid request body"})
+			return
+		}
+	}
+	caller := callerClaims(c)
+	tokens, err := g.auth.Impersonate(caller, username, c.Query("audience"), req.Reason, clientInfo(c))
+	switch {
+	case errors.Is(err, auth.ErrUserNotFound):
+		c.JSON(404, gin.H{"error": "user not found"})
+		return
+	case errors.Is(err, auth.ErrNestedImpersonation), errors.Is(err, auth.ErrSelfImpersonation):
+		c.JSON(403, gin.H{"error": err.Error()})
+		return
+	case errors.Is(err, auth.ErrInvalidAudience):
+		c.JSON(400, gin.H{"error": "audience is not allowed"})
+		return
+	case err != nil:
+		g.rlog.Error("Failed to impersonate user", "username", username, "caller", caller.Subject, "error", err)
+		c.JSON(500, gin.H{"error": "failed to impersonate user"})
+		return
+	}
+	g.rlog.Warn("User impersonated", "username", username, "caller", caller.Subject, "ip", c.ClientIP())
+	c.JSON(200, gin.H{
+		"jwt":        tokens.AccessToken,
+		"expires_in": tokens.ExpiresIn,
+		"act":        auth.Actor{Subject: caller.Subject},
+	})
+}
+
+// requestEmailVerification sends a new verification token to the email address of the user
+func (g *GinServer) requestEmailVerification(c *gin.Context) {
+	username := c.Param("username")
+	if !g.canModify(c, username) {
+		return
+	}
+	err := g.auth.RequestEmailVerification(username)
+	switch {
+	case errors.Is(err, auth.ErrUserNotFound):
+		c.JSON(404, gin.H{"error": "user not found"})
+	case errors.Is(err, auth.ErrInvalidEmail), errors.Is(err, auth.ErrEmailAlreadyVerified):
+		c.JSON(409, gin.H{"error": err.Error()})
+	case err != nil:
+		c.JSON(500, gin.H{"error": "failed to request email verification"})
+	default:
+		c.JSON(202, gin.H{
+			"message":  "verification sent",
+			"username": username,
+		})
+	}
+}
+
+// verifyEmail confirms an email address with the token sent to it
+func (g *GinServer) verifyEmail(c *gin.Context) {
+	var req struct {
+		Token string `json:"token"`
+	}
+	if err := c.ShouldBindBodyWithJSON(&req); err != nil || req.Token == "" {
+		c.JSON(400, gin.H{"error": "token not provided"})
+		return
+	}
+	username, err := g.auth.VerifyEmail(req.Token)
+	if errors.Is(err, auth.ErrInvalidVerificationToken) {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	if errors.Is(err, database.ErrEmailExists) {
+		c.JSON(409, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(500, gin.H{"error": "failed to verify email address"})
+		return
+	}
+	g.rlog.Info("Email verified", "username", username)
+	c.JSON(200, gin.H{
+		"message":  "email verified",
+		"username": username,
+	})
+}
+
+// enrollTOTP creates a TOTP secret for the authenticator app of the caller
+func (g *GinServer) enrollTOTP(c *gin.Context) {
+	username := c.Param("username")
+	if !g.checkOwnership(c, username, "enroll mfa", callerClaims(c).Subject == username) || !g.notImpersonated(c, "enroll mfa") {
+		return
+	}
+	enrollment, err := g.auth.EnrollTOTP(username)
+	if errors.Is(err, auth.ErrMFAAlreadyEnabled) {
+		c.JSON(409, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(500, gin.H{"error": "failed to enroll two-factor authentication"})
+		return
+	}
+	c.JSON(200, enrollment)
+}
+
+// confirmTOTP enables two-factor authentication with a first code and returns the recovery codes
+func (g *GinServer) confirmTOTP(c *gin.Context) {
+	username := c.Param("username")
+	if !g.checkOwnership(c, username, "enroll mfa", callerClaims(c).Subject == username) || !g.notImpersonated(c, "enroll mfa") {
+		return
+	}
+	var req struct {
+		Code string `json:"code"`
+	}
+	if err := c.ShouldBindBodyWithJSON(&req); err != nil || req.Code == "" {
+		c.JSON(400, gin.H{"error": "code not provided"})
+		return
+	}
+	recoveryCodes, err := g.auth.ConfirmTOTP(username, req.Code)
+	switch {
+	case errors.Is(err, auth.ErrInvalidMFACode):
+		c.JSON(400, gin.H{"error": err.Error()})
+	case errors.Is(err, auth.ErrMFANotEnrolled), errors.Is(err, auth.ErrMFAAlreadyEnabled):
+		c.JSON(409, gin.H{"error": err.Error()})
+	case err != nil:
+		c.JSON(500, gin.H{"error": "failed to enable two-factor authentication"})
+	default:
+		g.rlog.Info("Two-factor authentication enabled", "username", username)
+		c.JSON(200, gin.H{
+			"message":        "two-factor authentication enabled",
+			"recovery_codes": recoveryCodes,
+		})
+	}
+}
+
+// resetMFA removes the second factor of a user
+func (g *GinServer) resetMFA(c *gin.Context) {
+	username := c.Param("username")
+	if !g.notImpersonated(c, "reset mfa") {
+		return
+	}
+	if err := g.auth.ResetMFA(username); err != nil {
+		if errors.Is(err, auth.ErrUserNotFound) {
+			c.JSON(404, gin.H{"error": "user not found"})
+			return
+		}
+		c.JSON(500, gin.H{"error": "failed to reset two-factor authentication"})
+		return
+	}
+	g.rlog.Info("Two-factor authentication reset", "username", username, "caller", callerClaims(c).Subject)
+	c.JSON(200, gin.H{
+		"message":  "two-factor authentication reset",
+		"username": username,
+	})
+}
+
+// createAPIKey creates a named, scoped key for the user. The key is only returned once.
+func (g *GinServer) createAPIKey(c *gin.Context) {
+	username := c.Param("username")
+	if !g.canModify(c, username) {
+		return
+	}
+	// keys cannot be used to mint further keys, which would outlive a revoked key
+	if callerClaims(c).APIKeyID != "" {
+		c.JSON(403, gin.H{"error": "api keys cannot create api keys"})
+		return
+	}
+	// nor may support staff leave a key behind in an account they impersonate
+	if !g.notImpersonated(c, "create api key") {
+		return
+	}
+	var req struct {
+		Name      string     `json:"name"`
+		Scopes    []string   `json:"scopes"`
+		ExpiresAt *time.Time `json:"expires_at"`
+	}
+	if err := c.ShouldBindBodyWithJSON(&req); err != nil || req.Name == "" {
+		c.JSON(400, gin.H{"error": "name not provided"})
+		return
+	}
+	var expiresAt time.Time
+	if req.ExpiresAt != nil {
+		expiresAt = *req.ExpiresAt
+		if !expiresAt.After(time.Now()) {
+			c.JSON(400, gin.H{"error": "expires_at must be in the future"})
+			return
+		}
+	}
+	key, secret, err := g.auth.CreateAPIKey(username, req.Name, req.Scopes, expiresAt)
+	switch {
+	case errors.Is(err, auth.ErrUserNotFound):
+		c.JSON(404, gin.H{"error": "user not found"})
+		return
+	case errors.Is(err, auth.ErrInvalidScope):
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	case err != nil:
+		c.JSON(500, gin.H{"error": "failed to create api key"})
+		return
+	}
+	g.rlog.Info("API key created", "username", username, "key", key.ID, "caller", callerClaims(c).Subject)
+	response := apiKeyJSON(key)
+	response["key"] = secret
+	c.JSON(201, response)
+}
+
+func (g *GinServer) listAPIKeys(c *gin.Context) {
+	username := c.Param("username")
+	if !g.canModify(c, username) {
+		return
+	}
+	keys, err := g.auth.ListAPIKeys(username)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "failed to list api keys"})
+		return
+	}
+	response := []gin.H{}
+	for _, key := range keys {
+		response = append(response, apiKeyJSON(key))
+	}
+	c.JSON(200, gin.H{
+		"api_keys": response,
+	})
+}
+
+func (g *GinServer) revokeAPIKey(c *gin.Context) {
+	username := c.Param("username")
+	if !g.canModify(c, username) || !g.notImpersonated(c, "revoke api key") {
+		return
+	}
+	if err := g.auth.RevokeAPIKey(username, c.Param("id")); err != nil {
+		c.JSON(404, gin.H{"error": "api key not found"})
+		return
+	}
+	g.rlog.Info("API key revoked", "username", username, "key", c.Param("id"), "caller", callerClaims(c).Subject)
+	c.JSON(200, gin.H{
+		"message": "api key revoked",
+		"id":      c.Param("id"),
+	})
+}
+
+// apiKeyJSON describes a key without its secret
+func apiKeyJSON(key models.APIKey) gin.H {
+	response := gin.H{
+		"id":         key.ID,
+		"name":       key.Name,
+		"username":   key.Username,
+		"scopes":     key.Scopes,
+		"created_at": key.CreatedAt,
+		"revoked":    key.Revoked,
+	}
+	if !key.ExpiresAt.IsZero() {
+		response["expires_at"] = key.ExpiresAt
+	}
+	if !key.LastUsedAt.IsZero() {
+		response["last_used_at"] = key.LastUsedAt
+	}
+	return response
+}
+
+// listOwnSessions lists the active logins of the caller
+func (g *GinServer) listOwnSessions(c *gin.Context) {
+	g.listSessions(c, callerClaims(c).Subject)
+}
+
+// listUserSessions lists the active logins of a user
+func (g *GinServer) listUserSessions(c *gin.Context) {
+	if !g.canModify(c, c.Param("username")) {
+		return
+	}
+	g.listSessions(c, c.Param("username"))
+}
+
+func (g *GinServer) listSessions(c *gin.Context, username string) {
+	sessions, err := g.auth.ListSessions(username)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "failed to list sessions"})
+		return
+	}
+	response := []gin.H{}
+	for _, session := range sessions {
+		response = append(response, gin.H{
+			"id":           session.ID,
+			"audience":     session.Audience,
+			"ip":           session.IP,
+			"user_agent":   session.UserAgent,
+			"created_at":   session.CreatedAt,
+			"last_used_at": session.LastUsedAt,
+			"expires_at":   session.ExpiresAt,
+			"current":      session.ID == callerClaims(c).SessionID,
+		})
+	}
+	c.JSON(200, gin.H{
+		"username": username,
+		"sessions": response,
+	})
+}
+
+// revokeOwnSession ends a login of the caller
+func (g *GinServer) revokeOwnSession(c *gin.Context) {
+	g.revokeSession(c, callerClaims(c).Subject)
+}
+
+// revokeUserSession ends a login of a user
+func (g *GinServer) revokeUserSession(c *gin.Context) {
+	if !g.canModify(c, c.Param("username")) {
+		return
+	}
+	g.revokeSession(c, c.Param("username"))
+}
+
+func (g *GinServer) revokeSession(c *gin.Context, username string) {
+	if !g.notImpersonated(c, "revoke session") {
+		return
+	}
+	if err := g.auth.RevokeSession(username, c.Param("id")); err != nil {
+		if errors.Is(err, auth.ErrSessionNotFound) {
+			c.JSON(404, gin.H{"error": "session not found"})
+			return
+		}
+		c.JSON(500, gin.H{"error": "failed to revoke session"})
+		return
+	}
+	g.rlog.Info("Session revoked", "username", username, "session", c.Param("id"), "caller", callerClaims(c).Subject)
+	c.JSON(200, gin.H{
+		"message": "session revoked",
+		"id":      c.Param("id"),
+	})
+}
+
+// passwordRejected answers with the violated password rules of the given request field
+// if err is a policy error
+func passwordRejected(c *gin.Context, field string, err error) bool {
+	var policyErr *auth.PolicyError
+	if !errors.As(err, &policyErr) {
+		return false
+	}
+	c.JSON(400, gin.H{
+		"error":  "password does not meet the policy",
+		"fields": gin.H{field: policyErr.Violations},
+	})
+	return true
+}
+
 func (g *GinServer) publishEvents(user models.User, c *gin.Context) error {
 	// Prepare message for RabbitMQ
 	// Marshall user struct to JSON
 	// publish message to RabbitMQ exchange user with routing key "users.new"
 	// publish message to RabbitMQ exchange user with routing key "users.count"
-	msgBody, err := json.Marshal(user)
+	msgBody, err := json.Marshal(user.WithoutPassword())
 	if err != nil {
 		c.JSON(500, gin.H{"error": "failed to marshal user to JSON"})
 	}
@@ -0,0 +1,329 @@
+package restserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/BieggerM/userservice/pkg/adapter/out/broker/brokertest"
+	"github.com/BieggerM/userservice/pkg/adapter/out/database/databasetest"
+	"github.com/BieggerM/userservice/pkg/models"
+	"github.com/BieggerM/userservice/pkg/service/auth"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type nopLogger struct{}
+
+func (nopLogger) Setup(fluentHost string, fluentPort int, tag string) error { return nil }
+func (nopLogger) Close() error                                              { return nil }
+func (nopLogger) Info(message string, fields ...interface{})                {}
+func (nopLogger) Warn(message string, fields ...interface{})                {}
+func (nopLogger) Error(message string, fields ...interface{})               {}
+func (nopLogger) Debug(message string, fields ...interface{})               {}
+func (nopLogger) Fatal(message string, fields ...interface{})               {}
+
+type testServer struct {
+	*GinServer
+	db      *databasetest.Memory
+	mb      *brokertest.Recorder
+	service *auth.Auth
+	handler http.Handler
+}
+
+func setupServer(t *testing.T) *testServer {
+	gin.SetMode(gin.TestMode)
+	db := databasetest.NewMemory()
+	mb := &brokertest.Recorder{}
+	service := &auth.Auth{}
+	assert.NoError(t, service.Setup(db, mb, auth.Config{
+		KeyDir:            t.TempDir(),
+		KeyRotationLeader: true,
+		TokenTTL:          15 * time.Minute,
+		RefreshTokenTTL:   time.Hour,
+		Issuer:            "http://localhost:8082",
+		PublicURL:         "http://localhost:8082",
+		Audiences:         []string{"recipemanagement"},
+		Leeway:            30 * time.Second,
+		PasswordParams:    auth.Argon2Params{Memory: 1024, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32},
+	}))
+	g := &GinServer{DB: db, MB: mb, rlog: nopLogger{}, auth: service}
+	handler, err := g.router()
+	assert.NoError(t, err)
+	return &testServer{GinServer: g, db: db, mb: mb, service: service, handler: handler}
+}
+
+// do sends a request with an optional bearer token and JSON body
+func (s *testServer) do(method, path, token, body string) *httptest.ResponseRecorder {
+	var reader io.Reader
+	if body != "" {
+		reader = strings.NewReader(body)
+	}
+	req := httptest.NewRequest(method, path, reader)
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	s.handler.ServeHTTP(rec, req)
+	return rec
+}
+
+// failLogins sends failed logins for distinct unknown users from the same connection, each with another forwarded address
+func failLogins(handler http.Handler, count int) *httptest.ResponseRecorder {
+	var rec *httptest.ResponseRecorder
+	for i := 0; i < count; i++ {
+		req := httptest.NewRequest("POST", "/api/v1/auth", nil)
+		req.RemoteAddr = "192.0.2.1:4711"
+		req.Header.Set("X-Forwarded-For", fmt.Sprintf("198.51.100.%d", i))
+		req.SetBasicAuth(fmt.Sprintf("nobody%d", i), "wrong password")
+		rec = httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+	}
+	return rec
+}
+
+func TestForgedForwardedForDoesNotEscapeThrottling(t *testing.T) {
+	s := setupServer(t)
+	rec := failLogins(s.handler, 20)
+	assert.Equal(t, 401, rec.Code)
+	rec = failLogins(s.handler, 1)
+	assert.Equal(t, 429, rec.Code)
+	assert.NotEmpty(t, rec.Header().Get("Retry-After"))
+}
+
+func TestTrustedProxyForwardsClientAddress(t *testing.T) {
+	s := setupServer(t)
+	s.TrustedProxies = []string{"192.0.2.1"}
+	handler, err := s.router()
+	assert.NoError(t, err)
+	rec := failLogins(handler, 21)
+	assert.Equal(t, 401, rec.Code)
+
+	s.TrustedProxies = []string{"not an address"}
+	_, err = s.router()
+	assert.Error(t, err)
+}
+
+func TestJWKSIsCacheable(t *testing.T) {
+	s := setupServer(t)
+
+	rec := s.do("GET", "/.well-known/jwks.json", "", "")
+	assert.Equal(t, 200, rec.Code)
+	assert.Equal(t, "public, max-age=300", rec.Header().Get("Cache-Control"))
+	var set auth.JWKSet
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &set))
+	assert.Len(t, set.Keys, 1)
+	assert.Equal(t, auth.AlgRS256, set.Keys[0].Alg)
+}
+
+func TestLogoutAndDeletionRevokeTokens(t *testing.T) {
+	s := setupServer(t)
+	assert.NoError(t, s.db.SaveUser(models.User{Username: "user1", Roles: []string{auth.RoleUser}}))
+	token := s.tokenFor(t, "user1", auth.RoleUser)
+	other := s.tokenFor(t, "user1", auth.RoleUser)
+
+	rec := s.do("POST", "/api/v1/auth/logout", token, "")
+	assert.Equal(t, 200, rec.Code)
+	rec = s.do("GET", "/api/v1/auth", token, "")
+	assert.Equal(t, 401, rec.Code)
+	rec = s.do("GET", "/api/v1/auth", other, "")
+	assert.Equal(t, 200, rec.Code)
+
+	rec = s.do("DELETE", "/api/v1/users", s.tokenFor(t, "admin1", auth.RoleAdmin), `{"username":"user1"}`)
+	assert.Equal(t, 200, rec.Code)
+	rec = s.do("GET", "/api/v1/auth", other, "")
+	assert.Equal(t, 401, rec.Code)
+}
+
+func TestRefreshTokenIsNoBearerToken(t *testing.T) {
+	s := setupServer(t)
+	assert.NoError(t, s.db.SaveUser(models.User{Username: "user1", Roles: []string{auth.RoleUser}}))
+	user, err := s.db.GetUser("user1")
+	assert.NoError(t, err)
+	pair, err := s.service.IssueTokens(user, "", auth.ClientInfo{})
+	assert.NoError(t, err)
+
+	assert.Equal(t, 200, s.do("GET", "/api/v1/auth", pair.AccessToken, "").Code)
+	assert.Equal(t, 401, s.do("GET", "/api/v1/auth", pair.RefreshToken, "").Code)
+	assert.Equal(t, 401, s.do("GET", "/api/v1/users/user1", pair.RefreshToken, "").Code)
+}
+
+func TestSessionsAreOnlyVisibleToTheirUser(t *testing.T) {
+	s := setupServer(t)
+	pairs := map[string]auth.TokenPair{}
+	for _, username := range []string{"user1", "user2"} {
+		user := models.User{Username: username, Roles: []string{auth.RoleUser}}
+		assert.NoError(t, s.db.SaveUser(user))
+		pair, err := s.service.IssueTokens(user, "", auth.ClientInfo{})
+		assert.NoError(t, err)
+		pairs[username] = pair
+	}
+	sessions, err := s.db.ListSessions("user1")
+	assert.NoError(t, err)
+	assert.Len(t, sessions, 1)
+	id := sessions[0].ID
+
+	rec := s.do("GET", "/api/v1/auth/sessions", pairs["user2"].AccessToken, "")
+	assert.Equal(t, 200, rec.Code)
+	assert.NotContains(t, rec.Body.String(), id)
+	assert.Equal(t, 403, s.do("GET", "/api/v1/users/user1/sessions", pairs["user2"].AccessToken, "").Code)
+	assert.Equal(t, 404, s.do("DELETE", "/api/v1/auth/sessions/"+id, pairs["user2"].AccessToken, "").Code)
+	assert.Equal(t, 200, s.do("GET", "/api/v1/auth", pairs["user1"].AccessToken, "").Code)
+
+	rec = s.do("GET", "/api/v1/auth/sessions", pairs["user1"].AccessToken, "")
+	assert.Equal(t, 200, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"current":true`)
+	admin := s.tokenFor(t, "admin1", auth.RoleAdmin)
+	assert.Equal(t, 200, s.do("DELETE", "/api/v1/users/user1/sessions/"+id, admin, "").Code)
+	assert.Equal(t, 401, s.do("GET", "/api/v1/auth", pairs["user1"].AccessToken, "").Code)
+	assert.Equal(t, 200, s.do("GET", "/api/v1/auth", pairs["user2"].AccessToken, "").Code)
+}
+
+func TestMagicLinkLogsIn(t *testing.T) {
+	s := setupServer(t)
+	assert.NoError(t, s.db.SaveUser(models.User{Username: "user1", Email: "user1@example.com", Roles: []string{auth.RoleUser}}))
+	assert.NoError(t, s.db.MarkEmailVerified("user1"))
+
+	assert.Equal(t, 400, s.do("POST", "/api/v1/auth/magic-link", "", `{}`).Code)
+	// unknown users get the same answer
+	for _, username := range []string{"user1", "nobody"} {
+		assert.Equal(t, 202, s.do("POST", "/api/v1/auth/magic-link", "", `{"username":"`+username+`"}`).Code)
+	}
+	assert.Eventually(t, func() bool {
+		return len(s.mb.Messages("users.magic_link_requested")) > 0
+	}, time.Second, 10*time.Millisecond)
+	messages := s.mb.Messages("users.magic_link_requested")
+	assert.Len(t, messages, 1)
+	var event struct {
+		Token string `json:"token"`
+	}
+	assert.NoError(t, json.Unmarshal(messages[0].Body, &event))
+
+	assert.Equal(t, 400, s.do("POST", "/api/v1/auth/magic-link/confirm", "", `{}`).Code)
+	rec := s.do("POST", "/api/v1/auth/magic-link/confirm", "", `{"token":"`+event.Token+`"}`)
+	assert.Equal(t, 200, rec.Code, rec.Body.String())
+	var tokens auth.TokenPair
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &tokens))
+	assert.NotEmpty(t, tokens.RefreshToken)
+	assert.Equal(t, 200, s.do("GET", "/api/v1/auth", tokens.AccessToken, "").Code)
+
+	// links can be used once
+	assert.Equal(t, 401, s.do("POST", "/api/v1/auth/magic-link/confirm", "", `{"token":"`+event.Token+`"}`).Code)
+}
+
+func TestPasswordChangeRequiresCurrentPassword(t *testing.T) {
+	s := setupServer(t)
+	for _, username := range []string{"user1", "user2"} {
+		hash, err := s.service.HashPassword("correct horse battery")
+		assert.NoError(t, err)
+		assert.NoError(t, s.db.SaveUser(models.User{Username: username, Password: hash, Roles: []string{auth.RoleUser}}))
+	}
+	token := s.tokenFor(t, "user1", auth.RoleUser)
+
+	rec := s.do("PATCH", "/api/v1/users", token, `{"username":"user1","password":"Brand new passphrase 42"}`)
+	assert.Equal(t, 400, rec.Code)
+	rec = s.do("PATCH", "/api/v1/users", token, `{"username":"user1","password":"Brand new passphrase 42","current_password":"wrong"}`)
+	assert.Equal(t, 403, rec.Code)
+	_, err := s.service.Authenticate("user1", "correct horse battery", "")
+	assert.NoError(t, err)
+
+	rec = s.do("PATCH", "/api/v1/users", token, `{"username":"user1","password":"Brand new passphrase 42","current_password":"correct horse battery"}`)
+	assert.Equal(t, 200, rec.Code)
+	_, err = s.service.Authenticate("user1", "Brand new passphrase 42", "")
+	assert.NoError(t, err)
+
+	// admins reset the password of others without knowing it
+	rec = s.do("PATCH", "/api/v1/users", s.tokenFor(t, "admin1", auth.RoleAdmin), `{"username":"user2","password":"Brand new passphrase 42"}`)
+	assert.Equal(t, 200, rec.Code)
+	_, err = s.service.Authenticate("user2", "Brand new passphrase 42", "")
+	assert.NoError(t, err)
+}
+
+func TestClientIDsAreNotUsernames(t *testing.T) {
+	s := setupServer(t)
+	rec := s.do("POST", "/api/v1/users", s.tokenFor(t, "admin1", auth.RoleAdmin), `{"username":"cl_0123456789abcdef","password":"Brand new passphrase 42"}`)
+	assert.Equal(t, 400, rec.Code)
+	_, err := s.db.GetUser("cl_0123456789abcdef")
+	assert.Error(t, err)
+}
+
+func TestImpersonationCannotTakeOverAccount(t *testing.T) {
+	s := setupServer(t)
+	hash, err := s.service.HashPassword("correct horse battery")
+	assert.NoError(t, err)
+	assert.NoError(t, s.db.SaveUser(models.User{Username: "user1", Password: hash, Email: "user1@example.com", Roles: []string{auth.RoleUser}}))
+	admin := s.tokenFor(t, "admin1", auth.RoleAdmin)
+
+	rec := s.do("POST", "/api/v1/users/user1/impersonate", admin, `{"reason":`)
+	assert.Equal(t, 400, rec.Code)
+	rec = s.do("POST", "/api/v1/users/user1/impersonate", admin, "")
+	assert.Equal(t, 200, rec.Code)
+	rec = s.do("POST", "/api/v1/users/user1/impersonate", admin, `{"reason":"ticket 4711"}`)
+	assert.Equal(t, 200, rec.Code)
+	var impersonation struct {
+		JWT string `json:"jwt"`
+	}
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &impersonation))
+	token := impersonation.JWT
+
+	for _, request := range []struct{ method, path, body string }{
+		{"PATCH", "/api/v1/users", `{"username":"user1","password":"Brand new passphrase 42","current_password":"correct horse battery"}`},
+		{"PATCH", "/api/v1/users", `{"username":"user1","email":"attacker@example.com"}`},
+		{"POST", "/api/v1/users/user1/mfa/totp", ""},
+		{"POST", "/api/v1/users/user1/mfa/totp/confirm", `{"code":"123456"}`},
+		{"POST", "/api/v1/users/user1/api-keys", `{"name":"backdoor"}`},
+		{"DELETE", "/api/v1/users/user1/sessions/s1", ""},
+		{"DELETE", "/api/v1/auth/sessions/s1", ""},
+		{"DELETE", "/api/v1/users", `{"username":"user1"}`},
+	} {
+		rec = s.do(request.method, request.path, token, request.body)
+		assert.Equal(t, 403, rec.Code, request.method+" "+request.path+" "+request.body)
+	}
+	_, err = s.service.Authenticate("user1", "correct horse battery", "")
+	assert.NoError(t, err)
+	stored, err := s.db.GetUser("user1")
+	assert.NoError(t, err)
+	assert.Equal(t, "user1@example.com", stored.Email)
+
+	// everything else about the account may still be edited for the user
+	rec = s.do("PATCH", "/api/v1/users", token, `{"username":"user1","firstname":"John","email":"user1@example.com"}`)
+	assert.Equal(t, 200, rec.Code)
+}
+
+// unavailableBackend is an external credential backend that cannot be reached
+type unavailableBackend struct{}
+
+func (unavailableBackend) Source() string { return auth.SourceLDAP }
+func (unavailableBackend) Verify(login, password string) (models.User, error) {
+	return models.User{}, auth.ErrCredentialBackendUnavailable
+}
+
+func TestUnavailableCredentialBackend(t *testing.T) {
+	s := setupServer(t)
+	assert.NoError(t, s.service.Setup(s.db, s.mb, auth.Config{
+		KeyDir:              t.TempDir(),
+		KeyRotationLeader:   true,
+		TokenTTL:            15 * time.Minute,
+		Issuer:              "http://localhost:8082",
+		PublicURL:           "http://localhost:8082",
+		Audiences:           []string{"recipemanagement"},
+		PasswordParams:      auth.Argon2Params{Memory: 1024, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32},
+		CredentialVerifiers: []auth.CredentialVerifier{unavailableBackend{}},
+	}))
+
+	for i := 0; i < 25; i++ {
+		req := httptest.NewRequest("POST", "/api/v1/auth", nil)
+		req.SetBasicAuth("jdoe", "correct horse")
+		rec := httptest.NewRecorder()
+		s.handler.ServeHTTP(rec, req)
+		// an outage is neither a failed login nor a reason to throttle
+		assert.Equal(t, 503, rec.Code)
+	}
+}
@@ -0,0 +1,55 @@
+// Package brokertest provides a message broker for tests that records published messages
+package brokertest
+
+import (
+	"sync"
+
+	"github.com/BieggerM/userservice/pkg/adapter/out/broker"
+)
+
+// Message is a published message
+type Message struct {
+	Exchange   string
+	RoutingKey string
+	Body       []byte
+}
+
+// Recorder keeps all published messages in memory. It is safe for concurrent use.
+type Recorder struct {
+	mu       sync.Mutex
+	messages []Message
+}
+
+var _ broker.MessageBroker = (*Recorder)(nil)
+
+func (r *Recorder) Connect(rabbitmqUser, rabbitmqPassword, rabbitmqHost, rabbitmqPort string) error {
+	return nil
+}
+
+func (r *Recorder) Close() error {
+	return nil
+}
+
+func (r *Recorder) Publish(exchange, routingKey string, body []byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.messages = append(r.messages, Message{Exchange: exchange, RoutingKey: routingKey, Body: body})
+	return nil
+}
+
+func (r *Recorder) Subscribe(exchange, key string) error {
+	return nil
+}
+
+// Messages returns the messages published with the routing key in the order they were published
+func (r *Recorder) Messages(routingKey string) []Message {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var messages []Message
+	for _, message := range r.messages {
+		if message.RoutingKey == routingKey {
+			messages = append(messages, message)
+		}
+	}
+	return messages
+}
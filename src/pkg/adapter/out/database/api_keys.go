@@ -0,0 +1,83 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"github.com/BieggerM/userservice/pkg/models"
+	"github.com/lib/pq"
+)
+
+const apiKeyColumns = "id, name, username, key_hash, scopes, created_at, expires_at, last_used_at, revoked"
+
+// SaveAPIKey saves an API key to the PostgreSQL database
+func (p *Postgres) SaveAPIKey(key models.APIKey) error {
+	var expiresAt sql.NullTime
+	if !key.ExpiresAt.IsZero() {
+		expiresAt = sql.NullTime{Time: key.ExpiresAt, Valid: true}
+	}
+	_, err := p.DB.Exec("insert into api_keys (id, name, username, key_hash, scopes, expires_at) values ($1, $2, $3, $4, $5, $6)",
+		key.ID, key.Name, key.Username, key.KeyHash, pq.Array(key.Scopes), expiresAt)
+	return err
+}
+
+// GetAPIKey gets an API key by its id from the PostgreSQL database
+func (p *Postgres) GetAPIKey(id string) (models.APIKey, error) {
+	key, err := scanAPIKey(p.DB.QueryRow("select "+apiKeyColumns+" from api_keys where id = $1", id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return key, errors.New("api key does not exist")
+	}
+	return key, err
+}
+
+// ListAPIKeys lists the API keys of a user from the PostgreSQL database
+func (p *Postgres) ListAPIKeys(username string) ([]models.APIKey, error) {
+	rows, err := p.DB.Query("select "+apiKeyColumns+" from api_keys where username = $1 order by created_at", username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var keys []models.APIKey
+	for rows.Next() {
+		key, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+// RevokeAPIKey revokes an API key of a user
+func (p *Postgres) RevokeAPIKey(username, id string) error {
+	res, err := p.DB.Exec("update api_keys set revoked = true where id = $1 and username = $2", id, username)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return errors.New("api key does not exist")
+	}
+	return nil
+}
+
+// TouchAPIKey records the use of an API key, at most once per minute to limit writes
+func (p *Postgres) TouchAPIKey(id string) error {
+	_, err := p.DB.Exec("update api_keys set last_used_at = now() where id = $1 and (last_used_at is null or last_used_at < now() - interval '1 minute')", id)
+	return err
+}
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanAPIKey(row rowScanner) (models.APIKey, error) {
+	key := models.APIKey{}
+	var expiresAt, lastUsedAt sql.NullTime
+	err := row.Scan(&key.ID, &key.Name, &key.Username, &key.KeyHash, pq.Array(&key.Scopes), &key.CreatedAt, &expiresAt, &lastUsedAt, &key.Revoked)
+	key.ExpiresAt = expiresAt.Time
+	key.LastUsedAt = lastUsedAt.Time
+	return key, err
+}
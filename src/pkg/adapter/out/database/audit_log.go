@@ -0,0 +1,10 @@
+package database
+
+import "github.com/BieggerM/userservice/pkg/models"
+
+// SaveAuditEvent appends an event to the audit log in the PostgreSQL database
+func (p *Postgres) SaveAuditEvent(event models.AuditEvent) error {
+	_, err := p.DB.Exec("insert into audit_log (action, actor, target, details, ip) values ($1, $2, $3, $4, $5)",
+		event.Action, event.Actor, event.Target, event.Details, event.IP)
+	return err
+}
@@ -5,7 +5,8 @@ import (
 	"errors"
 	"fmt"
 	"github.com/BieggerM/userservice/pkg/models"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
+	"time"
 
 	"github.com/golang-migrate/migrate/v4"
 	"github.com/golang-migrate/migrate/v4/database/postgres"
@@ -17,12 +18,59 @@ type Database interface {
 	SaveUser(user models.User) error
 	DeleteUser(username string)
 	UpdateUser(user models.User) (models.User, error)
+	UpdatePassword(username, password string) error
+	UpdateRoles(username string, roles []string) error
+	GetLoginState(username string) (models.LoginState, error)
+	RecordFailedLogin(username string) (int, error)
+	LockUser(username string, until time.Time, resetFailedLogins bool) error
+	ResetLoginState(username string) error
 	GetUser(username string) (models.User, error)
+	GetUserByEmail(email string) (models.User, error)
+	SetEmail(username, email string) error
+	MarkEmailVerified(username string) error
 	ListUsers() []models.User
+	SaveRefreshToken(token models.RefreshToken) error
+	GetRefreshToken(tokenHash string) (models.RefreshToken, error)
+	MarkRefreshTokenUsed(tokenHash string) (bool, error)
+	RevokeRefreshTokenFamily(familyID string) error
+	RevokeToken(token models.RevokedToken) error
+	ListRevokedTokens() ([]models.RevokedToken, error)
+	DeleteExpiredRevokedTokens() error
+	RevokeUserTokens(username string, revokedAt time.Time) error
+	ListUserTokenRevocations() (map[string]time.Time, error)
+	SaveOneTimeToken(token models.OneTimeToken) error
+	GetOneTimeToken(tokenHash, purpose string) (models.OneTimeToken, error)
+	ConsumeOneTimeToken(tokenHash, purpose string) (models.OneTimeToken, error)
+	InvalidateOneTimeTokens(username, purpose string) error
+	DeleteExpiredOneTimeTokens() error
+	SaveTOTPSecret(secret models.TOTPSecret) error
+	GetTOTPSecret(username string) (models.TOTPSecret, error)
+	ConfirmTOTPSecret(username string, counter int64, recoveryCodeHashes []string) error
+	UseTOTPCounter(username string, counter int64) (bool, error)
+	UseRecoveryCode(username, codeHash string) (bool, error)
+	DeleteMFA(username string) error
+	SaveAPIKey(key models.APIKey) error
+	GetAPIKey(id string) (models.APIKey, error)
+	ListAPIKeys(username string) ([]models.APIKey, error)
+	RevokeAPIKey(username, id string) error
+	TouchAPIKey(id string) error
+	SaveSession(session models.Session) error
+	GetSession(id string) (models.Session, error)
+	ListSessions(username string) ([]models.Session, error)
+	RefreshSession(id, ip, userAgent string, expiresAt time.Time) error
+	TouchSession(id string) error
+	RevokeSession(id string, revokedAt time.Time) error
+	ListRevokedSessions(since time.Time) (map[string]time.Time, error)
+	SaveOAuthClient(client models.OAuthClient) error
+	GetOAuthClient(clientID string) (models.OAuthClient, error)
+	SaveAuditEvent(event models.AuditEvent) error
 	RunMigrations(migrationPath string) error
 	Close() error
 }
 
+// ErrEmailExists is returned when an email address is already verified by another account
+var ErrEmailExists = errors.New("email address already in use")
+
 // Postgres is the PostgreSQL database connection
 type Postgres struct {
 	DB *sql.DB
@@ -47,7 +95,14 @@ func (p *Postgres) SaveUser(user models.User) error {
 	if exists {
 		return errors.New("user already exists")
 	}
-	_, err = p.DB.Exec("insert into users (username, firstname, lastname, password) values ($1, $2, $3, $4)", user.Username, user.FirstName, user.LastName, user.Password)
+	taken, err := p.emailVerifiedByOther(user.Username, user.Email)
+	if err != nil {
+		return err
+	}
+	if taken {
+		return ErrEmailExists
+	}
+	_, err = p.DB.Exec("insert into users (username, firstname, lastname, password, roles, email, source) values ($1, $2, $3, $4, coalesce($5, '{user}'::text[]), nullif($6, ''), coalesce(nullif($7, ''), 'local'))", user.Username, user.FirstName, user.LastName, user.Password, pq.Array(user.Roles), user.Email, user.Source)
 	if err != nil {
 		return err
 	}
@@ -78,10 +133,32 @@ func (p *Postgres) UpdateUser(user models.User) (models.User, error) {
 	return user, nil
 }
 
+// UpdateRoles replaces the roles of a user in the PostgreSQL database
+func (p *Postgres) UpdateRoles(username string, roles []string) error {
+	_, err := p.DB.Exec("update users set roles = $1 where username = $2", pq.Array(roles), username)
+	return err
+}
+
+// UpdatePassword updates the password of a user in the PostgreSQL database
+func (p *Postgres) UpdatePassword(username, password string) error {
+	res, err := p.DB.Exec("update users set password = $1 where username = $2", password, username)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return errors.New("user does not exist")
+	}
+	return nil
+}
+
 // GetUser gets a user from the PostgreSQL database
 func (p *Postgres) GetUser(username string) (models.User, error) {
 	user := models.User{}
-	err := p.DB.QueryRow("select username, firstname, lastname, password from users where username = $1", username).Scan(&user.Username, &user.FirstName, &user.LastName, &user.Password)
+	err := p.DB.QueryRow("select username, firstname, lastname, password, roles, coalesce(email, ''), email_verified, source from users where username = $1", username).Scan(&user.Username, &user.FirstName, &user.LastName, &user.Password, pq.Array(&user.Roles), &user.Email, &user.EmailVerified, &user.Source)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			fmt.Println("No user found with the given username")
@@ -95,14 +172,14 @@ func (p *Postgres) GetUser(username string) (models.User, error) {
 
 // ListUsers lists all users from the PostgreSQL database
 func (p *Postgres) ListUsers() []models.User {
-	rows, err := p.DB.Query("select username, firstname, lastname from users")
+	rows, err := p.DB.Query("select username, firstname, lastname, roles, coalesce(email, ''), email_verified, source from users")
 	if err != nil {
 		fmt.Println(err)
 	}
 	var users []models.User
 	for rows.Next() {
 		user := models.User{}
-		rows.Scan(&user.Username, &user.FirstName, &user.LastName)
+		rows.Scan(&user.Username, &user.FirstName, &user.LastName, pq.Array(&user.Roles), &user.Email, &user.EmailVerified, &user.Source)
 		users = append(users, user)
 	}
 	return users
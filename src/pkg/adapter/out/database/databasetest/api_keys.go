@@ -0,0 +1,71 @@
+package databasetest
+
+import (
+	"errors"
+	"sort"
+
+	"github.com/BieggerM/userservice/pkg/models"
+)
+
+func (m *Memory) SaveAPIKey(key models.APIKey) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.apiKeys[key.ID]; ok {
+		return errors.New("api key already exists")
+	}
+	key.CreatedAt = m.now()
+	key.Scopes = append([]string(nil), key.Scopes...)
+	m.apiKeys[key.ID] = &key
+	return nil
+}
+
+func (m *Memory) GetAPIKey(id string) (models.APIKey, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key, ok := m.apiKeys[id]
+	if !ok {
+		return models.APIKey{}, errors.New("api key does not exist")
+	}
+	return *key, nil
+}
+
+func (m *Memory) ListAPIKeys(username string) ([]models.APIKey, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var keys []models.APIKey
+	for _, key := range m.apiKeys {
+		if key.Username == username {
+			keys = append(keys, *key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].CreatedAt.Before(keys[j].CreatedAt) })
+	return keys, nil
+}
+
+func (m *Memory) RevokeAPIKey(username, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key, ok := m.apiKeys[id]
+	if !ok || key.Username != username {
+		return errors.New("api key does not exist")
+	}
+	key.Revoked = true
+	return nil
+}
+
+func (m *Memory) TouchAPIKey(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.apiKeyTouches++
+	if key, ok := m.apiKeys[id]; ok {
+		key.LastUsedAt = m.now()
+	}
+	return nil
+}
+
+// APIKeyTouches returns how often the use of an API key was recorded
+func (m *Memory) APIKeyTouches() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.apiKeyTouches
+}
@@ -0,0 +1,21 @@
+package databasetest
+
+import (
+	"github.com/BieggerM/userservice/pkg/models"
+)
+
+func (m *Memory) SaveAuditEvent(event models.AuditEvent) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	event.ID = int64(len(m.auditEvents) + 1)
+	event.CreatedAt = m.now()
+	m.auditEvents = append(m.auditEvents, event)
+	return nil
+}
+
+// AuditEvents returns all events of the audit log in the order they were saved
+func (m *Memory) AuditEvents() []models.AuditEvent {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]models.AuditEvent(nil), m.auditEvents...)
+}
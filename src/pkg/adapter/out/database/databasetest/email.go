@@ -0,0 +1,58 @@
+package databasetest
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+
+	"github.com/BieggerM/userservice/pkg/adapter/out/database"
+	"github.com/BieggerM/userservice/pkg/models"
+)
+
+// emailTaken reports whether another user holds the address verified, like the unique index on lower(email)
+func (m *Memory) emailTaken(username, email string) bool {
+	for _, u := range m.users {
+		if u.Username != username && email != "" && u.EmailVerified && strings.EqualFold(u.Email, email) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *Memory) GetUserByEmail(email string) (models.User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, stored := range m.users {
+		if stored.Email != "" && stored.EmailVerified && strings.EqualFold(stored.Email, email) {
+			return copyUser(stored.User), nil
+		}
+	}
+	return models.User{}, sql.ErrNoRows
+}
+
+func (m *Memory) SetEmail(username, email string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stored, ok := m.users[username]
+	if !ok {
+		return errors.New("user does not exist")
+	}
+	if m.emailTaken(username, email) {
+		return database.ErrEmailExists
+	}
+	stored.Email = email
+	stored.EmailVerified = false
+	return nil
+}
+
+func (m *Memory) MarkEmailVerified(username string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if stored, ok := m.users[username]; ok && stored.Email != "" {
+		if m.emailTaken(username, stored.Email) {
+			return database.ErrEmailExists
+		}
+		stored.EmailVerified = true
+	}
+	return nil
+}
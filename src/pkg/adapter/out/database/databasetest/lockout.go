@@ -0,0 +1,50 @@
+package databasetest
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/BieggerM/userservice/pkg/models"
+)
+
+func (m *Memory) GetLoginState(username string) (models.LoginState, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stored, ok := m.users[username]
+	if !ok {
+		return models.LoginState{}, sql.ErrNoRows
+	}
+	return stored.state, nil
+}
+
+func (m *Memory) RecordFailedLogin(username string) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stored, ok := m.users[username]
+	if !ok {
+		return 0, sql.ErrNoRows
+	}
+	stored.state.FailedLogins++
+	return stored.state.FailedLogins, nil
+}
+
+func (m *Memory) LockUser(username string, until time.Time, resetFailedLogins bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if stored, ok := m.users[username]; ok {
+		stored.state.LockedUntil = until
+		if resetFailedLogins {
+			stored.state.FailedLogins = 0
+		}
+	}
+	return nil
+}
+
+func (m *Memory) ResetLoginState(username string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if stored, ok := m.users[username]; ok {
+		stored.state = models.LoginState{}
+	}
+	return nil
+}
@@ -0,0 +1,188 @@
+// Package databasetest provides an in-memory implementation of the database for tests
+package databasetest
+
+import (
+	"database/sql"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/BieggerM/userservice/pkg/adapter/out/database"
+	"github.com/BieggerM/userservice/pkg/models"
+)
+
+type user struct {
+	models.User
+	state models.LoginState
+}
+
+// Memory keeps all data in maps and behaves like the PostgreSQL implementation,
+// including the expiry checks done by its queries and the deletion of all data of removed users.
+// Like there, the storage of every feature lives in a file of its own. It is safe for concurrent use.
+type Memory struct {
+	// Now is the clock of the database, time.Now if unset. Tests move it forward to expire tokens.
+	Now func() time.Time
+
+	mu                   sync.Mutex
+	users                map[string]*user
+	refreshTokens        map[string]*models.RefreshToken
+	revokedTokens        map[string]models.RevokedToken
+	userTokenRevocations map[string]time.Time
+	oneTimeTokens        map[string]*oneTimeToken
+	totpSecrets          map[string]*totpSecret
+	apiKeys              map[string]*models.APIKey
+	sessions             map[string]*models.Session
+	sessionRevocations   map[string]time.Time
+	oauthClients         map[string]models.OAuthClient
+	auditEvents          []models.AuditEvent
+	apiKeyTouches        int
+	sessionTouches       int
+}
+
+// NewMemory returns an empty database
+func NewMemory() *Memory {
+	return &Memory{
+		users:                map[string]*user{},
+		refreshTokens:        map[string]*models.RefreshToken{},
+		revokedTokens:        map[string]models.RevokedToken{},
+		userTokenRevocations: map[string]time.Time{},
+		oneTimeTokens:        map[string]*oneTimeToken{},
+		totpSecrets:          map[string]*totpSecret{},
+		apiKeys:              map[string]*models.APIKey{},
+		sessions:             map[string]*models.Session{},
+		sessionRevocations:   map[string]time.Time{},
+		oauthClients:         map[string]models.OAuthClient{},
+	}
+}
+
+var _ database.Database = (*Memory)(nil)
+
+func (m *Memory) now() time.Time {
+	if m.Now != nil {
+		return m.Now()
+	}
+	return time.Now()
+}
+
+func (m *Memory) Connect(dbHost, dbPort, dbUser, dbPassword, dbName string) error {
+	return nil
+}
+
+func (m *Memory) RunMigrations(migrationPath string) error {
+	return nil
+}
+
+func (m *Memory) Close() error {
+	return nil
+}
+
+func (m *Memory) SaveUser(u models.User) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.users[u.Username]; ok {
+		return errors.New("user already exists")
+	}
+	if m.emailTaken(u.Username, u.Email) {
+		return database.ErrEmailExists
+	}
+	if u.Roles == nil {
+		u.Roles = []string{"user"}
+	}
+	if u.Source == "" {
+		u.Source = "local"
+	}
+	u.Roles = append([]string(nil), u.Roles...)
+	u.EmailVerified = false
+	m.users[u.Username] = &user{User: u}
+	return nil
+}
+
+// DeleteUser removes a user with everything that references it
+func (m *Memory) DeleteUser(username string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.users, username)
+	delete(m.totpSecrets, username)
+	for hash, token := range m.refreshTokens {
+		if token.Username == username {
+			delete(m.refreshTokens, hash)
+		}
+	}
+	for hash, token := range m.oneTimeTokens {
+		if token.Username == username {
+			delete(m.oneTimeTokens, hash)
+		}
+	}
+	for id, key := range m.apiKeys {
+		if key.Username == username {
+			delete(m.apiKeys, id)
+		}
+	}
+	for id, session := range m.sessions {
+		if session.Username == username {
+			delete(m.sessions, id)
+		}
+	}
+}
+
+func (m *Memory) UpdateUser(u models.User) (models.User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stored, ok := m.users[u.Username]
+	if !ok {
+		return u, errors.New("user does not exist")
+	}
+	stored.FirstName = u.FirstName
+	stored.LastName = u.LastName
+	return u, nil
+}
+
+func (m *Memory) UpdatePassword(username, password string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stored, ok := m.users[username]
+	if !ok {
+		return errors.New("user does not exist")
+	}
+	stored.Password = password
+	return nil
+}
+
+func (m *Memory) UpdateRoles(username string, roles []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if stored, ok := m.users[username]; ok {
+		stored.Roles = append([]string(nil), roles...)
+	}
+	return nil
+}
+
+func (m *Memory) GetUser(username string) (models.User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stored, ok := m.users[username]
+	if !ok {
+		return models.User{}, sql.ErrNoRows
+	}
+	return copyUser(stored.User), nil
+}
+
+// ListUsers lists all users ordered by username, without their passwords like the PostgreSQL implementation
+func (m *Memory) ListUsers() []models.User {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var users []models.User
+	for _, stored := range m.users {
+		u := copyUser(stored.User)
+		u.Password = ""
+		users = append(users, u)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Username < users[j].Username })
+	return users
+}
+
+func copyUser(u models.User) models.User {
+	u.Roles = append([]string(nil), u.Roles...)
+	return u
+}
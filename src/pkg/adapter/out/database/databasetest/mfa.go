@@ -0,0 +1,84 @@
+package databasetest
+
+import (
+	"database/sql"
+
+	"github.com/BieggerM/userservice/pkg/models"
+)
+
+type totpSecret struct {
+	models.TOTPSecret
+	recoveryCodes map[string]bool
+}
+
+func (m *Memory) SaveTOTPSecret(secret models.TOTPSecret) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	secret.Confirmed = false
+	secret.LastCounter = 0
+	if stored, ok := m.totpSecrets[secret.Username]; ok {
+		stored.TOTPSecret = secret
+		return nil
+	}
+	m.totpSecrets[secret.Username] = &totpSecret{TOTPSecret: secret, recoveryCodes: map[string]bool{}}
+	return nil
+}
+
+func (m *Memory) GetTOTPSecret(username string) (models.TOTPSecret, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stored, ok := m.totpSecrets[username]
+	if !ok {
+		return models.TOTPSecret{}, sql.ErrNoRows
+	}
+	return stored.TOTPSecret, nil
+}
+
+func (m *Memory) ConfirmTOTPSecret(username string, counter int64, recoveryCodeHashes []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stored, ok := m.totpSecrets[username]
+	if !ok {
+		return nil
+	}
+	stored.Confirmed = true
+	stored.LastCounter = counter
+	stored.recoveryCodes = map[string]bool{}
+	for _, hash := range recoveryCodeHashes {
+		stored.recoveryCodes[hash] = false
+	}
+	return nil
+}
+
+func (m *Memory) UseTOTPCounter(username string, counter int64) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stored, ok := m.totpSecrets[username]
+	if !ok || !stored.Confirmed || stored.LastCounter >= counter {
+		return false, nil
+	}
+	stored.LastCounter = counter
+	return true, nil
+}
+
+func (m *Memory) UseRecoveryCode(username, codeHash string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stored, ok := m.totpSecrets[username]
+	if !ok {
+		return false, nil
+	}
+	used, exists := stored.recoveryCodes[codeHash]
+	if !exists || used {
+		return false, nil
+	}
+	stored.recoveryCodes[codeHash] = true
+	return true, nil
+}
+
+func (m *Memory) DeleteMFA(username string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.totpSecrets, username)
+	return nil
+}
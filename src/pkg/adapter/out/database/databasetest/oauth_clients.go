@@ -0,0 +1,25 @@
+package databasetest
+
+import (
+	"errors"
+
+	"github.com/BieggerM/userservice/pkg/models"
+)
+
+func (m *Memory) SaveOAuthClient(client models.OAuthClient) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	client.CreatedAt = m.now()
+	m.oauthClients[client.ClientID] = client
+	return nil
+}
+
+func (m *Memory) GetOAuthClient(clientID string) (models.OAuthClient, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	client, ok := m.oauthClients[clientID]
+	if !ok {
+		return client, errors.New("oauth client does not exist")
+	}
+	return client, nil
+}
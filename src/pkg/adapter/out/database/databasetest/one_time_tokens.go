@@ -0,0 +1,88 @@
+package databasetest
+
+import (
+	"errors"
+
+	"github.com/BieggerM/userservice/pkg/models"
+)
+
+type oneTimeToken struct {
+	models.OneTimeToken
+	used bool
+}
+
+func (m *Memory) SaveOneTimeToken(token models.OneTimeToken) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.oneTimeTokens[token.TokenHash]; ok {
+		return errors.New("one-time token already exists")
+	}
+	token.CreatedAt = m.now()
+	m.oneTimeTokens[token.TokenHash] = &oneTimeToken{OneTimeToken: token}
+	return nil
+}
+
+// usableToken returns an unused, unexpired token of the given purpose
+func (m *Memory) usableToken(tokenHash, purpose string) (*oneTimeToken, error) {
+	token, ok := m.oneTimeTokens[tokenHash]
+	if !ok || token.Purpose != purpose || token.used || !token.ExpiresAt.After(m.now()) {
+		return nil, errors.New("one-time token does not exist or was already used")
+	}
+	return token, nil
+}
+
+func (m *Memory) GetOneTimeToken(tokenHash, purpose string) (models.OneTimeToken, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	token, err := m.usableToken(tokenHash, purpose)
+	if err != nil {
+		return models.OneTimeToken{}, err
+	}
+	return token.OneTimeToken, nil
+}
+
+func (m *Memory) ConsumeOneTimeToken(tokenHash, purpose string) (models.OneTimeToken, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	token, err := m.usableToken(tokenHash, purpose)
+	if err != nil {
+		return models.OneTimeToken{}, err
+	}
+	token.used = true
+	return token.OneTimeToken, nil
+}
+
+func (m *Memory) InvalidateOneTimeTokens(username, purpose string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, token := range m.oneTimeTokens {
+		if token.Username == username && token.Purpose == purpose {
+			token.used = true
+		}
+	}
+	return nil
+}
+
+func (m *Memory) DeleteExpiredOneTimeTokens() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for hash, token := range m.oneTimeTokens {
+		if token.ExpiresAt.Before(m.now()) {
+			delete(m.oneTimeTokens, hash)
+		}
+	}
+	return nil
+}
+
+// OneTimeTokens returns all stored one-time tokens of a user, used or not
+func (m *Memory) OneTimeTokens(username string) []models.OneTimeToken {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var tokens []models.OneTimeToken
+	for _, token := range m.oneTimeTokens {
+		if token.Username == username {
+			tokens = append(tokens, token.OneTimeToken)
+		}
+	}
+	return tokens
+}
@@ -0,0 +1,47 @@
+package databasetest
+
+import (
+	"errors"
+
+	"github.com/BieggerM/userservice/pkg/models"
+)
+
+func (m *Memory) SaveRefreshToken(token models.RefreshToken) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	token.CreatedAt = m.now()
+	m.refreshTokens[token.TokenHash] = &token
+	return nil
+}
+
+func (m *Memory) GetRefreshToken(tokenHash string) (models.RefreshToken, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	token, ok := m.refreshTokens[tokenHash]
+	if !ok {
+		return models.RefreshToken{}, errors.New("refresh token does not exist")
+	}
+	return *token, nil
+}
+
+func (m *Memory) MarkRefreshTokenUsed(tokenHash string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	token, ok := m.refreshTokens[tokenHash]
+	if !ok || token.Used || token.Revoked {
+		return false, nil
+	}
+	token.Used = true
+	return true, nil
+}
+
+func (m *Memory) RevokeRefreshTokenFamily(familyID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, token := range m.refreshTokens {
+		if token.FamilyID == familyID {
+			token.Revoked = true
+		}
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package databasetest
+
+import (
+	"time"
+
+	"github.com/BieggerM/userservice/pkg/models"
+)
+
+func (m *Memory) RevokeToken(token models.RevokedToken) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.revokedTokens[token.JTI]; !ok {
+		m.revokedTokens[token.JTI] = token
+	}
+	return nil
+}
+
+func (m *Memory) ListRevokedTokens() ([]models.RevokedToken, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var tokens []models.RevokedToken
+	for _, token := range m.revokedTokens {
+		if token.ExpiresAt.After(m.now()) {
+			tokens = append(tokens, token)
+		}
+	}
+	return tokens, nil
+}
+
+func (m *Memory) DeleteExpiredRevokedTokens() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for jti, token := range m.revokedTokens {
+		if !token.ExpiresAt.After(m.now()) {
+			delete(m.revokedTokens, jti)
+		}
+	}
+	return nil
+}
+
+func (m *Memory) RevokeUserTokens(username string, revokedAt time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.userTokenRevocations[username] = revokedAt
+	for _, token := range m.refreshTokens {
+		if token.Username == username {
+			token.Revoked = true
+		}
+	}
+	for _, session := range m.sessions {
+		if session.Username == username && !session.Revoked {
+			session.Revoked = true
+			m.sessionRevocations[session.ID] = revokedAt
+		}
+	}
+	return nil
+}
+
+func (m *Memory) ListUserTokenRevocations() (map[string]time.Time, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	revocations := make(map[string]time.Time)
+	for username, revokedAt := range m.userTokenRevocations {
+		revocations[username] = revokedAt
+	}
+	return revocations, nil
+}
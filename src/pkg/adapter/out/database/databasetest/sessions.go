@@ -0,0 +1,97 @@
+package databasetest
+
+import (
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/BieggerM/userservice/pkg/models"
+)
+
+func (m *Memory) SaveSession(session models.Session) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	session.CreatedAt = m.now()
+	session.LastUsedAt = session.CreatedAt
+	m.sessions[session.ID] = &session
+	return nil
+}
+
+func (m *Memory) GetSession(id string) (models.Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	session, ok := m.sessions[id]
+	if !ok {
+		return models.Session{}, errors.New("session does not exist")
+	}
+	return *session, nil
+}
+
+func (m *Memory) ListSessions(username string) ([]models.Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var sessions []models.Session
+	for _, session := range m.sessions {
+		if session.Username == username && !session.Revoked && session.ExpiresAt.After(m.now()) {
+			sessions = append(sessions, *session)
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].LastUsedAt.After(sessions[j].LastUsedAt) })
+	return sessions, nil
+}
+
+func (m *Memory) RefreshSession(id, ip, userAgent string, expiresAt time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if session, ok := m.sessions[id]; ok {
+		session.LastUsedAt = m.now()
+		session.IP = ip
+		session.UserAgent = userAgent
+		session.ExpiresAt = expiresAt
+	}
+	return nil
+}
+
+func (m *Memory) TouchSession(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sessionTouches++
+	if session, ok := m.sessions[id]; ok {
+		session.LastUsedAt = m.now()
+	}
+	return nil
+}
+
+// SessionTouches returns how often the use of a session was recorded
+func (m *Memory) SessionTouches() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.sessionTouches
+}
+
+func (m *Memory) RevokeSession(id string, revokedAt time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if session, ok := m.sessions[id]; ok && !session.Revoked {
+		session.Revoked = true
+		m.sessionRevocations[id] = revokedAt
+	}
+	for _, token := range m.refreshTokens {
+		if token.FamilyID == id {
+			token.Revoked = true
+		}
+	}
+	return nil
+}
+
+func (m *Memory) ListRevokedSessions(since time.Time) (map[string]time.Time, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	revocations := make(map[string]time.Time)
+	for id, revokedAt := range m.sessionRevocations {
+		if revokedAt.After(since) {
+			revocations[id] = revokedAt
+		}
+	}
+	return revocations, nil
+}
@@ -0,0 +1,66 @@
+package database
+
+import (
+	"errors"
+	"github.com/BieggerM/userservice/pkg/models"
+	"github.com/lib/pq"
+)
+
+// GetUserByEmail gets the user holding a verified email address from the PostgreSQL database, ignoring case.
+// Unverified addresses are not unique and never match.
+func (p *Postgres) GetUserByEmail(email string) (models.User, error) {
+	user := models.User{}
+	err := p.DB.QueryRow("select username, firstname, lastname, password, roles, email, email_verified, source from users where lower(email) = lower($1) and email_verified", email).
+		Scan(&user.Username, &user.FirstName, &user.LastName, &user.Password, pq.Array(&user.Roles), &user.Email, &user.EmailVerified, &user.Source)
+	return user, err
+}
+
+// SetEmail changes the email address of a user, the new address is unverified.
+// Addresses verified by another user are rejected, unverified ones may be claimed by several users.
+func (p *Postgres) SetEmail(username, email string) error {
+	taken, err := p.emailVerifiedByOther(username, email)
+	if err != nil {
+		return err
+	}
+	if taken {
+		return ErrEmailExists
+	}
+	res, err := p.DB.Exec("update users set email = nullif($1, ''), email_verified = false where username = $2", email, username)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return errors.New("user does not exist")
+	}
+	return nil
+}
+
+// MarkEmailVerified marks the current email address of a user as verified.
+// Only one user can hold a verified address, the first to verify it.
+func (p *Postgres) MarkEmailVerified(username string) error {
+	_, err := p.DB.Exec("update users set email_verified = true where username = $1 and email is not null", username)
+	if isUniqueViolation(err, "users_email_idx") {
+		return ErrEmailExists
+	}
+	return err
+}
+
+// emailVerifiedByOther reports whether another user holds the address verified
+func (p *Postgres) emailVerifiedByOther(username, email string) (bool, error) {
+	if email == "" {
+		return false, nil
+	}
+	var taken bool
+	err := p.DB.QueryRow("select exists(select 1 from users where lower(email) = lower($1) and email_verified and username <> $2)", email, username).Scan(&taken)
+	return taken, err
+}
+
+// isUniqueViolation reports whether err is a violation of the named unique constraint or index
+func isUniqueViolation(err error, constraint string) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23505" && pqErr.Constraint == constraint
+}
@@ -0,0 +1,39 @@
+package database
+
+import (
+	"database/sql"
+	"github.com/BieggerM/userservice/pkg/models"
+	"time"
+)
+
+// GetLoginState gets the failed login attempts of a user from the PostgreSQL database
+func (p *Postgres) GetLoginState(username string) (models.LoginState, error) {
+	state := models.LoginState{}
+	var lockedUntil sql.NullTime
+	err := p.DB.QueryRow("select failed_logins, locked_until from users where username = $1", username).Scan(&state.FailedLogins, &lockedUntil)
+	state.LockedUntil = lockedUntil.Time
+	return state, err
+}
+
+// RecordFailedLogin increments the failed login counter of a user and returns the new count
+func (p *Postgres) RecordFailedLogin(username string) (int, error) {
+	var failedLogins int
+	err := p.DB.QueryRow("update users set failed_logins = failed_logins + 1 where username = $1 returning failed_logins", username).Scan(&failedLogins)
+	return failedLogins, err
+}
+
+// LockUser blocks logins of a user until the given time
+func (p *Postgres) LockUser(username string, until time.Time, resetFailedLogins bool) error {
+	query := "update users set locked_until = $1 where username = $2"
+	if resetFailedLogins {
+		query = "update users set locked_until = $1, failed_logins = 0 where username = $2"
+	}
+	_, err := p.DB.Exec(query, until, username)
+	return err
+}
+
+// ResetLoginState clears failed login attempts and any lockout of a user
+func (p *Postgres) ResetLoginState(username string) error {
+	_, err := p.DB.Exec("update users set failed_logins = 0, locked_until = null where username = $1", username)
+	return err
+}
@@ -0,0 +1,84 @@
+package database
+
+import (
+	"github.com/BieggerM/userservice/pkg/models"
+)
+
+// SaveTOTPSecret stores a new unconfirmed TOTP secret for a user, replacing a previous one
+func (p *Postgres) SaveTOTPSecret(secret models.TOTPSecret) error {
+	_, err := p.DB.Exec("insert into totp_secrets (username, secret) values ($1, $2) on conflict (username) do update set secret = excluded.secret, confirmed = false, last_counter = 0, created_at = now()",
+		secret.Username, secret.Secret)
+	return err
+}
+
+// GetTOTPSecret gets the TOTP secret of a user from the PostgreSQL database
+func (p *Postgres) GetTOTPSecret(username string) (models.TOTPSecret, error) {
+	secret := models.TOTPSecret{}
+	err := p.DB.QueryRow("select username, secret, confirmed, last_counter from totp_secrets where username = $1", username).
+		Scan(&secret.Username, &secret.Secret, &secret.Confirmed, &secret.LastCounter)
+	return secret, err
+}
+
+// ConfirmTOTPSecret enables the TOTP secret of a user as second factor and replaces the recovery codes
+func (p *Postgres) ConfirmTOTPSecret(username string, counter int64, recoveryCodeHashes []string) error {
+	tx, err := p.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("update totp_secrets set confirmed = true, last_counter = $1 where username = $2", counter, username); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("delete from recovery_codes where username = $1", username); err != nil {
+		return err
+	}
+	for _, hash := range recoveryCodeHashes {
+		if _, err := tx.Exec("insert into recovery_codes (username, code_hash) values ($1, $2)", username, hash); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// UseTOTPCounter records the time step of an accepted code.
+// It reports false if a code of the same or a later time step was accepted before.
+func (p *Postgres) UseTOTPCounter(username string, counter int64) (bool, error) {
+	res, err := p.DB.Exec("update totp_secrets set last_counter = $1 where username = $2 and confirmed and last_counter < $1", counter, username)
+	if err != nil {
+		return false, err
+	}
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return rowsAffected == 1, nil
+}
+
+// UseRecoveryCode marks an unused recovery code as used and reports whether it was valid
+func (p *Postgres) UseRecoveryCode(username, codeHash string) (bool, error) {
+	res, err := p.DB.Exec("update recovery_codes set used_at = now() where username = $1 and code_hash = $2 and used_at is null", username, codeHash)
+	if err != nil {
+		return false, err
+	}
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return rowsAffected == 1, nil
+}
+
+// DeleteMFA removes the TOTP secret and recovery codes of a user
+func (p *Postgres) DeleteMFA(username string) error {
+	tx, err := p.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("delete from totp_secrets where username = $1", username); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("delete from recovery_codes where username = $1", username); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,26 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"github.com/BieggerM/userservice/pkg/models"
+	"github.com/lib/pq"
+)
+
+// SaveOAuthClient saves an OAuth2 client to the PostgreSQL database
+func (p *Postgres) SaveOAuthClient(client models.OAuthClient) error {
+	_, err := p.DB.Exec("insert into oauth_clients (client_id, name, secret_hash, scopes, audiences, grant_types) values ($1, $2, $3, $4, $5, $6)",
+		client.ClientID, client.Name, client.SecretHash, pq.Array(client.Scopes), pq.Array(client.Audiences), pq.Array(client.GrantTypes))
+	return err
+}
+
+// GetOAuthClient gets an OAuth2 client by its id from the PostgreSQL database
+func (p *Postgres) GetOAuthClient(clientID string) (models.OAuthClient, error) {
+	client := models.OAuthClient{}
+	err := p.DB.QueryRow("select client_id, name, secret_hash, scopes, audiences, grant_types, created_at from oauth_clients where client_id = $1", clientID).
+		Scan(&client.ClientID, &client.Name, &client.SecretHash, pq.Array(&client.Scopes), pq.Array(&client.Audiences), pq.Array(&client.GrantTypes), &client.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return client, errors.New("oauth client does not exist")
+	}
+	return client, err
+}
@@ -0,0 +1,49 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"github.com/BieggerM/userservice/pkg/models"
+)
+
+// SaveOneTimeToken saves a one-time token to the PostgreSQL database
+func (p *Postgres) SaveOneTimeToken(token models.OneTimeToken) error {
+	_, err := p.DB.Exec("insert into one_time_tokens (token_hash, purpose, username, expires_at) values ($1, $2, $3, $4)",
+		token.TokenHash, token.Purpose, token.Username, token.ExpiresAt)
+	return err
+}
+
+// GetOneTimeToken gets an unused, unexpired token of the given purpose without consuming it
+func (p *Postgres) GetOneTimeToken(tokenHash, purpose string) (models.OneTimeToken, error) {
+	token := models.OneTimeToken{}
+	err := p.DB.QueryRow("select token_hash, purpose, username, created_at, expires_at from one_time_tokens where token_hash = $1 and purpose = $2 and used_at is null and expires_at > now()", tokenHash, purpose).
+		Scan(&token.TokenHash, &token.Purpose, &token.Username, &token.CreatedAt, &token.ExpiresAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return token, errors.New("one-time token does not exist or was already used")
+	}
+	return token, err
+}
+
+// ConsumeOneTimeToken marks an unused, unexpired token of the given purpose as used and returns it.
+// Marking the token and checking it happens in one statement, so a token can only be consumed once.
+func (p *Postgres) ConsumeOneTimeToken(tokenHash, purpose string) (models.OneTimeToken, error) {
+	token := models.OneTimeToken{}
+	err := p.DB.QueryRow("update one_time_tokens set used_at = now() where token_hash = $1 and purpose = $2 and used_at is null and expires_at > now() returning token_hash, purpose, username, created_at, expires_at", tokenHash, purpose).
+		Scan(&token.TokenHash, &token.Purpose, &token.Username, &token.CreatedAt, &token.ExpiresAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return token, errors.New("one-time token does not exist or was already used")
+	}
+	return token, err
+}
+
+// InvalidateOneTimeTokens marks all outstanding tokens of a user for the given purpose as used
+func (p *Postgres) InvalidateOneTimeTokens(username, purpose string) error {
+	_, err := p.DB.Exec("update one_time_tokens set used_at = now() where username = $1 and purpose = $2 and used_at is null", username, purpose)
+	return err
+}
+
+// DeleteExpiredOneTimeTokens removes tokens that can no longer be used
+func (p *Postgres) DeleteExpiredOneTimeTokens() error {
+	_, err := p.DB.Exec("delete from one_time_tokens where expires_at < now()")
+	return err
+}
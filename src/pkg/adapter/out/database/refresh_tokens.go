@@ -0,0 +1,47 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"github.com/BieggerM/userservice/pkg/models"
+)
+
+// SaveRefreshToken saves a refresh token to the PostgreSQL database
+func (p *Postgres) SaveRefreshToken(token models.RefreshToken) error {
+	_, err := p.DB.Exec("insert into refresh_tokens (token_hash, family_id, username, audience, client_id, scope, expires_at) values ($1, $2, $3, $4, $5, $6, $7)",
+		token.TokenHash, token.FamilyID, token.Username, token.Audience, token.ClientID, token.Scope, token.ExpiresAt)
+	return err
+}
+
+// GetRefreshToken gets a refresh token by its hash from the PostgreSQL database
+func (p *Postgres) GetRefreshToken(tokenHash string) (models.RefreshToken, error) {
+	token := models.RefreshToken{}
+	var usedAt sql.NullTime
+	err := p.DB.QueryRow("select token_hash, family_id, username, audience, client_id, scope, created_at, expires_at, used_at, revoked from refresh_tokens where token_hash = $1", tokenHash).
+		Scan(&token.TokenHash, &token.FamilyID, &token.Username, &token.Audience, &token.ClientID, &token.Scope, &token.CreatedAt, &token.ExpiresAt, &usedAt, &token.Revoked)
+	if errors.Is(err, sql.ErrNoRows) {
+		return token, errors.New("refresh token does not exist")
+	}
+	token.Used = usedAt.Valid
+	return token, err
+}
+
+// MarkRefreshTokenUsed marks an unused refresh token as used.
+// It reports false if the token was already used or revoked in the meantime.
+func (p *Postgres) MarkRefreshTokenUsed(tokenHash string) (bool, error) {
+	res, err := p.DB.Exec("update refresh_tokens set used_at = now() where token_hash = $1 and used_at is null and not revoked", tokenHash)
+	if err != nil {
+		return false, err
+	}
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return rowsAffected == 1, nil
+}
+
+// RevokeRefreshTokenFamily revokes all refresh tokens of a family
+func (p *Postgres) RevokeRefreshTokenFamily(familyID string) error {
+	_, err := p.DB.Exec("update refresh_tokens set revoked = true where family_id = $1", familyID)
+	return err
+}
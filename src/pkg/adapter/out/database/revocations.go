@@ -0,0 +1,71 @@
+package database
+
+import (
+	"github.com/BieggerM/userservice/pkg/models"
+	"time"
+)
+
+// RevokeToken adds an access token to the denylist in the PostgreSQL database
+func (p *Postgres) RevokeToken(token models.RevokedToken) error {
+	_, err := p.DB.Exec("insert into revoked_tokens (jti, username, expires_at) values ($1, $2, $3) on conflict (jti) do nothing",
+		token.JTI, token.Username, token.ExpiresAt)
+	return err
+}
+
+// ListRevokedTokens lists all revoked access tokens that have not expired yet
+func (p *Postgres) ListRevokedTokens() ([]models.RevokedToken, error) {
+	rows, err := p.DB.Query("select jti, username, expires_at from revoked_tokens where expires_at > now()")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var tokens []models.RevokedToken
+	for rows.Next() {
+		token := models.RevokedToken{}
+		if err := rows.Scan(&token.JTI, &token.Username, &token.ExpiresAt); err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, token)
+	}
+	return tokens, rows.Err()
+}
+
+// DeleteExpiredRevokedTokens removes denylist entries of tokens that expired anyway
+func (p *Postgres) DeleteExpiredRevokedTokens() error {
+	_, err := p.DB.Exec("delete from revoked_tokens where expires_at <= now()")
+	return err
+}
+
+// RevokeUserTokens revokes all tokens of a user issued up to revokedAt
+func (p *Postgres) RevokeUserTokens(username string, revokedAt time.Time) error {
+	_, err := p.DB.Exec("insert into user_token_revocations (username, revoked_at) values ($1, $2) on conflict (username) do update set revoked_at = excluded.revoked_at",
+		username, revokedAt)
+	if err != nil {
+		return err
+	}
+	_, err = p.DB.Exec("update refresh_tokens set revoked = true where username = $1", username)
+	if err != nil {
+		return err
+	}
+	_, err = p.DB.Exec("update sessions set revoked_at = $1 where username = $2 and revoked_at is null", revokedAt, username)
+	return err
+}
+
+// ListUserTokenRevocations returns the time up to which the tokens of each user are revoked
+func (p *Postgres) ListUserTokenRevocations() (map[string]time.Time, error) {
+	rows, err := p.DB.Query("select username, revoked_at from user_token_revocations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	revocations := make(map[string]time.Time)
+	for rows.Next() {
+		var username string
+		var revokedAt time.Time
+		if err := rows.Scan(&username, &revokedAt); err != nil {
+			return nil, err
+		}
+		revocations[username] = revokedAt
+	}
+	return revocations, rows.Err()
+}
@@ -0,0 +1,93 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"github.com/BieggerM/userservice/pkg/models"
+	"time"
+)
+
+// SaveSession saves a new session to the PostgreSQL database
+func (p *Postgres) SaveSession(session models.Session) error {
+	_, err := p.DB.Exec("insert into sessions (id, username, audience, ip, user_agent, expires_at) values ($1, $2, $3, $4, $5, $6)",
+		session.ID, session.Username, session.Audience, session.IP, session.UserAgent, session.ExpiresAt)
+	return err
+}
+
+// GetSession gets a session by its id from the PostgreSQL database
+func (p *Postgres) GetSession(id string) (models.Session, error) {
+	session := models.Session{}
+	var revokedAt sql.NullTime
+	err := p.DB.QueryRow("select id, username, audience, ip, user_agent, created_at, last_used_at, expires_at, revoked_at from sessions where id = $1", id).
+		Scan(&session.ID, &session.Username, &session.Audience, &session.IP, &session.UserAgent, &session.CreatedAt, &session.LastUsedAt, &session.ExpiresAt, &revokedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return session, errors.New("session does not exist")
+	}
+	session.Revoked = revokedAt.Valid
+	return session, err
+}
+
+// ListSessions lists the active sessions of a user from the PostgreSQL database
+func (p *Postgres) ListSessions(username string) ([]models.Session, error) {
+	rows, err := p.DB.Query("select id, username, audience, ip, user_agent, created_at, last_used_at, expires_at from sessions where username = $1 and revoked_at is null and expires_at > now() order by last_used_at desc", username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var sessions []models.Session
+	for rows.Next() {
+		session := models.Session{}
+		if err := rows.Scan(&session.ID, &session.Username, &session.Audience, &session.IP, &session.UserAgent, &session.CreatedAt, &session.LastUsedAt, &session.ExpiresAt); err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, rows.Err()
+}
+
+// RefreshSession records a refresh of the session from the given client and extends its lifetime
+func (p *Postgres) RefreshSession(id, ip, userAgent string, expiresAt time.Time) error {
+	_, err := p.DB.Exec("update sessions set last_used_at = now(), ip = $1, user_agent = $2, expires_at = $3 where id = $4", ip, userAgent, expiresAt, id)
+	return err
+}
+
+// TouchSession records the use of an access token of the session, at most once per minute to limit writes
+func (p *Postgres) TouchSession(id string) error {
+	_, err := p.DB.Exec("update sessions set last_used_at = now() where id = $1 and last_used_at < now() - interval '1 minute'", id)
+	return err
+}
+
+// RevokeSession revokes a session and all of its refresh tokens
+func (p *Postgres) RevokeSession(id string, revokedAt time.Time) error {
+	tx, err := p.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("update sessions set revoked_at = $1 where id = $2 and revoked_at is null", revokedAt, id); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("update refresh_tokens set revoked = true where family_id = $1", id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ListRevokedSessions returns the sessions revoked after since with the time of revocation
+func (p *Postgres) ListRevokedSessions(since time.Time) (map[string]time.Time, error) {
+	rows, err := p.DB.Query("select id, revoked_at from sessions where revoked_at > $1", since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	revocations := make(map[string]time.Time)
+	for rows.Next() {
+		var id string
+		var revokedAt time.Time
+		if err := rows.Scan(&id, &revokedAt); err != nil {
+			return nil, err
+		}
+		revocations[id] = revokedAt
+	}
+	return revocations, rows.Err()
+}
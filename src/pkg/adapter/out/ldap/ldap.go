@@ -0,0 +1,175 @@
+// Package ldap connects to LDAP directories for simple binds and searches, built on github.com/go-ldap/ldap/v3
+package ldap
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	goldap "github.com/go-ldap/ldap/v3"
+)
+
+var (
+	// ErrInvalidCredentials is returned by Bind for a wrong DN or password
+	ErrInvalidCredentials = errors.New("ldap: invalid credentials")
+	// ErrEmptyPassword is returned by Bind instead of performing an unauthenticated bind (RFC 4513 section 5.1.2)
+	ErrEmptyPassword = errors.New("ldap: empty password")
+	// ErrUnavailable wraps failures to reach the server: connection errors, timeouts, failed TLS
+	// handshakes and servers answering busy or unavailable
+	ErrUnavailable = errors.New("ldap: server unavailable")
+)
+
+// Entry is an entry returned by a search
+type Entry struct {
+	DN         string
+	Attributes map[string][]string
+}
+
+// Get returns the first value of an attribute, attribute names are case insensitive
+func (e Entry) Get(attribute string) string {
+	if values := e.Values(attribute); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// Values returns all values of an attribute
+func (e Entry) Values(attribute string) []string {
+	for name, values := range e.Attributes {
+		if strings.EqualFold(name, attribute) {
+			return values
+		}
+	}
+	return nil
+}
+
+// SearchRequest describes a subtree search
+type SearchRequest struct {
+	BaseDN     string
+	Filter     string
+	Attributes []string
+	SizeLimit  int
+}
+
+// Options controls how Dial secures the connection
+type Options struct {
+	// Timeout bounds connecting and every operation
+	Timeout time.Duration
+	// StartTLS upgrades an ldap:// connection to TLS before anything else is sent (RFC 4513 section 3)
+	StartTLS bool
+	// TLSConfig verifies the server certificate of ldaps:// and StartTLS connections, the system roots if nil
+	TLSConfig *tls.Config
+}
+
+// Client is a connection to an LDAP server. A client is not safe for concurrent use.
+type Client struct {
+	conn    *goldap.Conn
+	timeout time.Duration
+}
+
+// Dial connects to an ldap:// or ldaps:// URL
+func Dial(rawURL string, options Options) (*Client, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("ldap: invalid url: %w", err)
+	}
+	if u.Scheme != "ldap" && u.Scheme != "ldaps" {
+		return nil, fmt.Errorf("ldap: unsupported url scheme %q", u.Scheme)
+	}
+	tlsConfig := &tls.Config{}
+	if options.TLSConfig != nil {
+		tlsConfig = options.TLSConfig.Clone()
+	}
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName = u.Hostname()
+	}
+	conn, err := goldap.DialURL(rawURL,
+		goldap.DialWithDialer(&net.Dialer{Timeout: options.Timeout}),
+		goldap.DialWithTLSConfig(tlsConfig),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrUnavailable, err)
+	}
+	conn.SetTimeout(options.Timeout)
+	if options.StartTLS && u.Scheme == "ldap" {
+		if err := conn.StartTLS(tlsConfig); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("%w: starttls: %v", ErrUnavailable, err)
+		}
+	}
+	return &Client{conn: conn, timeout: options.Timeout}, nil
+}
+
+// Bind authenticates the connection with a simple bind
+func (c *Client) Bind(dn, password string) error {
+	if password == "" {
+		return ErrEmptyPassword
+	}
+	err := c.conn.Bind(dn, password)
+	if goldap.IsErrorWithCode(err, goldap.LDAPResultInvalidCredentials) {
+		return ErrInvalidCredentials
+	}
+	return wrap(err)
+}
+
+// Search returns all entries below the base DN matching the filter, none if the base DN does not exist
+func (c *Client) Search(req SearchRequest) ([]Entry, error) {
+	result, err := c.conn.Search(goldap.NewSearchRequest(
+		req.BaseDN,
+		goldap.ScopeWholeSubtree,
+		goldap.NeverDerefAliases,
+		req.SizeLimit,
+		int(c.timeout.Seconds()),
+		false,
+		req.Filter,
+		req.Attributes,
+		nil,
+	))
+	if goldap.IsErrorWithCode(err, goldap.LDAPResultNoSuchObject) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, wrap(err)
+	}
+	// referrals to other servers are not followed
+	entries := make([]Entry, 0, len(result.Entries))
+	for _, e := range result.Entries {
+		entry := Entry{DN: e.DN, Attributes: map[string][]string{}}
+		for _, attribute := range e.Attributes {
+			entry.Attributes[attribute.Name] = attribute.Values
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// Close sends an unbind request and closes the connection
+func (c *Client) Close() error {
+	return c.conn.Unbind()
+}
+
+// EscapeFilter escapes a value for use in a filter (RFC 4515 section 3)
+func EscapeFilter(value string) string {
+	return goldap.EscapeFilter(value)
+}
+
+// ValidateFilter checks the syntax of a filter (RFC 4515)
+func ValidateFilter(filter string) error {
+	_, err := goldap.CompileFilter(filter)
+	return err
+}
+
+// wrap marks errors of the connection rather than of the request as ErrUnavailable
+func wrap(err error) error {
+	if err == nil {
+		return nil
+	}
+	if goldap.IsErrorAnyOf(err, goldap.ErrorNetwork, goldap.LDAPResultBusy, goldap.LDAPResultUnavailable) {
+		return fmt.Errorf("%w: %v", ErrUnavailable, err)
+	}
+	return fmt.Errorf("ldap: %w", err)
+}
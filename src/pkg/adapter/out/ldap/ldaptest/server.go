@@ -0,0 +1,318 @@
+// Package ldaptest provides an in-process LDAP server for tests, like net/http/httptest does for HTTP
+package ldaptest
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	goldap "github.com/go-ldap/ldap/v3"
+)
+
+// startTLSOID names the StartTLS extended operation (RFC 4511 section 4.14)
+const startTLSOID = "1.3.6.1.4.1.1466.20037"
+
+// Entry is a directory entry, Password is compared on simple binds to its DN
+type Entry struct {
+	DN         string
+	Password   string
+	Attributes map[string][]string
+}
+
+// Server is an LDAP server on a local port. It supports simple binds, StartTLS and subtree
+// searches with and, or, not, equality and presence filters. Like many real servers it
+// accepts binds with an empty password as unauthenticated binds.
+type Server struct {
+	URL      string
+	listener net.Listener
+	tls      *tls.Config
+	cert     *x509.Certificate
+	entries  []Entry
+	wg       sync.WaitGroup
+	mu       sync.Mutex
+	conns    map[net.Conn]struct{}
+}
+
+// NewServer starts an ldap:// server holding the given entries. Clients may upgrade to TLS with StartTLS.
+func NewServer(entries ...Entry) *Server {
+	return start(false, entries)
+}
+
+// NewTLSServer starts an ldaps:// server holding the given entries
+func NewTLSServer(entries ...Entry) *Server {
+	return start(true, entries)
+}
+
+func start(useTLS bool, entries []Entry) *Server {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic("ldaptest: failed to listen: " + err.Error())
+	}
+	config, cert := selfSigned()
+	url := "ldap://" + listener.Addr().String()
+	if useTLS {
+		url = "ldaps://" + listener.Addr().String()
+		listener = tls.NewListener(listener, config)
+	}
+	s := &Server{
+		URL:      url,
+		listener: listener,
+		tls:      config,
+		cert:     cert,
+		entries:  entries,
+		conns:    map[net.Conn]struct{}{},
+	}
+	s.wg.Add(1)
+	go s.serve()
+	return s
+}
+
+// ClientTLSConfig returns a TLS configuration trusting the server certificate
+func (s *Server) ClientTLSConfig() *tls.Config {
+	roots := x509.NewCertPool()
+	roots.AddCert(s.cert)
+	return &tls.Config{RootCAs: roots}
+}
+
+// Close stops the server and closes all open connections
+func (s *Server) Close() {
+	s.listener.Close()
+	s.mu.Lock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.conns[conn] = struct{}{}
+		s.mu.Unlock()
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.handle(conn)
+			s.mu.Lock()
+			delete(s.conns, conn)
+			s.mu.Unlock()
+		}()
+	}
+}
+
+func (s *Server) handle(conn net.Conn) {
+	// conn is replaced by its TLS wrapper after StartTLS
+	defer func() { conn.Close() }()
+	reader := bufio.NewReader(conn)
+	authenticated := false
+	for {
+		message, err := ber.ReadPacket(reader)
+		if err != nil || len(message.Children) < 2 {
+			return
+		}
+		id := integer(message.Children[0])
+		op := message.Children[1]
+		if op.ClassType != ber.ClassApplication {
+			return
+		}
+		switch op.Tag {
+		case goldap.ApplicationBindRequest:
+			dn, password := str(op.Children[1]), str(op.Children[2])
+			code := s.bind(dn, password)
+			authenticated = code == goldap.LDAPResultSuccess && password != ""
+			reply(conn, id, goldap.ApplicationBindResponse, code)
+		case goldap.ApplicationExtendedRequest:
+			if len(op.Children) == 0 || str(op.Children[0]) != startTLSOID {
+				reply(conn, id, goldap.ApplicationExtendedResponse, goldap.LDAPResultProtocolError)
+				continue
+			}
+			reply(conn, id, goldap.ApplicationExtendedResponse, goldap.LDAPResultSuccess)
+			tlsConn := tls.Server(conn, s.tls)
+			if err := tlsConn.Handshake(); err != nil {
+				return
+			}
+			conn, reader = tlsConn, bufio.NewReader(tlsConn)
+		case goldap.ApplicationSearchRequest:
+			if !authenticated {
+				reply(conn, id, goldap.ApplicationSearchResultDone, goldap.LDAPResultInsufficientAccessRights)
+				continue
+			}
+			s.search(conn, id, op)
+		default:
+			// unbind and unsupported operations end the connection
+			return
+		}
+	}
+}
+
+func (s *Server) bind(dn, password string) uint16 {
+	if password == "" {
+		return goldap.LDAPResultSuccess
+	}
+	for _, entry := range s.entries {
+		if strings.EqualFold(entry.DN, dn) && entry.Password != "" && entry.Password == password {
+			return goldap.LDAPResultSuccess
+		}
+	}
+	return goldap.LDAPResultInvalidCredentials
+}
+
+func (s *Server) search(conn net.Conn, id int64, op *ber.Packet) {
+	baseDN := strings.ToLower(str(op.Children[0]))
+	filter := op.Children[6]
+	var requested []string
+	for _, attribute := range op.Children[7].Children {
+		requested = append(requested, str(attribute))
+	}
+	for _, entry := range s.entries {
+		dn := strings.ToLower(entry.DN)
+		if dn != baseDN && !strings.HasSuffix(dn, ","+baseDN) {
+			continue
+		}
+		if !matches(entry, filter) {
+			continue
+		}
+		result := ber.Encode(ber.ClassApplication, ber.TypeConstructed, goldap.ApplicationSearchResultEntry, nil, "Search Result Entry")
+		result.AppendChild(octetString(entry.DN))
+		attributes := ber.NewSequence("Attributes")
+		for name, values := range entry.Attributes {
+			if len(requested) > 0 && !containsFold(requested, name) {
+				continue
+			}
+			attribute := ber.NewSequence("Attribute")
+			attribute.AppendChild(octetString(name))
+			set := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "Values")
+			for _, value := range values {
+				set.AppendChild(octetString(value))
+			}
+			attribute.AppendChild(set)
+			attributes.AppendChild(attribute)
+		}
+		result.AppendChild(attributes)
+		write(conn, id, result)
+	}
+	reply(conn, id, goldap.ApplicationSearchResultDone, goldap.LDAPResultSuccess)
+}
+
+func matches(entry Entry, filter *ber.Packet) bool {
+	if filter.ClassType != ber.ClassContext {
+		return false
+	}
+	switch filter.Tag {
+	case goldap.FilterAnd:
+		for _, child := range filter.Children {
+			if !matches(entry, child) {
+				return false
+			}
+		}
+		return true
+	case goldap.FilterOr:
+		for _, child := range filter.Children {
+			if matches(entry, child) {
+				return true
+			}
+		}
+		return false
+	case goldap.FilterNot:
+		return len(filter.Children) == 1 && !matches(entry, filter.Children[0])
+	case goldap.FilterEqualityMatch:
+		return containsFold(values(entry, str(filter.Children[0])), str(filter.Children[1]))
+	case goldap.FilterPresent:
+		return len(values(entry, str(filter))) > 0
+	}
+	return false
+}
+
+func values(entry Entry, attribute string) []string {
+	for name, values := range entry.Attributes {
+		if strings.EqualFold(name, attribute) {
+			return values
+		}
+	}
+	return nil
+}
+
+func containsFold(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// str returns the content of a primitive element, whatever its class
+func str(p *ber.Packet) string {
+	if p.Data == nil {
+		return ""
+	}
+	return p.Data.String()
+}
+
+func integer(p *ber.Packet) int64 {
+	value, _ := ber.ParseInt64(p.Data.Bytes())
+	return value
+}
+
+func octetString(value string) *ber.Packet {
+	return ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, value, "")
+}
+
+func reply(conn net.Conn, id int64, tag ber.Tag, code uint16) {
+	result := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "Result")
+	result.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, int64(code), "Result Code"))
+	result.AppendChild(octetString(""))
+	result.AppendChild(octetString(""))
+	write(conn, id, result)
+}
+
+func write(conn net.Conn, id int64, op *ber.Packet) {
+	message := ber.NewSequence("LDAP Message")
+	message.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, "Message ID"))
+	message.AppendChild(op)
+	conn.Write(message.Bytes())
+}
+
+// selfSigned creates a certificate for 127.0.0.1, valid for a day
+func selfSigned() (*tls.Config, *x509.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic("ldaptest: failed to generate key: " + err.Error())
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "ldaptest"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		panic("ldaptest: failed to create certificate: " + err.Error())
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		panic("ldaptest: failed to parse certificate: " + err.Error())
+	}
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}, cert
+}
@@ -0,0 +1,18 @@
+package models
+
+import "time"
+
+// APIKey is a long-lived credential of a user or service account, e.g. for batch jobs.
+// The ID is the visible part of the key, only the hash of the secret part is stored.
+type APIKey struct {
+	ID       string
+	Name     string
+	Username string
+	KeyHash  string
+	// Scopes are the roles the key may use, a subset of the roles of its user
+	Scopes     []string
+	CreatedAt  time.Time
+	ExpiresAt  time.Time
+	LastUsedAt time.Time
+	Revoked    bool
+}
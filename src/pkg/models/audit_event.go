@@ -0,0 +1,15 @@
+package models
+
+import "time"
+
+// AuditEvent records a security relevant action of Actor on the account of Target.
+// Events are kept after the accounts involved are deleted.
+type AuditEvent struct {
+	ID        int64
+	Action    string
+	Actor     string
+	Target    string
+	Details   string
+	IP        string
+	CreatedAt time.Time
+}
@@ -0,0 +1,9 @@
+package models
+
+import "time"
+
+// LoginState tracks failed login attempts of an account
+type LoginState struct {
+	FailedLogins int
+	LockedUntil  time.Time
+}
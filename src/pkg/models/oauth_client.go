@@ -0,0 +1,16 @@
+package models
+
+import "time"
+
+// OAuthClient is an application registered to request tokens at the OAuth2 token endpoint.
+// Only the hash of the client secret is stored.
+type OAuthClient struct {
+	ClientID   string
+	Name       string
+	SecretHash string
+	// Scopes are the roles tokens issued to the client may carry
+	Scopes     []string
+	Audiences  []string
+	GrantTypes []string
+	CreatedAt  time.Time
+}
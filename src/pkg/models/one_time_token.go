@@ -0,0 +1,13 @@
+package models
+
+import "time"
+
+// OneTimeToken is a single-use token sent to a user out of band, e.g. to reset a password.
+// Only the hash of the token is stored.
+type OneTimeToken struct {
+	TokenHash string
+	Purpose   string
+	Username  string
+	CreatedAt time.Time
+	ExpiresAt time.Time
+}
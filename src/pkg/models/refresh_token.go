@@ -0,0 +1,19 @@
+package models
+
+import "time"
+
+// RefreshToken is a persisted refresh token. Only the hash of the token is stored.
+// All tokens created from the same login share a FamilyID.
+type RefreshToken struct {
+	TokenHash string
+	FamilyID  string
+	Username  string
+	Audience  string
+	// ClientID and Scope are set for tokens issued to an OAuth2 client, which alone may refresh them
+	ClientID  string
+	Scope     string
+	CreatedAt time.Time
+	ExpiresAt time.Time
+	Used      bool
+	Revoked   bool
+}
@@ -0,0 +1,10 @@
+package models
+
+import "time"
+
+// RevokedToken is an access token that was revoked before it expired
+type RevokedToken struct {
+	JTI       string
+	Username  string
+	ExpiresAt time.Time
+}
@@ -0,0 +1,17 @@
+package models
+
+import "time"
+
+// Session is a login of a user on a device. All refresh tokens of the login belong to it,
+// its ID is the refresh token family and the sid claim of its access tokens.
+type Session struct {
+	ID         string
+	Username   string
+	Audience   string
+	IP         string
+	UserAgent  string
+	CreatedAt  time.Time
+	LastUsedAt time.Time
+	ExpiresAt  time.Time
+	Revoked    bool
+}
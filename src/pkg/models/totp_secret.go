@@ -0,0 +1,11 @@
+package models
+
+// TOTPSecret is the shared secret of a user's authenticator app.
+// It is only used as second factor once the user confirmed it with a valid code.
+type TOTPSecret struct {
+	Username  string
+	Secret    string
+	Confirmed bool
+	// LastCounter is the time step of the last accepted code, codes cannot be used twice
+	LastCounter int64
+}
@@ -5,4 +5,16 @@ type User struct {
 	FirstName string
 	LastName  string
 	Password  string
+	Roles     []string
+	Email     string
+	// EmailVerified is set once the user confirmed the email address, only verified addresses can be used to log in
+	EmailVerified bool
+	// Source names the credential backend checking the password of the user, "local" for the users table
+	Source string
+}
+
+// WithoutPassword returns a copy of the user that is safe to publish
+func (u User) WithoutPassword() User {
+	u.Password = ""
+	return u
 }
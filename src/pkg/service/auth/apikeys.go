@@ -0,0 +1,159 @@
+package auth
+
+import (
+	"crypto/subtle"
+	"errors"
+	"github.com/BieggerM/userservice/pkg/models"
+	"github.com/golang-jwt/jwt"
+	"github.com/sirupsen/logrus"
+	"strings"
+	"time"
+)
+
+// apiKeyPrefix marks API keys, which look like "usk_<id>_<secret>"
+const apiKeyPrefix = "usk_"
+
+var (
+	ErrInvalidAPIKey  = errors.New("invalid api key")
+	ErrAPIKeyNotFound = errors.New("api key not found")
+	ErrInvalidScope   = errors.New("scope exceeds the roles of the user")
+)
+
+// CreateAPIKey creates a key for the user limited to the given scopes, which default to all roles of the user.
+// The returned secret is shown once and cannot be recovered. A zero expiresAt creates a key without expiry.
+func (a *Auth) CreateAPIKey(username, name string, scopes []string, expiresAt time.Time) (models.APIKey, string, error) {
+	user, err := a.DB.GetUser(username)
+	if err != nil {
+		return models.APIKey{}, "", ErrUserNotFound
+	}
+	if len(scopes) == 0 {
+		scopes = user.Roles
+	}
+	for _, scope := range scopes {
+		if !containsRole(user.Roles, scope) {
+			return models.APIKey{}, "", ErrInvalidScope
+		}
+	}
+	// long enough that ids of different keys never collide
+	id, err := randomHex(8)
+	if err != nil {
+		return models.APIKey{}, "", err
+	}
+	secret, err := randomToken()
+	if err != nil {
+		return models.APIKey{}, "", err
+	}
+	key := models.APIKey{
+		ID:        id,
+		Name:      name,
+		Username:  username,
+		KeyHash:   hashToken(secret),
+		Scopes:    scopes,
+		CreatedAt: time.Now(),
+		ExpiresAt: expiresAt,
+	}
+	if err := a.DB.SaveAPIKey(key); err != nil {
+		return models.APIKey{}, "", err
+	}
+	return key, apiKeyPrefix + id + "_" + secret, nil
+}
+
+// ListAPIKeys returns the keys of a user without their hashes
+func (a *Auth) ListAPIKeys(username string) ([]models.APIKey, error) {
+	keys, err := a.DB.ListAPIKeys(username)
+	for i := range keys {
+		keys[i].KeyHash = ""
+	}
+	return keys, err
+}
+
+// RevokeAPIKey revokes a key of the user, it is rejected from then on
+func (a *Auth) RevokeAPIKey(username, id string) error {
+	if err := a.DB.RevokeAPIKey(username, id); err != nil {
+		return ErrAPIKeyNotFound
+	}
+	return nil
+}
+
+// ValidateToken accepts both JWTs and API keys and returns the claims of the caller
+func (a *Auth) ValidateToken(token string) (*Claims, error) {
+	if strings.HasPrefix(token, apiKeyPrefix) {
+		return a.validateAPIKey(token)
+	}
+	return a.ValidateJWT(token)
+}
+
+// validateAPIKey checks an API key like checkAPIKey and records its use
+func (a *Auth) validateAPIKey(token string) (*Claims, error) {
+	claims, err := a.checkAPIKey(token)
+	if err != nil {
+		return nil, err
+	}
+	a.touchAPIKey(claims.APIKeyID)
+	return claims, nil
+}
+
+// checkAPIKey checks an API key and returns claims with the scopes of the key that the user still has.
+// Keys are revoked with all tokens of their user, e.g. on a password change.
+func (a *Auth) checkAPIKey(token string) (*Claims, error) {
+	id, secret, ok := strings.Cut(strings.TrimPrefix(token, apiKeyPrefix), "_")
+	if !ok {
+		return nil, ErrInvalidAPIKey
+	}
+	key, err := a.DB.GetAPIKey(id)
+	if err != nil || subtle.ConstantTimeCompare([]byte(key.KeyHash), []byte(hashToken(secret))) != 1 {
+		return nil, ErrInvalidAPIKey
+	}
+	now := time.Now()
+	if key.Revoked || (!key.ExpiresAt.IsZero() && now.After(key.ExpiresAt)) {
+		return nil, ErrInvalidAPIKey
+	}
+	user, err := a.DB.GetUser(key.Username)
+	if err != nil {
+		return nil, ErrInvalidAPIKey
+	}
+	// roles removed from the user since the key was created are not granted anymore
+	var roles []string
+	for _, scope := range key.Scopes {
+		if containsRole(user.Roles, scope) {
+			roles = append(roles, scope)
+		}
+	}
+	claims := &Claims{
+		StandardClaims: jwt.StandardClaims{
+			Id:       id,
+			Subject:  key.Username,
+			Issuer:   a.config.Issuer,
+			IssuedAt: key.CreatedAt.Unix(),
+		},
+		UserID:         key.Username,
+		Roles:          roles,
+		IssuedAtMillis: key.CreatedAt.UnixMilli(),
+		APIKeyID:       id,
+	}
+	if !key.ExpiresAt.IsZero() {
+		claims.ExpiresAt = key.ExpiresAt.Unix()
+	}
+	if a.revocations.IsRevoked(claims) {
+		return nil, ErrTokenRevoked
+	}
+	return claims, nil
+}
+
+func (a *Auth) touchAPIKey(id string) {
+	if !a.apiKeyTouches.due(id, time.Now()) {
+		return
+	}
+	if err := a.DB.TouchAPIKey(id); err != nil {
+		logrus.Errorf("Failed to record use of api key %s: %v", id, err)
+	}
+}
+
+func containsRole(roles []string, role string) bool {
+	for _, r := range roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
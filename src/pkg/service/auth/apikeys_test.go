@@ -0,0 +1,114 @@
+package auth
+
+import (
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAPIKeyScopes(t *testing.T) {
+	a, db, _ := setupService(t)
+	user, err := db.GetUser("user1")
+	assert.NoError(t, err)
+	user.Roles = []string{RoleUser, RoleService}
+	_, err = db.UpdateUser(user)
+	assert.NoError(t, err)
+	assert.NoError(t, db.UpdateRoles("user1", user.Roles))
+
+	_, _, err = a.CreateAPIKey("user1", "import", []string{RoleAdmin}, time.Time{})
+	assert.ErrorIs(t, err, ErrInvalidScope)
+	_, _, err = a.CreateAPIKey("nobody", "import", nil, time.Time{})
+	assert.ErrorIs(t, err, ErrUserNotFound)
+
+	key, secret, err := a.CreateAPIKey("user1", "import", []string{RoleService}, time.Time{})
+	assert.NoError(t, err)
+	assert.Len(t, key.ID, 16)
+	assert.True(t, strings.HasPrefix(secret, apiKeyPrefix+key.ID+"_"))
+	claims, err := a.ValidateToken(secret)
+	assert.NoError(t, err)
+	assert.Equal(t, "user1", claims.Subject)
+	assert.Equal(t, key.ID, claims.APIKeyID)
+	assert.Equal(t, []string{RoleService}, claims.Roles)
+
+	// without scopes a key gets all roles of the user
+	_, secret, err = a.CreateAPIKey("user1", "all", nil, time.Time{})
+	assert.NoError(t, err)
+	claims, err = a.ValidateToken(secret)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{RoleUser, RoleService}, claims.Roles)
+}
+
+func TestAPIKeyLosesRemovedRoles(t *testing.T) {
+	a, db, _ := setupService(t)
+	assert.NoError(t, db.UpdateRoles("user1", []string{RoleUser, RoleService}))
+	_, secret, err := a.CreateAPIKey("user1", "import", nil, time.Time{})
+	assert.NoError(t, err)
+
+	assert.NoError(t, db.UpdateRoles("user1", []string{RoleUser}))
+	claims, err := a.ValidateToken(secret)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{RoleUser}, claims.Roles)
+}
+
+func TestExpiredAPIKeyIsRejected(t *testing.T) {
+	a, _, _ := setupService(t)
+	_, secret, err := a.CreateAPIKey("user1", "import", nil, time.Now().Add(-time.Second))
+	assert.NoError(t, err)
+	_, err = a.ValidateToken(secret)
+	assert.ErrorIs(t, err, ErrInvalidAPIKey)
+
+	expiresAt := time.Now().Add(time.Hour)
+	_, secret, err = a.CreateAPIKey("user1", "import", nil, expiresAt)
+	assert.NoError(t, err)
+	claims, err := a.ValidateToken(secret)
+	assert.NoError(t, err)
+	assert.Equal(t, expiresAt.Unix(), claims.ExpiresAt)
+}
+
+func TestRevokedAPIKeyIsRejected(t *testing.T) {
+	a, _, _ := setupService(t)
+	key, secret, err := a.CreateAPIKey("user1", "import", nil, time.Time{})
+	assert.NoError(t, err)
+	_, other, err := a.CreateAPIKey("user1", "export", nil, time.Time{})
+	assert.NoError(t, err)
+
+	assert.ErrorIs(t, a.RevokeAPIKey("user2", key.ID), ErrAPIKeyNotFound)
+	assert.NoError(t, a.RevokeAPIKey("user1", key.ID))
+	_, err = a.ValidateToken(secret)
+	assert.ErrorIs(t, err, ErrInvalidAPIKey)
+	_, err = a.ValidateToken(other)
+	assert.NoError(t, err)
+
+	// a wrong secret for an existing id
+	_, err = a.ValidateToken(other[:len(other)-4] + "AAAA")
+	assert.ErrorIs(t, err, ErrInvalidAPIKey)
+}
+
+func TestPasswordChangeRevokesAPIKeys(t *testing.T) {
+	a, _, _ := setupService(t)
+	_, secret, err := a.CreateAPIKey("user1", "import", nil, time.Time{})
+	assert.NoError(t, err)
+
+	assert.NoError(t, a.ChangePassword("user1", "Brand new passphrase 42"))
+	_, err = a.ValidateToken(secret)
+	assert.ErrorIs(t, err, ErrTokenRevoked)
+
+	// keys created afterwards work
+	time.Sleep(2 * time.Millisecond)
+	_, secret, err = a.CreateAPIKey("user1", "import", nil, time.Time{})
+	assert.NoError(t, err)
+	_, err = a.ValidateToken(secret)
+	assert.NoError(t, err)
+}
+
+func TestAPIKeyUseIsRecordedOncePerInterval(t *testing.T) {
+	a, db, _ := setupService(t)
+	_, secret, err := a.CreateAPIKey("user1", "import", nil, time.Time{})
+	assert.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		_, err = a.ValidateToken(secret)
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, 1, db.APIKeyTouches())
+}
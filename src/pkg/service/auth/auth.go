@@ -1,52 +1,344 @@
 package auth
 
 import (
-	"crypto/rand"
-	"crypto/rsa"
 	"fmt"
+	"github.com/BieggerM/userservice/pkg/adapter/out/broker"
+	"github.com/BieggerM/userservice/pkg/adapter/out/database"
+	"github.com/BieggerM/userservice/pkg/models"
 	"github.com/golang-jwt/jwt"
+	"github.com/sirupsen/logrus"
+	"strings"
+	"sync"
 	"time"
 )
 
+// keyReloadInterval defines how often the key directory is checked for rotated keys
+const keyReloadInterval = time.Minute
+
+// keyWaitInterval is how often replicas look for the first key generated by the rotation leader
+const keyWaitInterval = time.Second
+
 type AuthService interface {
-	GenerateJWT(username string) (string, error)
-	ValidateJWT(token string) (bool, error)
-	SetupRSAKeys()
+	GenerateJWT(user models.User, audience string) (string, error)
+	ValidateJWT(token string) (*Claims, error)
+	ValidateToken(token string) (*Claims, error)
+	IssueTokens(user models.User, audience string, client ClientInfo) (TokenPair, error)
+	RefreshTokens(refreshToken string, client ClientInfo) (TokenPair, error)
+	Token(req TokenRequest) (OAuthToken, error)
+	Introspect(clientID, clientSecret, token string) (Introspection, error)
+	ListSessions(username string) ([]models.Session, error)
+	RevokeSession(username, id string) error
+	Authenticate(username, password, clientIP string) (models.User, error)
+	Unlock(username string) error
+	HashPassword(password string) (string, error)
+	ChangePassword(username, password string) error
+	CheckPassword(username, password string) error
+	RequestPasswordReset(username, clientIP string) error
+	ResetPassword(token, password string) (string, error)
+	RequestMagicLink(login, clientIP string) error
+	RedeemMagicLink(token string) (models.User, error)
+	ChangeEmail(username, email string) error
+	RequestEmailVerification(username string) error
+	VerifyEmail(token string) (string, error)
+	EnrollTOTP(username string) (TOTPEnrollment, error)
+	ConfirmTOTP(username, code string) ([]string, error)
+	VerifyMFA(mfaToken, code, audience string, client ClientInfo) (TokenPair, error)
+	ResetMFA(username string) error
+	CreateAPIKey(username, name string, scopes []string, expiresAt time.Time) (models.APIKey, string, error)
+	ListAPIKeys(username string) ([]models.APIKey, error)
+	RevokeAPIKey(username, id string) error
+	Logout(accessToken, refreshToken string) error
+	RevokeUserTokens(username string) error
+	Impersonate(actor *Claims, target, audience, reason string, client ClientInfo) (TokenPair, error)
+	JWKS() JWKSet
+	OpenIDConfiguration() (OpenIDConfiguration, error)
+	UserInfo(username string) (UserInfo, error)
+	Setup(DB database.Database, MB broker.MessageBroker, config Config) error
+}
+
+// Config holds the settings of the authentication service
+type Config struct {
+	// KeyDir is the directory containing the PEM encoded signing keys
+	KeyDir string
+	// KeyRotationInterval is the maximum age of the newest signing key, 0 disables automatic rotation
+	KeyRotationInterval time.Duration
+	// KeyRotationLeader enables automatic rotation on this replica. Replicas sharing KeyDir
+	// must not rotate on their own, so only one of them or the "keys rotate" command may do it.
+	// The leader also generates the first key of an empty KeyDir.
+	KeyRotationLeader bool
+	// KeyWaitTimeout is how long other replicas wait on startup for the first key to appear in KeyDir
+	KeyWaitTimeout time.Duration
+	// SigningAlgorithm is used for keys generated by the service, AlgRS256 if unset.
+	// Existing keys keep the algorithm they were created with.
+	SigningAlgorithm string
+	// TokenTTL is the lifetime of issued access tokens
+	TokenTTL time.Duration
+	// RefreshTokenTTL is the lifetime of issued refresh tokens
+	RefreshTokenTTL time.Duration
+	// PasswordParams are used to hash passwords, DefaultArgon2Params if unset
+	PasswordParams Argon2Params
+	// PasswordPolicy is enforced for new passwords, DefaultPasswordPolicy if unset
+	PasswordPolicy PasswordPolicy
+	// Issuer is set as iss claim and required when validating tokens
+	Issuer string
+	// PublicURL is the base URL clients reach the REST API at, used in the discovery document
+	PublicURL string
+	// Audiences are the clients tokens can be issued for, the first one is the default
+	Audiences []string
+	// Leeway is the tolerated clock skew when checking exp, nbf and iat
+	Leeway time.Duration
+	// PasswordResetTTL is the lifetime of password reset tokens
+	PasswordResetTTL time.Duration
+	// EmailVerificationTTL is the lifetime of email verification tokens
+	EmailVerificationTTL time.Duration
+	// ImpersonationTTL is the lifetime of impersonation tokens, at most TokenTTL
+	ImpersonationTTL time.Duration
+	// MagicLinkTTL is the lifetime of passwordless login tokens
+	MagicLinkTTL time.Duration
+	// CredentialVerifiers are external backends like LDAP, tried in order for logins unknown
+	// to the users table. Passwords of local users are always checked against the users table.
+	CredentialVerifiers []CredentialVerifier
 }
 
 type Claims struct {
 	jwt.StandardClaims
-	UserID string `json:"user_id"`
+	// UserID duplicates the sub claim for clients of the first token format
+	UserID string   `json:"user_id"`
+	Roles  []string `json:"roles"`
+	// SessionID identifies the login the token was issued for
+	SessionID string `json:"sid,omitempty"`
+	// IssuedAtMillis is iat in milliseconds, so tokens issued right after revoking all tokens
+	// of a user in the same second are not revoked as well
+	IssuedAtMillis int64 `json:"iat_ms,omitempty"`
+	// Scope lists the granted roles space-delimited for tokens issued to an OAuth2 client
+	Scope    string `json:"scope,omitempty"`
+	ClientID string `json:"client_id,omitempty"`
+	// Actor identifies the admin acting on behalf of the subject in impersonation tokens
+	Actor *Actor `json:"act,omitempty"`
+	// APIKeyID is set when the caller authenticated with an API key instead of a JWT
+	APIKeyID string `json:"-"`
 }
 
 type Auth struct {
-	privateKey *rsa.PrivateKey
-	publicKey  *rsa.PublicKey
+	DB          database.Database
+	MB          broker.MessageBroker
+	config      Config
+	keys        *KeyRing
+	revocations *RevocationStore
+	ipThrottle  *throttle
+	// loginThrottle delays and locks unknown logins like accounts, so lockouts do not reveal which accounts exist
+	loginThrottle *throttle
+	// requestLoginThrottle and requestIPThrottle limit requests that send mail, such as password resets
+	requestLoginThrottle *throttle
+	requestIPThrottle    *throttle
+	breached             map[string]struct{}
+	sessionTouches       touches
+	apiKeyTouches        touches
+	// verifiers holds the local backend followed by the configured external ones
+	verifiers []CredentialVerifier
+	// dummyHash is verified for unknown users to hide which usernames exist
+	dummyHash string
+	// deliveries tracks login links and reset tokens still being stored and published after their request returned
+	deliveries sync.WaitGroup
 }
 
-func (a *Auth) SetupRSAKeys() {
-	var err error
-	a.privateKey, err = rsa.GenerateKey(rand.Reader, 2048)
+// Setup loads the signing keys from the key directory, waiting for the first one if none exist,
+// and starts watching the directory for rotated keys
+func (a *Auth) Setup(DB database.Database, MB broker.MessageBroker, config Config) error {
+	a.DB = DB
+	a.MB = MB
+	a.config = config
+	if a.config.SigningAlgorithm == "" {
+		a.config.SigningAlgorithm = AlgRS256
+	}
+	if signingMethod(a.config.SigningAlgorithm) == nil {
+		return fmt.Errorf("unsupported signing algorithm %q", a.config.SigningAlgorithm)
+	}
+	if a.config.PasswordParams == (Argon2Params{}) {
+		a.config.PasswordParams = DefaultArgon2Params
+	}
+	if a.config.PasswordResetTTL == 0 {
+		a.config.PasswordResetTTL = time.Hour
+	}
+	if a.config.EmailVerificationTTL == 0 {
+		a.config.EmailVerificationTTL = 24 * time.Hour
+	}
+	if a.config.MagicLinkTTL == 0 {
+		a.config.MagicLinkTTL = 15 * time.Minute
+	}
+	// longer lived tokens could outlive the retention of their signing key
+	if a.config.ImpersonationTTL == 0 || a.config.ImpersonationTTL > a.config.TokenTTL {
+		a.config.ImpersonationTTL = min(10*time.Minute, a.config.TokenTTL)
+	}
+	if a.config.PasswordPolicy == (PasswordPolicy{}) {
+		a.config.PasswordPolicy = DefaultPasswordPolicy
+	}
+	if path := a.config.PasswordPolicy.BreachedListFile; path != "" {
+		breached, err := loadBreachedPasswords(path)
+		if err != nil {
+			return err
+		}
+		a.breached = breached
+		logrus.Infof("Loaded %d breached passwords from %s", len(breached), path)
+	}
+	if !a.issuerIsPublicURL() {
+		logrus.Warnf("JWT issuer %q is not the public URL %q, OpenID Connect discovery is disabled", a.config.Issuer, a.config.PublicURL)
+	}
+	a.ipThrottle = newThrottle(ipFreeAttempts, 0)
+	a.loginThrottle = newThrottle(accountFreeAttempts, maxFailedLogins)
+	a.requestLoginThrottle = newThrottle(requestFreeAttempts, 0)
+	a.requestIPThrottle = newThrottle(ipFreeAttempts, 0)
+	dummyHash, err := a.HashPassword("dummy password")
 	if err != nil {
-		fmt.Println("Failed to generate private key")
+		return err
 	}
-	a.publicKey = &a.privateKey.PublicKey
+	a.dummyHash = dummyHash
+	a.verifiers = append([]CredentialVerifier{&localVerifier{auth: a}}, config.CredentialVerifiers...)
+	for _, v := range config.CredentialVerifiers {
+		if v.Source() == SourceLocal {
+			return fmt.Errorf("credential backend %q is reserved for the users table", SourceLocal)
+		}
+		logrus.Infof("Using %s credential backend", v.Source())
+	}
+	a.revocations = &RevocationStore{DB: DB, MaxTokenAge: a.maxTokenAge()}
+	if err := a.revocations.Load(); err != nil {
+		return err
+	}
+	go a.revocations.watch()
+
+	keys, err := LoadKeyRing(config.KeyDir)
+	if err != nil {
+		return err
+	}
+	a.keys = keys
+	if _, err := a.keys.Newest(); err != nil {
+		if err := a.initialKey(); err != nil {
+			return err
+		}
+	}
+	go a.watchKeys()
+	return nil
 }
 
-func (a *Auth) GenerateJWT(username string) (string, error) {
-	expirationTime := time.Now().Add(time.Hour * 24) 
+// initialKey provides the first key of an empty key directory. It signs right away, so only the
+// rotation leader generates it: keys generated by several replicas would each sign tokens the
+// other replicas cannot verify yet. The other replicas wait up to KeyWaitTimeout for it.
+func (a *Auth) initialKey() error {
+	if a.config.KeyRotationLeader {
+		key, err := GenerateKey(a.config.KeyDir, a.config.SigningAlgorithm, time.Now())
+		if err != nil {
+			return err
+		}
+		logrus.Infof("Generated signing key %s in %s", key.ID, a.config.KeyDir)
+		return a.keys.Reload()
+	}
+	logrus.Infof("Waiting for the rotation leader to generate a signing key in %s", a.config.KeyDir)
+	deadline := time.Now().Add(a.config.KeyWaitTimeout)
+	for {
+		if err := a.keys.Reload(); err != nil {
+			return err
+		}
+		if _, err := a.keys.Newest(); err == nil {
+			return nil
+		}
+		if !time.Now().Before(deadline) {
+			return fmt.Errorf("no signing key in %s, only the rotation leader generates the first one", a.config.KeyDir)
+		}
+		time.Sleep(keyWaitInterval)
+	}
+}
+
+// watchKeys periodically reloads the key ring and, on the rotation leader, rotates the keys when it is due
+func (a *Auth) watchKeys() {
+	for range time.Tick(keyReloadInterval) {
+		if err := a.rotateIfDue(time.Now()); err != nil {
+			logrus.Errorf("Failed to rotate signing keys: %v", err)
+		}
+		if err := a.keys.Reload(); err != nil {
+			logrus.Errorf("Failed to reload signing keys: %v", err)
+		}
+	}
+}
+
+func (a *Auth) rotateIfDue(now time.Time) error {
+	if !a.config.KeyRotationLeader || a.config.KeyRotationInterval <= 0 {
+		return nil
+	}
+	// the newest key counts even before it signs, otherwise every tick would add another one
+	newest, err := a.keys.Newest()
+	if err != nil || now.Sub(newest.Created) < a.config.KeyRotationInterval {
+		return err
+	}
+	key, removed, err := RotateKeys(a.config.KeyDir, a.config.SigningAlgorithm, a.maxTokenAge(), now)
+	if err != nil {
+		return err
+	}
+	logrus.Infof("Generated signing key %s, removed %d expired keys", key.ID, len(removed))
+	return a.keys.Reload()
+}
+
+// maxTokenAge is the time after which no token signed by a retired key can be valid anymore
+func (a *Auth) maxTokenAge() time.Duration {
+	return a.config.TokenTTL + a.config.Leeway
+}
+
+// GenerateJWT signs an access token without session. Like logins it fails with ErrMFARequired
+// for users with two-factor authentication.
+func (a *Auth) GenerateJWT(user models.User, audience string) (string, error) {
+	g := grant{audience: audience}
+	if err := a.requireSecondFactor(user, g); err != nil {
+		return "", err
+	}
+	return a.generateJWT(user, g, "")
+}
+
+// generateJWT signs an access token, sessionID is empty for tokens issued outside a login session
+func (a *Auth) generateJWT(user models.User, g grant, sessionID string) (string, error) {
+	audience, err := a.audience(g.audience)
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	key, err := a.keys.Active(now)
+	if err != nil {
+		return "", err
+	}
+	jti, err := randomHex(16)
+	if err != nil {
+		return "", err
+	}
+	ttl := a.config.TokenTTL
+	if g.ttl > 0 {
+		ttl = g.ttl
+	}
 
 	claims := &Claims{
 		StandardClaims: jwt.StandardClaims{
-			ExpiresAt: expirationTime.Unix(),
-			IssuedAt:  time.Now().Unix(),
+			Id:        jti,
+			Subject:   user.Username,
+			Issuer:    a.config.Issuer,
+			Audience:  audience,
+			ExpiresAt: now.Add(ttl).Unix(),
+			IssuedAt:  now.Unix(),
+			NotBefore: now.Unix(),
 		},
-		UserID: username,
+		UserID:         user.Username,
+		Roles:          user.Roles,
+		SessionID:      sessionID,
+		IssuedAtMillis: now.UnixMilli(),
+		ClientID:       g.clientID,
+		Actor:          g.actor,
+	}
+	if g.scope != nil {
+		// scoped tokens carry the granted roles the user still has
+		claims.Roles = intersectRoles(user.Roles, g.scope)
+		claims.Scope = strings.Join(claims.Roles, " ")
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token := jwt.NewWithClaims(signingMethod(key.Algorithm), claims)
+	token.Header["kid"] = key.ID
 
-	signedToken, err := token.SignedString(a.privateKey)
+	signedToken, err := token.SignedString(key.PrivateKey)
 	if err != nil {
 		return "", err
 	}
@@ -54,18 +346,75 @@ func (a *Auth) GenerateJWT(username string) (string, error) {
 	return signedToken, nil
 }
 
-func (a *Auth) ValidateJWT(tokenString string) (bool, error) {
-	token, err := jwt.ParseWithClaims(tokenString, &Claims{}, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodRSA); !ok {
+// Logout revokes the access token and its session, or for tokens without session
+// the refresh token family of the same login if given
+func (a *Auth) Logout(accessToken, refreshToken string) error {
+	claims, err := a.ValidateJWT(accessToken)
+	if err != nil {
+		return err
+	}
+	if err := a.revocations.RevokeToken(claims); err != nil {
+		return err
+	}
+	if claims.SessionID != "" {
+		return a.revocations.RevokeSession(claims.SessionID)
+	}
+	if refreshToken == "" {
+		return nil
+	}
+	stored, err := a.DB.GetRefreshToken(hashToken(refreshToken))
+	if err != nil || stored.Username != claims.UserID {
+		return ErrInvalidRefreshToken
+	}
+	return a.DB.RevokeRefreshTokenFamily(stored.FamilyID)
+}
+
+// RevokeUserTokens revokes every token issued to the user, e.g. after a password change
+func (a *Auth) RevokeUserTokens(username string) error {
+	return a.revocations.RevokeUser(username)
+}
+
+// ValidateJWT verifies the signature, issuer, audience and lifetime of a token,
+// checks it against the denylist and returns its claims. The use of its session is recorded.
+func (a *Auth) ValidateJWT(tokenString string) (*Claims, error) {
+	claims, err := a.checkJWT(tokenString)
+	if err != nil {
+		return nil, err
+	}
+	if claims.SessionID != "" && a.DB != nil {
+		a.touchSession(claims.SessionID)
+	}
+	return claims, nil
+}
+
+// checkJWT validates a token like ValidateJWT without recording its use
+func (a *Auth) checkJWT(tokenString string) (*Claims, error) {
+	claims := &Claims{}
+	// the registered claims are checked by verifyClaims, which allows for clock skew
+	parser := &jwt.Parser{SkipClaimsValidation: true}
+	token, err := parser.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		key, ok := a.keys.Lookup(kid, a.maxTokenAge(), time.Now())
+		if !ok {
+			return nil, fmt.Errorf("Unknown signing key: %q", kid)
+		}
+		// the key decides the algorithm, never the token, which prevents algorithm confusion
+		if token.Method.Alg() != key.Algorithm {
 			return nil, fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
 		}
-		return a.publicKey, nil
+		return key.PublicKey(), nil
 	})
 	if err != nil {
-		return false, err
+		return nil, err
+	}
+	if !token.Valid {
+		return nil, fmt.Errorf("Invalid token")
+	}
+	if err := a.verifyClaims(claims, time.Now()); err != nil {
+		return nil, err
 	}
-	if token.Valid {
-		return true, nil
+	if a.revocations != nil && a.revocations.IsRevoked(claims) {
+		return nil, ErrTokenRevoked
 	}
-	return false, nil
+	return claims, nil
 }
@@ -0,0 +1,378 @@
+package auth
+
+import (
+	"errors"
+	"github.com/BieggerM/userservice/pkg/adapter/out/broker/brokertest"
+	"github.com/BieggerM/userservice/pkg/adapter/out/database/databasetest"
+	"github.com/BieggerM/userservice/pkg/models"
+	"github.com/golang-jwt/jwt"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func setupAuth(t *testing.T, dir string) *Auth {
+	a := &Auth{DB: databasetest.NewMemory(), config: Config{
+		KeyDir:    dir,
+		TokenTTL:  time.Hour,
+		Issuer:    "user-service",
+		Audiences: []string{"recipemanagement", "gateway"},
+		Leeway:    time.Minute,
+	}}
+	keys, err := LoadKeyRing(dir)
+	assert.NoError(t, err)
+	a.keys = keys
+	return a
+}
+
+// setupService starts the service on an in-memory database with a user1 holding password "correct horse"
+func setupService(t *testing.T) (*Auth, *databasetest.Memory, *brokertest.Recorder) {
+	db := databasetest.NewMemory()
+	mb := &brokertest.Recorder{}
+	a := &Auth{}
+	assert.NoError(t, a.Setup(db, mb, Config{
+		KeyDir:            t.TempDir(),
+		KeyRotationLeader: true,
+		TokenTTL:          15 * time.Minute,
+		RefreshTokenTTL:   time.Hour,
+		Issuer:            "user-service",
+		Audiences:         []string{"recipemanagement", "gateway"},
+		Leeway:            time.Minute,
+		PasswordParams:    testParams,
+	}))
+	hash, err := a.HashPassword("correct horse")
+	assert.NoError(t, err)
+	assert.NoError(t, db.SaveUser(models.User{Username: "user1", Password: hash, Roles: []string{RoleUser}}))
+	return a, db, mb
+}
+
+func TestTokensSurviveRestart(t *testing.T) {
+	dir := t.TempDir()
+	_, err := GenerateKey(dir, AlgRS256, time.Now())
+	assert.NoError(t, err)
+
+	token, err := setupAuth(t, dir).GenerateJWT(models.User{Username: "user1"}, "")
+	assert.NoError(t, err)
+
+	claims, err := setupAuth(t, dir).ValidateJWT(token)
+	assert.NoError(t, err)
+	assert.Equal(t, "user1", claims.UserID)
+}
+
+func TestRotatedKeyStillVerifies(t *testing.T) {
+	dir := t.TempDir()
+	_, err := GenerateKey(dir, AlgRS256, time.Now().Add(-2*time.Minute))
+	assert.NoError(t, err)
+	a := setupAuth(t, dir)
+	oldToken, err := a.GenerateJWT(models.User{Username: "user1"}, "")
+	assert.NoError(t, err)
+
+	newKey, removed, err := RotateKeys(dir, AlgRS256, time.Hour, time.Now().Add(-KeyPublishDelay))
+	assert.NoError(t, err)
+	assert.Empty(t, removed)
+	assert.NoError(t, a.keys.Reload())
+
+	active, err := a.keys.Active(time.Now())
+	assert.NoError(t, err)
+	assert.Equal(t, newKey.ID, active.ID)
+
+	_, err = a.ValidateJWT(oldToken)
+	assert.NoError(t, err)
+}
+
+func TestRotatedKeyIsPublishedBeforeSigning(t *testing.T) {
+	dir := t.TempDir()
+	oldKey, err := GenerateKey(dir, AlgRS256, time.Now().Add(-time.Hour))
+	assert.NoError(t, err)
+	a := setupAuth(t, dir)
+
+	newKey, _, err := RotateKeys(dir, AlgRS256, time.Hour, time.Now())
+	assert.NoError(t, err)
+	assert.NoError(t, a.keys.Reload())
+
+	var kids []string
+	for _, key := range a.JWKS().Keys {
+		kids = append(kids, key.Kid)
+	}
+	assert.ElementsMatch(t, []string{oldKey.ID, newKey.ID}, kids)
+
+	token, err := a.GenerateJWT(models.User{Username: "user1"}, "")
+	assert.NoError(t, err)
+	parsed, _, err := new(jwt.Parser).ParseUnverified(token, &Claims{})
+	assert.NoError(t, err)
+	assert.Equal(t, oldKey.ID, parsed.Header["kid"])
+
+	active, err := a.keys.Active(time.Now().Add(KeyPublishDelay))
+	assert.NoError(t, err)
+	assert.Equal(t, newKey.ID, active.ID)
+}
+
+func TestOnlyTheLeaderRotatesKeys(t *testing.T) {
+	dir := t.TempDir()
+	_, err := GenerateKey(dir, AlgRS256, time.Now().Add(-2*time.Hour))
+	assert.NoError(t, err)
+	a := setupAuth(t, dir)
+	a.config.KeyDir = dir
+	a.config.SigningAlgorithm = AlgRS256
+	a.config.KeyRotationInterval = time.Hour
+
+	assert.NoError(t, a.rotateIfDue(time.Now()))
+	assert.NoError(t, a.keys.Reload())
+	assert.Len(t, a.keys.VerificationKeys(time.Hour, time.Now()), 1)
+
+	a.config.KeyRotationLeader = true
+	assert.NoError(t, a.rotateIfDue(time.Now()))
+	assert.NoError(t, a.rotateIfDue(time.Now()))
+	assert.NoError(t, a.keys.Reload())
+	assert.Len(t, a.keys.VerificationKeys(time.Hour, time.Now()), 2)
+}
+
+func TestOnlyTheLeaderGeneratesTheFirstKey(t *testing.T) {
+	dir := t.TempDir()
+	config := Config{KeyDir: dir, TokenTTL: time.Hour, PasswordParams: testParams}
+	assert.Error(t, (&Auth{}).Setup(databasetest.NewMemory(), &brokertest.Recorder{}, config))
+	keys, err := LoadKeyRing(dir)
+	assert.NoError(t, err)
+	_, err = keys.Newest()
+	assert.Error(t, err)
+
+	// replicas started together with the leader pick up its key
+	config.KeyWaitTimeout = time.Minute
+	replica := make(chan error)
+	go func() {
+		replica <- (&Auth{}).Setup(databasetest.NewMemory(), &brokertest.Recorder{}, config)
+	}()
+	leader := &Auth{}
+	leaderConfig := config
+	leaderConfig.KeyRotationLeader = true
+	assert.NoError(t, leader.Setup(databasetest.NewMemory(), &brokertest.Recorder{}, leaderConfig))
+	assert.NoError(t, <-replica)
+	assert.NoError(t, keys.Reload())
+	assert.Len(t, keys.VerificationKeys(time.Hour, time.Now()), 1)
+}
+
+func TestExpiredKeysArePruned(t *testing.T) {
+	dir := t.TempDir()
+	old, err := GenerateKey(dir, AlgRS256, time.Now().Add(-3*time.Hour))
+	assert.NoError(t, err)
+	// the second key took over after KeyPublishDelay, its predecessor's tokens expired an hour later
+	_, err = GenerateKey(dir, AlgRS256, time.Now().Add(-time.Hour-KeyPublishDelay))
+	assert.NoError(t, err)
+
+	_, removed, err := RotateKeys(dir, AlgRS256, time.Hour, time.Now())
+	assert.NoError(t, err)
+	assert.Equal(t, []string{old.ID}, removed)
+
+	keys, err := LoadKeyRing(dir)
+	assert.NoError(t, err)
+	assert.Len(t, keys.VerificationKeys(time.Hour, time.Now()), 2)
+}
+
+func TestIssuerAndAudienceAreChecked(t *testing.T) {
+	dir := t.TempDir()
+	_, err := GenerateKey(dir, AlgRS256, time.Now())
+	assert.NoError(t, err)
+	a := setupAuth(t, dir)
+
+	token, err := a.GenerateJWT(models.User{Username: "user1"}, "gateway")
+	assert.NoError(t, err)
+	claims, err := a.ValidateJWT(token)
+	assert.NoError(t, err)
+	assert.Equal(t, "user1", claims.Subject)
+	assert.Equal(t, "gateway", claims.Audience)
+
+	_, err = a.GenerateJWT(models.User{Username: "user1"}, "unknown")
+	assert.ErrorIs(t, err, ErrInvalidAudience)
+
+	other := setupAuth(t, dir)
+	other.config.Issuer = "other-service"
+	_, err = other.ValidateJWT(token)
+	assert.Error(t, err)
+
+	other = setupAuth(t, dir)
+	other.config.Audiences = []string{"recipemanagement"}
+	_, err = other.ValidateJWT(token)
+	assert.ErrorIs(t, err, ErrInvalidAudience)
+}
+
+func TestClockSkewWithinLeeway(t *testing.T) {
+	a := &Auth{config: Config{Issuer: "user-service", Audiences: []string{"recipemanagement"}, Leeway: time.Minute}}
+	now := time.Now()
+	claims := &Claims{}
+	claims.Subject = "user1"
+	claims.Issuer = "user-service"
+	claims.Audience = "recipemanagement"
+	claims.IssuedAt = now.Add(30 * time.Second).Unix()
+	claims.NotBefore = now.Add(30 * time.Second).Unix()
+	claims.ExpiresAt = now.Add(-30 * time.Second).Unix()
+	assert.NoError(t, a.verifyClaims(claims, now))
+
+	claims.NotBefore = now.Add(2 * time.Minute).Unix()
+	assert.Error(t, a.verifyClaims(claims, now))
+}
+
+func TestLoginBackoff(t *testing.T) {
+	assert.Equal(t, time.Duration(0), backoff(2, accountFreeAttempts))
+	assert.Equal(t, time.Second, backoff(3, accountFreeAttempts))
+	assert.Equal(t, 4*time.Second, backoff(5, accountFreeAttempts))
+	assert.Equal(t, maxBackoff, backoff(100, accountFreeAttempts))
+
+	throttle := newThrottle(ipFreeAttempts, 0)
+	now := time.Now()
+	for i := 0; i < ipFreeAttempts; i++ {
+		throttle.fail("10.0.0.1", now)
+	}
+	_, blocked := throttle.blockedUntil("10.0.0.1", now)
+	assert.True(t, blocked)
+	_, blocked = throttle.blockedUntil("10.0.0.2", now)
+	assert.False(t, blocked)
+
+	throttle.succeed("10.0.0.1")
+	_, blocked = throttle.blockedUntil("10.0.0.1", now)
+	assert.False(t, blocked)
+}
+
+func TestUnknownLoginsAreThrottledLikeAccounts(t *testing.T) {
+	a, _, _ := setupService(t)
+	outcome := func(login string) []string {
+		var outcomes []string
+		for i := 0; i < accountFreeAttempts+2; i++ {
+			_, err := a.Authenticate(login, "wrong password", "")
+			var locked *LockedError
+			if errors.As(err, &locked) {
+				outcomes = append(outcomes, "locked")
+			} else {
+				assert.ErrorIs(t, err, ErrInvalidCredentials)
+				outcomes = append(outcomes, "invalid")
+			}
+		}
+		return outcomes
+	}
+	known := outcome("user1")
+	assert.Contains(t, known, "locked")
+	assert.Equal(t, known, outcome("nobody"))
+	// the login is tracked case insensitively like usernames and email addresses
+	_, err := a.Authenticate("NOBODY", "wrong password", "")
+	var locked *LockedError
+	assert.ErrorAs(t, err, &locked)
+}
+
+func TestUnknownLoginsAreLockedLikeAccounts(t *testing.T) {
+	throttle := newThrottle(accountFreeAttempts, maxFailedLogins)
+	now := time.Now()
+	for i := 0; i < maxFailedLogins; i++ {
+		throttle.fail("nobody", now)
+	}
+	until, blocked := throttle.blockedUntil("nobody", now)
+	assert.True(t, blocked)
+	assert.Equal(t, now.Add(lockoutDuration), until)
+}
+
+func TestValidateEmail(t *testing.T) {
+	assert.NoError(t, ValidateEmail("jane@example.com"))
+	assert.ErrorIs(t, ValidateEmail("Jane <jane@example.com>"), ErrInvalidEmail)
+	assert.ErrorIs(t, ValidateEmail("jane"), ErrInvalidEmail)
+}
+
+func TestRevokedSessionRejectsItsTokens(t *testing.T) {
+	dir := t.TempDir()
+	_, err := GenerateKey(dir, AlgRS256, time.Now())
+	assert.NoError(t, err)
+	a := setupAuth(t, dir)
+	a.revocations = &RevocationStore{
+		tokens:   map[string]time.Time{},
+		users:    map[string]time.Time{},
+		sessions: map[string]time.Time{"revoked": time.Now()},
+	}
+
+	token, err := a.generateJWT(models.User{Username: "user1"}, grant{}, "revoked")
+	assert.NoError(t, err)
+	_, err = a.ValidateJWT(token)
+	assert.ErrorIs(t, err, ErrTokenRevoked)
+
+	token, err = a.generateJWT(models.User{Username: "user1"}, grant{}, "active")
+	assert.NoError(t, err)
+	claims, err := a.ValidateJWT(token)
+	assert.NoError(t, err)
+	assert.Equal(t, "active", claims.SessionID)
+}
+
+func TestClientGrantScopes(t *testing.T) {
+	client := models.OAuthClient{ClientID: "cl_1", Scopes: []string{RoleUser, RoleService}, Audiences: []string{"gateway"}}
+	userRoles := []string{RoleAdmin, RoleUser}
+
+	g, err := clientGrant(client, userRoles, TokenRequest{})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{RoleUser}, g.scope)
+	assert.Equal(t, "gateway", g.audience)
+
+	var oauthErr *OAuthError
+	_, err = clientGrant(client, userRoles, TokenRequest{Scope: RoleAdmin})
+	assert.ErrorAs(t, err, &oauthErr)
+	assert.Equal(t, ErrCodeInvalidScope, oauthErr.Code)
+
+	_, err = clientGrant(client, userRoles, TokenRequest{Audience: "recipemanagement"})
+	assert.ErrorAs(t, err, &oauthErr)
+	assert.Equal(t, ErrCodeInvalidRequest, oauthErr.Code)
+}
+
+func TestScopedTokenCarriesGrantedRoles(t *testing.T) {
+	dir := t.TempDir()
+	_, err := GenerateKey(dir, AlgRS256, time.Now())
+	assert.NoError(t, err)
+	a := setupAuth(t, dir)
+
+	user := models.User{Username: "user1", Roles: []string{RoleAdmin, RoleUser}}
+	token, err := a.generateJWT(user, grant{clientID: "cl_1", scope: []string{RoleUser}}, "")
+	assert.NoError(t, err)
+	claims, err := a.ValidateJWT(token)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{RoleUser}, claims.Roles)
+	assert.Equal(t, "user", claims.Scope)
+	assert.Equal(t, "cl_1", claims.ClientID)
+}
+
+func TestImpersonationTokenCarriesActor(t *testing.T) {
+	dir := t.TempDir()
+	_, err := GenerateKey(dir, AlgRS256, time.Now())
+	assert.NoError(t, err)
+	a := setupAuth(t, dir)
+
+	token, err := a.generateJWT(models.User{Username: "user2"}, grant{actor: &Actor{Subject: "user1"}, ttl: time.Minute}, "")
+	assert.NoError(t, err)
+	claims, err := a.ValidateJWT(token)
+	assert.NoError(t, err)
+	assert.Equal(t, "user1", claims.Actor.Subject)
+	assert.Equal(t, claims.IssuedAt+60, claims.ExpiresAt)
+
+	_, err = a.Impersonate(claims, "user3", "", "", ClientInfo{})
+	assert.ErrorIs(t, err, ErrNestedImpersonation)
+}
+
+func TestIntrospectAccessToken(t *testing.T) {
+	dir := t.TempDir()
+	_, err := GenerateKey(dir, AlgRS256, time.Now())
+	assert.NoError(t, err)
+	a := setupAuth(t, dir)
+
+	token, err := a.generateJWT(models.User{Username: "user1", Roles: []string{RoleAdmin, RoleUser}}, grant{}, "")
+	assert.NoError(t, err)
+	result := a.introspect(token)
+	assert.True(t, result.Active)
+	assert.Equal(t, "user1", result.Subject)
+	assert.Equal(t, "user1", result.Username)
+	assert.Equal(t, "admin user", result.Scope)
+	assert.Equal(t, TokenTypeBearer, result.TokenType)
+	assert.Equal(t, "recipemanagement", result.Audience)
+
+	// client credentials tokens have the client as subject and no user
+	token, err = a.generateJWT(models.User{Username: "cl_1", Roles: []string{RoleService}}, grant{clientID: "cl_1", scope: []string{RoleService}}, "")
+	assert.NoError(t, err)
+	result = a.introspect(token)
+	assert.True(t, result.Active)
+	assert.Equal(t, "cl_1", result.ClientID)
+	assert.Equal(t, "service", result.Scope)
+	assert.Empty(t, result.Username)
+
+	assert.Equal(t, Introspection{}, a.introspect(token+"x"))
+}
@@ -0,0 +1,46 @@
+package auth
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	ErrInvalidAudience = errors.New("audience is not allowed")
+	ErrInvalidClaims   = errors.New("token claims are invalid")
+)
+
+// audience returns the requested audience if it is configured, the default audience if none is requested
+func (a *Auth) audience(requested string) (string, error) {
+	if requested == "" && len(a.config.Audiences) > 0 {
+		return a.config.Audiences[0], nil
+	}
+	for _, audience := range a.config.Audiences {
+		if audience == requested {
+			return audience, nil
+		}
+	}
+	return "", ErrInvalidAudience
+}
+
+// verifyClaims checks the registered claims, allowing for clock skew of the configured leeway
+func (a *Auth) verifyClaims(claims *Claims, now time.Time) error {
+	leeway := int64(a.config.Leeway.Seconds())
+	unix := now.Unix()
+	switch {
+	case claims.ExpiresAt == 0 || unix > claims.ExpiresAt+leeway:
+		return errors.New("token is expired")
+	case unix+leeway < claims.NotBefore:
+		return errors.New("token is not valid yet")
+	case unix+leeway < claims.IssuedAt:
+		return errors.New("token used before issued")
+	case claims.Issuer != a.config.Issuer:
+		return ErrInvalidClaims
+	case claims.Subject == "":
+		return ErrInvalidClaims
+	}
+	if _, err := a.audience(claims.Audience); err != nil || claims.Audience == "" {
+		return ErrInvalidAudience
+	}
+	return nil
+}
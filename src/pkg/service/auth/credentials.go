@@ -0,0 +1,173 @@
+package auth
+
+import (
+	"errors"
+	"github.com/BieggerM/userservice/pkg/adapter/out/database"
+	"github.com/BieggerM/userservice/pkg/models"
+	"github.com/sirupsen/logrus"
+)
+
+// Sources of user accounts, stored with each user
+const (
+	SourceLocal = "local"
+	SourceLDAP  = "ldap"
+)
+
+var (
+	// ErrExternalCredentials is returned when changing the password of a user managed by an external directory
+	ErrExternalCredentials = errors.New("password is managed by an external directory")
+	// ErrCredentialBackendUnavailable is returned when an external backend cannot be reached to check a password.
+	// It is not a failed login and does not count towards lockout.
+	ErrCredentialBackendUnavailable = errors.New("credential backend unavailable")
+)
+
+// CredentialVerifier checks passwords against a credential backend
+type CredentialVerifier interface {
+	// Source identifies the backend, users stay bound to the backend they were provisioned from
+	Source() string
+	// Verify checks the password of a login and returns the user as known to the backend.
+	// Unknown logins and wrong passwords both return ErrInvalidCredentials, a backend that
+	// cannot be reached ErrCredentialBackendUnavailable.
+	Verify(login, password string) (models.User, error)
+}
+
+// localVerifier checks passwords against the hashes in the users table
+type localVerifier struct {
+	auth *Auth
+}
+
+func (v *localVerifier) Source() string {
+	return SourceLocal
+}
+
+func (v *localVerifier) Verify(login, password string) (models.User, error) {
+	a := v.auth
+	user, err := a.lookupLogin(login)
+	if err != nil {
+		// verify against a dummy hash so unknown users take as long as wrong passwords
+		VerifyPassword(password, a.dummyHash, a.config.PasswordParams)
+		return models.User{}, ErrInvalidCredentials
+	}
+	match, needsRehash := VerifyPassword(password, user.Password, a.config.PasswordParams)
+	if !match {
+		return models.User{}, ErrInvalidCredentials
+	}
+	if needsRehash {
+		if err := a.rehashPassword(user.Username, password); err != nil {
+			logrus.Errorf("Failed to rehash password of %s: %v", user.Username, err)
+		}
+	}
+	return user, nil
+}
+
+// verifier returns the backend responsible for users of the given source
+func (a *Auth) verifier(source string) CredentialVerifier {
+	if source == "" {
+		source = SourceLocal
+	}
+	for _, v := range a.verifiers {
+		if v.Source() == source {
+			return v
+		}
+	}
+	return nil
+}
+
+// verifyExternal tries the external backends in order for a login unknown to the users table
+// and provisions the user on the first success
+func (a *Auth) verifyExternal(login, password string) (models.User, error) {
+	tried := false
+	for _, v := range a.verifiers {
+		if v.Source() == SourceLocal {
+			continue
+		}
+		tried = true
+		external, err := v.Verify(login, password)
+		if errors.Is(err, ErrInvalidCredentials) {
+			continue
+		}
+		if err != nil {
+			return models.User{}, err
+		}
+		return a.provision(v.Source(), external)
+	}
+	if !tried {
+		// verify against a dummy hash so unknown users take as long as wrong passwords
+		VerifyPassword(password, a.dummyHash, a.config.PasswordParams)
+	}
+	return models.User{}, ErrInvalidCredentials
+}
+
+// provision creates the account of a user on the first login through an external backend.
+// An existing account of another source is never taken over.
+func (a *Auth) provision(source string, external models.User) (models.User, error) {
+	if err := ValidateUsername(external.Username); err != nil {
+		logrus.Warnf("Refusing %s login of %s, the username is reserved for OAuth clients", source, external.Username)
+		return models.User{}, ErrInvalidCredentials
+	}
+	if existing, err := a.DB.GetUser(external.Username); err == nil {
+		if existing.Source != source {
+			logrus.Warnf("Refusing %s login of %s, the username belongs to a %s account", source, external.Username, existing.Source)
+			return models.User{}, ErrInvalidCredentials
+		}
+		return a.syncExternal(existing, external)
+	}
+	external.Source = source
+	external.Password = ""
+	if len(external.Roles) == 0 {
+		external.Roles = DefaultRoles
+	}
+	err := a.DB.SaveUser(external)
+	if errors.Is(err, database.ErrEmailExists) {
+		// the address belongs to another account, the user can set a different one later
+		logrus.Warnf("Provisioning %s without email, %s is already in use", external.Username, external.Email)
+		external.Email = ""
+		err = a.DB.SaveUser(external)
+	}
+	if err != nil {
+		return models.User{}, err
+	}
+	if external.Email != "" {
+		// addresses from the directory are trusted like verified ones
+		err := a.DB.MarkEmailVerified(external.Username)
+		if errors.Is(err, database.ErrEmailExists) {
+			logrus.Warnf("Provisioning %s without email, %s is already in use", external.Username, external.Email)
+			err = a.DB.SetEmail(external.Username, "")
+		}
+		if err != nil {
+			logrus.Errorf("Failed to mark email of %s as verified: %v", external.Username, err)
+		}
+	}
+	logrus.Infof("Provisioned %s user %s", source, external.Username)
+	return a.DB.GetUser(external.Username)
+}
+
+// syncExternal updates names and roles of a provisioned user from the backend
+func (a *Auth) syncExternal(user, external models.User) (models.User, error) {
+	if user.FirstName != external.FirstName || user.LastName != external.LastName {
+		user.FirstName = external.FirstName
+		user.LastName = external.LastName
+		if _, err := a.DB.UpdateUser(user); err != nil {
+			return models.User{}, err
+		}
+	}
+	if len(external.Roles) > 0 && !sameRoles(user.Roles, external.Roles) {
+		if err := a.DB.UpdateRoles(user.Username, external.Roles); err != nil {
+			return models.User{}, err
+		}
+		user.Roles = external.Roles
+	}
+	return user, nil
+}
+
+func sameRoles(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for _, role := range a {
+		if !containsRole(b, role) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,104 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/BieggerM/userservice/pkg/models"
+	"net/mail"
+	"strings"
+	"time"
+)
+
+const purposeEmailVerification = "email_verification"
+
+var (
+	ErrInvalidEmail             = errors.New("invalid email address")
+	ErrEmailAlreadyVerified     = errors.New("email address already verified")
+	ErrInvalidVerificationToken = errors.New("invalid or expired verification token")
+)
+
+// ValidateEmail checks that email is a plain address like "jane@example.com"
+func ValidateEmail(email string) error {
+	address, err := mail.ParseAddress(email)
+	if err != nil || address.Address != email {
+		return ErrInvalidEmail
+	}
+	return nil
+}
+
+// ChangeEmail sets a new, unverified email address and sends a verification token to it.
+// Verification tokens sent to a previous address become invalid.
+func (a *Auth) ChangeEmail(username, email string) error {
+	if err := ValidateEmail(email); err != nil {
+		return err
+	}
+	if err := a.DB.SetEmail(username, email); err != nil {
+		return err
+	}
+	if err := a.DB.InvalidateOneTimeTokens(username, purposeEmailVerification); err != nil {
+		return err
+	}
+	return a.RequestEmailVerification(username)
+}
+
+// RequestEmailVerification publishes a verification token for the email address of the user
+// for delivery by the mail service
+func (a *Auth) RequestEmailVerification(username string) error {
+	user, err := a.DB.GetUser(username)
+	if err != nil {
+		return ErrUserNotFound
+	}
+	if user.Email == "" {
+		return ErrInvalidEmail
+	}
+	if user.EmailVerified {
+		return ErrEmailAlreadyVerified
+	}
+	token, err := randomToken()
+	if err != nil {
+		return err
+	}
+	expiresAt := time.Now().Add(a.config.EmailVerificationTTL)
+	if err := a.DB.SaveOneTimeToken(models.OneTimeToken{
+		TokenHash: hashToken(token),
+		Purpose:   purposeEmailVerification,
+		Username:  username,
+		ExpiresAt: expiresAt,
+	}); err != nil {
+		return err
+	}
+	msgBody, err := json.Marshal(map[string]interface{}{
+		"username":   username,
+		"email":      user.Email,
+		"token":      token,
+		"expires_at": expiresAt.UTC().Format(time.RFC3339),
+	})
+	if err != nil {
+		return err
+	}
+	return a.MB.Publish(eventExchange, "users.email_verification_requested", msgBody)
+}
+
+// VerifyEmail marks the email address of the user the token was sent to as verified.
+// It fails with database.ErrEmailExists if another user has verified the address first.
+func (a *Auth) VerifyEmail(token string) (string, error) {
+	stored, err := a.DB.ConsumeOneTimeToken(hashToken(token), purposeEmailVerification)
+	if err != nil {
+		return "", ErrInvalidVerificationToken
+	}
+	if err := a.DB.MarkEmailVerified(stored.Username); err != nil {
+		return "", err
+	}
+	return stored.Username, nil
+}
+
+// lookupLogin finds the user for a login name, which is either the username or a verified email address
+func (a *Auth) lookupLogin(login string) (models.User, error) {
+	if strings.Contains(login, "@") {
+		user, err := a.DB.GetUserByEmail(login)
+		if err == nil && user.EmailVerified {
+			return user, nil
+		}
+	}
+	return a.DB.GetUser(login)
+}
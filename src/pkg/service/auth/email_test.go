@@ -0,0 +1,93 @@
+package auth
+
+import (
+	"encoding/json"
+	"github.com/BieggerM/userservice/pkg/adapter/out/broker/brokertest"
+	"github.com/BieggerM/userservice/pkg/adapter/out/database"
+	"github.com/BieggerM/userservice/pkg/models"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+// verificationToken returns the latest verification token delivered to the mail service for the user
+func verificationToken(t *testing.T, mb *brokertest.Recorder, username string) string {
+	var token string
+	for _, message := range mb.Messages("users.email_verification_requested") {
+		var event struct {
+			Username string `json:"username"`
+			Token    string `json:"token"`
+		}
+		assert.NoError(t, json.Unmarshal(message.Body, &event))
+		if event.Username == username {
+			token = event.Token
+		}
+	}
+	assert.NotEmpty(t, token)
+	return token
+}
+
+func TestVerifiedEmailIsALogin(t *testing.T) {
+	a, db, mb := setupService(t)
+	assert.NoError(t, a.ChangeEmail("user1", "jane@example.com"))
+
+	// unverified addresses cannot be used to log in
+	_, err := a.Authenticate("jane@example.com", "correct horse", "")
+	assert.ErrorIs(t, err, ErrInvalidCredentials)
+
+	username, err := a.VerifyEmail(verificationToken(t, mb, "user1"))
+	assert.NoError(t, err)
+	assert.Equal(t, "user1", username)
+	user, err := db.GetUser("user1")
+	assert.NoError(t, err)
+	assert.True(t, user.EmailVerified)
+	assert.ErrorIs(t, a.RequestEmailVerification("user1"), ErrEmailAlreadyVerified)
+
+	user, err = a.Authenticate("Jane@Example.com", "correct horse", "")
+	assert.NoError(t, err)
+	assert.Equal(t, "user1", user.Username)
+}
+
+func TestVerificationTokenIsSingleUse(t *testing.T) {
+	a, _, mb := setupService(t)
+	assert.NoError(t, a.ChangeEmail("user1", "jane@example.com"))
+	token := verificationToken(t, mb, "user1")
+	_, err := a.VerifyEmail(token)
+	assert.NoError(t, err)
+	_, err = a.VerifyEmail(token)
+	assert.ErrorIs(t, err, ErrInvalidVerificationToken)
+}
+
+func TestChangedEmailInvalidatesVerification(t *testing.T) {
+	a, db, mb := setupService(t)
+	assert.NoError(t, a.ChangeEmail("user1", "jane@example.com"))
+	first := verificationToken(t, mb, "user1")
+	assert.NoError(t, a.ChangeEmail("user1", "jane.doe@example.com"))
+
+	_, err := a.VerifyEmail(first)
+	assert.ErrorIs(t, err, ErrInvalidVerificationToken)
+	_, err = a.VerifyEmail(verificationToken(t, mb, "user1"))
+	assert.NoError(t, err)
+	user, err := db.GetUser("user1")
+	assert.NoError(t, err)
+	assert.Equal(t, "jane.doe@example.com", user.Email)
+	assert.True(t, user.EmailVerified)
+}
+
+func TestUnverifiedEmailDoesNotBlockItsOwner(t *testing.T) {
+	a, db, mb := setupService(t)
+	assert.NoError(t, db.SaveUser(models.User{Username: "squatter", Roles: []string{RoleUser}}))
+	assert.NoError(t, a.ChangeEmail("squatter", "jane@example.com"))
+
+	// the owner can still claim and verify the address
+	assert.NoError(t, a.ChangeEmail("user1", "JANE@example.com"))
+	_, err := a.VerifyEmail(verificationToken(t, mb, "user1"))
+	assert.NoError(t, err)
+
+	// the first to verify holds the address
+	_, err = a.VerifyEmail(verificationToken(t, mb, "squatter"))
+	assert.ErrorIs(t, err, database.ErrEmailExists)
+	assert.ErrorIs(t, a.ChangeEmail("squatter", "jane@example.com"), database.ErrEmailExists)
+	user, err := a.lookupLogin("jane@example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, "user1", user.Username)
+}
@@ -0,0 +1,125 @@
+package auth
+
+import (
+	"strings"
+	"time"
+)
+
+// Token types reported by introspection. Refresh tokens are only reported as active to the client
+// they were issued to, still resource servers have to check for TokenTypeBearer before granting access.
+const (
+	TokenTypeBearer  = "Bearer"
+	TokenTypeRefresh = "refresh_token"
+)
+
+// Introspection is the response of the introspection endpoint (RFC 7662 section 2.2).
+// Only Active is set for tokens that are unknown, expired or revoked.
+type Introspection struct {
+	Active    bool   `json:"active"`
+	Scope     string `json:"scope,omitempty"`
+	ClientID  string `json:"client_id,omitempty"`
+	Username  string `json:"username,omitempty"`
+	TokenType string `json:"token_type,omitempty"`
+	ExpiresAt int64  `json:"exp,omitempty"`
+	IssuedAt  int64  `json:"iat,omitempty"`
+	NotBefore int64  `json:"nbf,omitempty"`
+	Subject   string `json:"sub,omitempty"`
+	Audience  string `json:"aud,omitempty"`
+	Issuer    string `json:"iss,omitempty"`
+	ID        string `json:"jti,omitempty"`
+	// Actor identifies the admin behind an impersonation token
+	Actor *Actor `json:"act,omitempty"`
+}
+
+// Introspect authenticates the calling client and describes an access token, refresh token or API key.
+// Refresh tokens are no credential for resource servers, so they are inactive for every other client.
+func (a *Auth) Introspect(clientID, clientSecret, token string) (Introspection, error) {
+	client, err := a.authenticateClient(clientID, clientSecret)
+	if err != nil {
+		return Introspection{}, err
+	}
+	if token == "" {
+		return Introspection{}, &OAuthError{ErrCodeInvalidRequest, "token is missing"}
+	}
+	result := a.introspect(token)
+	if result.TokenType == TokenTypeRefresh && result.ClientID != client.ClientID {
+		return Introspection{}, nil
+	}
+	return result, nil
+}
+
+// introspect tells the kind of token by its format, as all of them are opaque to clients.
+// Describing a token is not using it, so the last use of sessions and API keys is left alone.
+func (a *Auth) introspect(token string) Introspection {
+	var claims *Claims
+	var err error
+	switch {
+	case strings.HasPrefix(token, apiKeyPrefix):
+		claims, err = a.checkAPIKey(token)
+	case strings.Count(token, ".") == 2:
+		claims, err = a.checkJWT(token)
+	default:
+		return a.introspectRefreshToken(token)
+	}
+	if err != nil {
+		return Introspection{}
+	}
+	result := Introspection{
+		Active:    true,
+		Scope:     claims.Scope,
+		ClientID:  claims.ClientID,
+		Username:  claims.UserID,
+		TokenType: TokenTypeBearer,
+		ExpiresAt: claims.ExpiresAt,
+		IssuedAt:  claims.IssuedAt,
+		NotBefore: claims.NotBefore,
+		Subject:   claims.Subject,
+		Audience:  claims.Audience,
+		Issuer:    claims.Issuer,
+		ID:        claims.Id,
+		Actor:     claims.Actor,
+	}
+	if result.Scope == "" {
+		// login tokens and API keys grant the roles they carry
+		result.Scope = strings.Join(claims.Roles, " ")
+	}
+	if claims.ClientID != "" && claims.Subject == claims.ClientID {
+		// tokens of the client credentials grant have no user
+		result.Username = ""
+	}
+	return result
+}
+
+// introspectRefreshToken describes a refresh token that can still be exchanged, with the scope it would grant.
+// Like on refresh, roles removed from the user since the token was issued are not reported.
+func (a *Auth) introspectRefreshToken(token string) Introspection {
+	// revoking a session or all tokens of a user marks its refresh tokens as revoked
+	stored, err := a.DB.GetRefreshToken(hashToken(token))
+	if err != nil || stored.Revoked || stored.Used || time.Now().After(stored.ExpiresAt) {
+		return Introspection{}
+	}
+	user, err := a.DB.GetUser(stored.Username)
+	if err != nil {
+		return Introspection{}
+	}
+	roles := user.Roles
+	if stored.Scope != "" {
+		roles = intersectRoles(user.Roles, strings.Fields(stored.Scope))
+	}
+	audience, err := a.audience(stored.Audience)
+	if err != nil {
+		return Introspection{}
+	}
+	return Introspection{
+		Active:    true,
+		Scope:     strings.Join(roles, " "),
+		ClientID:  stored.ClientID,
+		Username:  stored.Username,
+		TokenType: TokenTypeRefresh,
+		ExpiresAt: stored.ExpiresAt.Unix(),
+		IssuedAt:  stored.CreatedAt.Unix(),
+		Subject:   stored.Username,
+		Audience:  audience,
+		Issuer:    a.config.Issuer,
+	}
+}
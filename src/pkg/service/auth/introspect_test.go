@@ -0,0 +1,126 @@
+package auth
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestIntrospectRefreshToken(t *testing.T) {
+	a, db, _ := setupService(t)
+	user, err := db.GetUser("user1")
+	assert.NoError(t, err)
+	pair, err := a.IssueTokens(user, "", ClientInfo{})
+	assert.NoError(t, err)
+
+	result := a.introspect(pair.RefreshToken)
+	assert.True(t, result.Active)
+	assert.Equal(t, TokenTypeRefresh, result.TokenType)
+	assert.Equal(t, "user1", result.Username)
+	assert.Equal(t, "user1", result.Subject)
+	assert.Equal(t, RoleUser, result.Scope)
+	assert.Equal(t, "recipemanagement", result.Audience)
+	assert.Equal(t, "user-service", result.Issuer)
+
+	// a rotated refresh token cannot be exchanged anymore
+	rotated, err := a.RefreshTokens(pair.RefreshToken, ClientInfo{})
+	assert.NoError(t, err)
+	assert.Equal(t, Introspection{}, a.introspect(pair.RefreshToken))
+	assert.True(t, a.introspect(rotated.RefreshToken).Active)
+
+	sessions, err := db.ListSessions("user1")
+	assert.NoError(t, err)
+	assert.Len(t, sessions, 1)
+	assert.NoError(t, a.RevokeSession("user1", sessions[0].ID))
+	assert.Equal(t, Introspection{}, a.introspect(rotated.RefreshToken))
+	assert.Equal(t, Introspection{}, a.introspect(rotated.AccessToken))
+}
+
+func TestRefreshTokensAreOnlyIntrospectedByTheirClient(t *testing.T) {
+	a, db, _ := setupService(t)
+	clientID, secret := saveClient(t, db, GrantPassword, GrantRefreshToken)
+	otherID, otherSecret := saveClient(t, db, GrantClientCredentials)
+	token, err := a.Token(TokenRequest{GrantType: GrantPassword, ClientID: clientID, ClientSecret: secret, Username: "user1", Password: "correct horse"})
+	assert.NoError(t, err)
+	user, err := db.GetUser("user1")
+	assert.NoError(t, err)
+	login, err := a.IssueTokens(user, "", ClientInfo{})
+	assert.NoError(t, err)
+
+	result, err := a.Introspect(clientID, secret, token.RefreshToken)
+	assert.NoError(t, err)
+	assert.True(t, result.Active)
+	assert.Equal(t, TokenTypeRefresh, result.TokenType)
+	for _, refreshToken := range []string{token.RefreshToken, login.RefreshToken} {
+		result, err = a.Introspect(otherID, otherSecret, refreshToken)
+		assert.NoError(t, err)
+		assert.Equal(t, Introspection{}, result)
+	}
+	result, err = a.Introspect(clientID, secret, login.RefreshToken)
+	assert.NoError(t, err)
+	assert.Equal(t, Introspection{}, result)
+
+	// access tokens are described to every client
+	result, err = a.Introspect(otherID, otherSecret, token.AccessToken)
+	assert.NoError(t, err)
+	assert.True(t, result.Active)
+	assert.Equal(t, TokenTypeBearer, result.TokenType)
+}
+
+func TestIntrospectAPIKey(t *testing.T) {
+	a, _, _ := setupService(t)
+	key, secret, err := a.CreateAPIKey("user1", "import", []string{RoleUser}, time.Time{})
+	assert.NoError(t, err)
+
+	result := a.introspect(secret)
+	assert.True(t, result.Active)
+	assert.Equal(t, TokenTypeBearer, result.TokenType)
+	assert.Equal(t, "user1", result.Username)
+	assert.Equal(t, RoleUser, result.Scope)
+	assert.Equal(t, key.ID, result.ID)
+	assert.Zero(t, result.ExpiresAt)
+
+	assert.NoError(t, a.RevokeAPIKey("user1", key.ID))
+	assert.Equal(t, Introspection{}, a.introspect(secret))
+}
+
+func TestIntrospectRevokedTokens(t *testing.T) {
+	a, db, _ := setupService(t)
+	user, err := db.GetUser("user1")
+	assert.NoError(t, err)
+	pair, err := a.IssueTokens(user, "", ClientInfo{})
+	assert.NoError(t, err)
+	_, secret, err := a.CreateAPIKey("user1", "import", nil, time.Time{})
+	assert.NoError(t, err)
+	assert.True(t, a.introspect(pair.AccessToken).Active)
+
+	assert.NoError(t, a.RevokeUserTokens("user1"))
+	for _, token := range []string{pair.AccessToken, pair.RefreshToken, secret} {
+		assert.Equal(t, Introspection{}, a.introspect(token))
+	}
+}
+
+func TestIntrospectionDoesNotRecordUse(t *testing.T) {
+	a, db, _ := setupService(t)
+	user, err := db.GetUser("user1")
+	assert.NoError(t, err)
+	pair, err := a.IssueTokens(user, "", ClientInfo{})
+	assert.NoError(t, err)
+	_, secret, err := a.CreateAPIKey("user1", "import", nil, time.Time{})
+	assert.NoError(t, err)
+
+	for i := 0; i < 3; i++ {
+		assert.True(t, a.introspect(pair.AccessToken).Active)
+		assert.True(t, a.introspect(secret).Active)
+	}
+	assert.Zero(t, db.SessionTouches())
+	assert.Zero(t, db.APIKeyTouches())
+
+	// using them does
+	_, err = a.ValidateToken(pair.AccessToken)
+	assert.NoError(t, err)
+	_, err = a.ValidateToken(secret)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, db.SessionTouches())
+	assert.Equal(t, 1, db.APIKeyTouches())
+}
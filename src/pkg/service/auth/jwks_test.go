@@ -0,0 +1,85 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"github.com/BieggerM/userservice/pkg/models"
+	"github.com/golang-jwt/jwt"
+	"github.com/stretchr/testify/assert"
+	"math/big"
+	"testing"
+	"time"
+)
+
+// publicKeyFromJWK decodes a published key the way a resource server without access to the key directory would
+func publicKeyFromJWK(t *testing.T, jwk map[string]string) crypto.PublicKey {
+	decode := func(member string) []byte {
+		value, err := base64.RawURLEncoding.DecodeString(jwk[member])
+		assert.NoError(t, err, member)
+		return value
+	}
+	switch jwk["kty"] {
+	case "RSA":
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(decode("n")), E: int(new(big.Int).SetBytes(decode("e")).Int64())}
+	case "EC":
+		assert.Equal(t, "P-256", jwk["crv"])
+		x, y := decode("x"), decode("y")
+		assert.Len(t, x, 32)
+		assert.Len(t, y, 32)
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+	case "OKP":
+		assert.Equal(t, "Ed25519", jwk["crv"])
+		return ed25519.PublicKey(decode("x"))
+	}
+	t.Fatalf("unexpected key type %q", jwk["kty"])
+	return nil
+}
+
+func TestTokensVerifyWithPublishedJWKS(t *testing.T) {
+	for algorithm, kty := range map[string]string{AlgRS256: "RSA", AlgPS256: "RSA", AlgES256: "EC", AlgEdDSA: "OKP"} {
+		t.Run(algorithm, func(t *testing.T) {
+			dir := t.TempDir()
+			key, err := GenerateKey(dir, algorithm, time.Now())
+			assert.NoError(t, err)
+			a := setupAuth(t, dir)
+			token, err := a.GenerateJWT(models.User{Username: "user1", Roles: []string{RoleUser}}, "")
+			assert.NoError(t, err)
+
+			// only the serialized document is shared with the verifier
+			body, err := json.Marshal(a.JWKS())
+			assert.NoError(t, err)
+			var set struct {
+				Keys []map[string]string `json:"keys"`
+			}
+			assert.NoError(t, json.Unmarshal(body, &set))
+			assert.Len(t, set.Keys, 1)
+			jwk := set.Keys[0]
+			assert.Equal(t, key.ID, jwk["kid"])
+			assert.Equal(t, algorithm, jwk["alg"])
+			assert.Equal(t, "sig", jwk["use"])
+			assert.Equal(t, kty, jwk["kty"])
+
+			claims := &Claims{}
+			parsed, err := jwt.ParseWithClaims(token, claims, func(token *jwt.Token) (interface{}, error) {
+				for _, jwk := range set.Keys {
+					if jwk["kid"] == token.Header["kid"] {
+						if jwk["alg"] != token.Method.Alg() {
+							return nil, errors.New("algorithm does not match the key")
+						}
+						return publicKeyFromJWK(t, jwk), nil
+					}
+				}
+				return nil, errors.New("unknown kid")
+			})
+			assert.NoError(t, err)
+			assert.True(t, parsed.Valid)
+			assert.Equal(t, "user1", claims.Subject)
+		})
+	}
+}
@@ -0,0 +1,365 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/golang-jwt/jwt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	keyFileExt      = ".pem"
+	keyBlockType    = "PRIVATE KEY"
+	createdHeader   = "Created"
+	algorithmHeader = "Algorithm"
+	rsaKeyBits      = 2048
+)
+
+// KeyPublishDelay is how long a new key is published in the JWKS before it signs tokens.
+// It exceeds the time verifiers may cache the JWKS (5 minutes) plus the key reload interval,
+// so every verifier knows a key before the first token signed by it arrives.
+const KeyPublishDelay = 10 * time.Minute
+
+// Signing algorithms a key can be generated for
+const (
+	AlgRS256 = "RS256"
+	AlgPS256 = "PS256"
+	AlgES256 = "ES256"
+	AlgEdDSA = "EdDSA"
+)
+
+// SigningKey is a private key used to sign tokens, identified by its kid.
+// Every key signs with exactly one algorithm, tokens claiming another one are rejected.
+type SigningKey struct {
+	ID         string
+	Created    time.Time
+	Algorithm  string
+	PrivateKey crypto.Signer
+}
+
+// PublicKey returns the key verifying the signatures of the key
+func (k SigningKey) PublicKey() crypto.PublicKey {
+	return k.PrivateKey.Public()
+}
+
+// KeyRing holds all signing keys found in a key directory.
+// The newest key that has been published for KeyPublishDelay signs new tokens, older keys are
+// kept for verification until every token they may have signed has expired.
+type KeyRing struct {
+	dir  string
+	mu   sync.RWMutex
+	keys []SigningKey
+}
+
+// LoadKeyRing reads all keys from the given directory
+func LoadKeyRing(dir string) (*KeyRing, error) {
+	k := &KeyRing{dir: dir}
+	if err := k.Reload(); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// Reload re-reads the key directory, picking up keys added or removed by a rotation
+func (k *KeyRing) Reload() error {
+	keys, err := readKeys(k.dir)
+	if err != nil {
+		return err
+	}
+	k.mu.Lock()
+	k.keys = keys
+	k.mu.Unlock()
+	return nil
+}
+
+// Active returns the key used to sign new tokens
+func (k *KeyRing) Active(now time.Time) (SigningKey, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	for i := len(k.keys) - 1; i >= 0; i-- {
+		if !now.Before(activatesAt(k.keys, i)) {
+			return k.keys[i], nil
+		}
+	}
+	return SigningKey{}, errors.New("no signing key available")
+}
+
+// Newest returns the most recently created key, which may not sign tokens yet
+func (k *KeyRing) Newest() (SigningKey, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	if len(k.keys) == 0 {
+		return SigningKey{}, errors.New("no signing key available")
+	}
+	return k.keys[len(k.keys)-1], nil
+}
+
+// activatesAt returns when the i-th of the keys sorted by age starts signing tokens.
+// The oldest key signs right away, as it has no predecessor that verifiers could still rely on.
+func activatesAt(keys []SigningKey, i int) time.Time {
+	if i == 0 {
+		return keys[0].Created
+	}
+	return keys[i].Created.Add(KeyPublishDelay)
+}
+
+// retired reports whether every token the i-th key may have signed has expired,
+// which is tokenTTL after its successor took over
+func retired(keys []SigningKey, i int, tokenTTL time.Duration, now time.Time) bool {
+	return i < len(keys)-1 && !now.Before(activatesAt(keys, i+1).Add(tokenTTL))
+}
+
+// Lookup returns the key with the given kid if it may still verify tokens
+func (k *KeyRing) Lookup(kid string, tokenTTL time.Duration, now time.Time) (SigningKey, bool) {
+	for _, key := range k.VerificationKeys(tokenTTL, now) {
+		if key.ID == kid {
+			return key, true
+		}
+	}
+	return SigningKey{}, false
+}
+
+// VerificationKeys returns all keys that may still have valid tokens in circulation
+func (k *KeyRing) VerificationKeys(tokenTTL time.Duration, now time.Time) []SigningKey {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	var keys []SigningKey
+	// keys that do not sign yet are published as well
+	for i, key := range k.keys {
+		if !retired(k.keys, i, tokenTTL, now) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// GenerateKey creates a new signing key for the algorithm in the key directory
+func GenerateKey(dir, algorithm string, now time.Time) (SigningKey, error) {
+	privateKey, err := generatePrivateKey(algorithm)
+	if err != nil {
+		return SigningKey{}, fmt.Errorf("failed to generate private key: %w", err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		return SigningKey{}, fmt.Errorf("failed to marshal private key: %w", err)
+	}
+	key := SigningKey{
+		ID:         keyID(privateKey.Public()),
+		Created:    now.UTC().Truncate(time.Second),
+		Algorithm:  algorithm,
+		PrivateKey: privateKey,
+	}
+	block := &pem.Block{
+		Type: keyBlockType,
+		Headers: map[string]string{
+			createdHeader:   key.Created.Format(time.RFC3339),
+			algorithmHeader: key.Algorithm,
+		},
+		Bytes: der,
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return SigningKey{}, fmt.Errorf("failed to create key directory: %w", err)
+	}
+	// replicas reading the directory meanwhile must not see a partially written key
+	path := filepath.Join(dir, key.ID+keyFileExt)
+	if err := os.WriteFile(path+".tmp", pem.EncodeToMemory(block), 0600); err != nil {
+		return SigningKey{}, fmt.Errorf("failed to write key file: %w", err)
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return SigningKey{}, fmt.Errorf("failed to write key file: %w", err)
+	}
+	return key, nil
+}
+
+func generatePrivateKey(algorithm string) (crypto.Signer, error) {
+	switch algorithm {
+	case AlgRS256, AlgPS256:
+		return rsa.GenerateKey(rand.Reader, rsaKeyBits)
+	case AlgES256:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case AlgEdDSA:
+		_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+		return privateKey, err
+	default:
+		return nil, fmt.Errorf("unsupported signing algorithm %q", algorithm)
+	}
+}
+
+// RotateKeys generates a new key for the algorithm, which signs tokens after KeyPublishDelay,
+// and removes keys whose tokens have all expired. It returns the new key and the ids of the removed keys.
+func RotateKeys(dir, algorithm string, tokenTTL time.Duration, now time.Time) (SigningKey, []string, error) {
+	key, err := GenerateKey(dir, algorithm, now)
+	if err != nil {
+		return SigningKey{}, nil, err
+	}
+	removed, err := PruneKeys(dir, tokenTTL, now)
+	return key, removed, err
+}
+
+// PruneKeys removes retired keys that can no longer have valid tokens in circulation
+func PruneKeys(dir string, tokenTTL time.Duration, now time.Time) ([]string, error) {
+	keys, err := readKeys(dir)
+	if err != nil {
+		return nil, err
+	}
+	var removed []string
+	for i := 0; i < len(keys)-1; i++ {
+		if !retired(keys, i, tokenTTL, now) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, keys[i].ID+keyFileExt)); err != nil {
+			return removed, fmt.Errorf("failed to remove key %s: %w", keys[i].ID, err)
+		}
+		removed = append(removed, keys[i].ID)
+	}
+	return removed, nil
+}
+
+// readKeys parses all key files in dir, sorted from oldest to newest
+func readKeys(dir string) ([]SigningKey, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read key directory: %w", err)
+	}
+	var keys []SigningKey
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), keyFileExt) {
+			continue
+		}
+		key, err := readKey(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].Created.Before(keys[j].Created)
+	})
+	return keys, nil
+}
+
+func readKey(path string) (SigningKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return SigningKey{}, fmt.Errorf("failed to read key file %s: %w", path, err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return SigningKey{}, fmt.Errorf("no PEM data found in %s", path)
+	}
+	var parsed interface{}
+	switch block.Type {
+	case keyBlockType:
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		parsed, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		return SigningKey{}, fmt.Errorf("unsupported PEM block %q in %s", block.Type, path)
+	}
+	if err != nil {
+		return SigningKey{}, fmt.Errorf("failed to parse key file %s: %w", path, err)
+	}
+	privateKey, ok := parsed.(crypto.Signer)
+	if !ok {
+		return SigningKey{}, fmt.Errorf("key file %s does not contain a signing key", path)
+	}
+
+	// keys without an Algorithm header (e.g. generated with openssl) use the default algorithm of their type
+	algorithm, ok := block.Headers[algorithmHeader]
+	if !ok {
+		algorithm = defaultAlgorithm(privateKey)
+	}
+	if err := checkAlgorithm(privateKey, algorithm); err != nil {
+		return SigningKey{}, fmt.Errorf("key file %s: %w", path, err)
+	}
+
+	// keys without a Created header (e.g. generated with openssl) fall back to the file time
+	created := time.Time{}
+	if value, ok := block.Headers[createdHeader]; ok {
+		if created, err = time.Parse(time.RFC3339, value); err != nil {
+			return SigningKey{}, fmt.Errorf("invalid %s header in %s: %w", createdHeader, path, err)
+		}
+	} else if info, err := os.Stat(path); err == nil {
+		created = info.ModTime().UTC().Truncate(time.Second)
+	}
+
+	return SigningKey{
+		ID:         strings.TrimSuffix(filepath.Base(path), keyFileExt),
+		Created:    created,
+		Algorithm:  algorithm,
+		PrivateKey: privateKey,
+	}, nil
+}
+
+func defaultAlgorithm(privateKey crypto.Signer) string {
+	switch privateKey.(type) {
+	case *ecdsa.PrivateKey:
+		return AlgES256
+	case ed25519.PrivateKey:
+		return AlgEdDSA
+	default:
+		return AlgRS256
+	}
+}
+
+// checkAlgorithm verifies that the key type fits the algorithm, ES256 requires a P-256 key
+func checkAlgorithm(privateKey crypto.Signer, algorithm string) error {
+	var ok bool
+	switch algorithm {
+	case AlgRS256, AlgPS256:
+		_, ok = privateKey.(*rsa.PrivateKey)
+	case AlgES256:
+		ecKey, isEC := privateKey.(*ecdsa.PrivateKey)
+		ok = isEC && ecKey.Curve == elliptic.P256()
+	case AlgEdDSA:
+		_, ok = privateKey.(ed25519.PrivateKey)
+	default:
+		return fmt.Errorf("unsupported signing algorithm %q", algorithm)
+	}
+	if !ok {
+		return fmt.Errorf("key type does not fit signing algorithm %s", algorithm)
+	}
+	return nil
+}
+
+// signingMethod returns the jwt implementation of a supported algorithm
+func signingMethod(algorithm string) jwt.SigningMethod {
+	switch algorithm {
+	case AlgRS256:
+		return jwt.SigningMethodRS256
+	case AlgPS256:
+		return jwt.SigningMethodPS256
+	case AlgES256:
+		return jwt.SigningMethodES256
+	case AlgEdDSA:
+		return jwt.SigningMethodEdDSA
+	}
+	return nil
+}
+
+// keyID derives a stable kid from the public key
+func keyID(publicKey crypto.PublicKey) string {
+	der, _ := x509.MarshalPKIXPublicKey(publicKey)
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:8])
+}
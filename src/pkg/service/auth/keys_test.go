@@ -0,0 +1,136 @@
+package auth
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"github.com/BieggerM/userservice/pkg/adapter/out/database/databasetest"
+	"github.com/BieggerM/userservice/pkg/models"
+	"github.com/golang-jwt/jwt"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var algorithms = []string{AlgRS256, AlgPS256, AlgES256, AlgEdDSA}
+
+func TestSigningAlgorithms(t *testing.T) {
+	for _, algorithm := range algorithms {
+		t.Run(algorithm, func(t *testing.T) {
+			dir := t.TempDir()
+			_, err := GenerateKey(dir, algorithm, time.Now())
+			assert.NoError(t, err)
+			a := setupAuth(t, dir)
+
+			token, err := a.GenerateJWT(models.User{Username: "user1"}, "")
+			assert.NoError(t, err)
+			parsed, _, err := new(jwt.Parser).ParseUnverified(token, &Claims{})
+			assert.NoError(t, err)
+			assert.Equal(t, algorithm, parsed.Header["alg"])
+
+			claims, err := setupAuth(t, dir).ValidateJWT(token)
+			assert.NoError(t, err)
+			assert.Equal(t, "user1", claims.UserID)
+			assert.Equal(t, algorithm, a.JWKS().Keys[0].Alg)
+		})
+	}
+}
+
+func TestAlgorithmIsPinnedPerKey(t *testing.T) {
+	dir := t.TempDir()
+	key, err := GenerateKey(dir, AlgRS256, time.Now())
+	assert.NoError(t, err)
+	a := setupAuth(t, dir)
+	claims := &Claims{StandardClaims: jwt.StandardClaims{
+		Subject:   "user1",
+		Issuer:    "user-service",
+		Audience:  "recipemanagement",
+		IssuedAt:  time.Now().Unix(),
+		ExpiresAt: time.Now().Add(time.Minute).Unix(),
+	}, UserID: "user1"}
+
+	// a valid signature of the right key with another algorithm than the key is pinned to
+	token := jwt.NewWithClaims(jwt.SigningMethodPS256, claims)
+	token.Header["kid"] = key.ID
+	signed, err := token.SignedString(key.PrivateKey)
+	assert.NoError(t, err)
+	_, err = a.ValidateJWT(signed)
+	assert.Error(t, err)
+
+	// the public key used as HMAC secret, the classic algorithm confusion attack
+	der, err := x509.MarshalPKIXPublicKey(key.PublicKey())
+	assert.NoError(t, err)
+	token = jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	token.Header["kid"] = key.ID
+	signed, err = token.SignedString(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+	assert.NoError(t, err)
+	_, err = a.ValidateJWT(signed)
+	assert.Error(t, err)
+}
+
+func TestAlgorithmMustFitKey(t *testing.T) {
+	dir := t.TempDir()
+	key, err := GenerateKey(dir, AlgRS256, time.Now())
+	assert.NoError(t, err)
+	path := filepath.Join(dir, key.ID+keyFileExt)
+	data, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	block, _ := pem.Decode(data)
+	block.Headers[algorithmHeader] = AlgES256
+	assert.NoError(t, os.WriteFile(path, pem.EncodeToMemory(block), 0600))
+
+	_, err = LoadKeyRing(dir)
+	assert.Error(t, err)
+}
+
+func BenchmarkGenerateJWT(b *testing.B) {
+	for _, algorithm := range algorithms {
+		b.Run(algorithm, func(b *testing.B) {
+			a := benchmarkAuth(b, algorithm)
+			user := models.User{Username: "user1", Roles: []string{RoleUser}}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := a.generateJWT(user, grant{}, ""); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkValidateJWT(b *testing.B) {
+	for _, algorithm := range algorithms {
+		b.Run(algorithm, func(b *testing.B) {
+			a := benchmarkAuth(b, algorithm)
+			token, err := a.GenerateJWT(models.User{Username: "user1", Roles: []string{RoleUser}}, "")
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := a.ValidateJWT(token); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func benchmarkAuth(b *testing.B, algorithm string) *Auth {
+	dir := b.TempDir()
+	if _, err := GenerateKey(dir, algorithm, time.Now()); err != nil {
+		b.Fatal(err)
+	}
+	keys, err := LoadKeyRing(dir)
+	if err != nil {
+		b.Fatal(err)
+	}
+	// GenerateJWT looks up whether the user has two-factor authentication
+	return &Auth{DB: databasetest.NewMemory(), keys: keys, config: Config{
+		TokenTTL:  time.Hour,
+		Issuer:    "user-service",
+		Audiences: []string{"recipemanagement"},
+		Leeway:    time.Minute,
+	}}
+}
@@ -0,0 +1,203 @@
+package auth
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/BieggerM/userservice/pkg/adapter/out/ldap"
+	"github.com/BieggerM/userservice/pkg/models"
+	"github.com/sirupsen/logrus"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// LDAPConfig holds the settings of the LDAP credential backend
+type LDAPConfig struct {
+	// URL of the directory server, ldap:// or ldaps://
+	URL string
+	// StartTLS upgrades ldap:// connections to TLS before binding
+	StartTLS bool
+	// AllowPlaintext permits ldap:// without StartTLS, sending passwords in the clear
+	AllowPlaintext bool
+	// TLSConfig verifies the certificate of the server, against the system roots if nil
+	TLSConfig *tls.Config
+	// BindDN and BindPassword are the service account used to search for users, empty for anonymous searches
+	BindDN       string
+	BindPassword string
+	// BaseDN is the subtree containing the users
+	BaseDN string
+	// UserFilter finds the entry of a login, %s is replaced with the escaped login. Defaults to (uid=%s).
+	UserFilter string
+	// UsernameAttribute, FirstNameAttribute, LastNameAttribute and EmailAttribute map entries
+	// to users, uid, givenName, sn and mail if unset
+	UsernameAttribute  string
+	FirstNameAttribute string
+	LastNameAttribute  string
+	EmailAttribute     string
+	// GroupAttribute lists the groups of an entry, memberOf if unset
+	GroupAttribute string
+	// RoleGroups maps the admin and service roles to group DNs. If set, the directory is
+	// authoritative for the roles of its users, otherwise they get DefaultRoles on their first login.
+	RoleGroups map[string]string
+	// Timeout bounds connecting and every operation, 5 seconds if unset
+	Timeout time.Duration
+}
+
+// LDAPVerifier checks passwords with a simple bind as the directory entry of a login
+type LDAPVerifier struct {
+	config LDAPConfig
+}
+
+// NewLDAPVerifier checks the configuration and fills in defaults
+func NewLDAPVerifier(config LDAPConfig) (*LDAPVerifier, error) {
+	if config.URL == "" || config.BaseDN == "" {
+		return nil, errors.New("ldap url and base dn are required")
+	}
+	u, err := url.Parse(config.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ldap url: %w", err)
+	}
+	switch {
+	case u.Scheme == "ldaps" && config.StartTLS:
+		return nil, errors.New("starttls is only used with ldap:// urls, ldaps:// connections are encrypted already")
+	case u.Scheme == "ldap" && !config.StartTLS && !config.AllowPlaintext:
+		return nil, errors.New("refusing to send passwords to ldap:// in plaintext, use ldaps://, enable starttls or explicitly allow plaintext")
+	case u.Scheme == "ldap" && !config.StartTLS:
+		logrus.Warnf("LDAP passwords are sent to %s IN PLAINTEXT, use ldaps:// or StartTLS", config.URL)
+	case u.Scheme != "ldap" && u.Scheme != "ldaps":
+		return nil, fmt.Errorf("unsupported ldap url scheme %q", u.Scheme)
+	}
+	if config.UserFilter == "" {
+		config.UserFilter = "(uid=%s)"
+	}
+	if strings.Count(config.UserFilter, "%s") != 1 {
+		return nil, fmt.Errorf("ldap user filter must contain %%s exactly once: %q", config.UserFilter)
+	}
+	if err := ldap.ValidateFilter(strings.Replace(config.UserFilter, "%s", "login", 1)); err != nil {
+		return nil, err
+	}
+	for role := range config.RoleGroups {
+		if role != RoleAdmin && role != RoleService {
+			return nil, fmt.Errorf("ldap groups can only be mapped to the admin and service roles, not %q", role)
+		}
+	}
+	if config.UsernameAttribute == "" {
+		config.UsernameAttribute = "uid"
+	}
+	if config.FirstNameAttribute == "" {
+		config.FirstNameAttribute = "givenName"
+	}
+	if config.LastNameAttribute == "" {
+		config.LastNameAttribute = "sn"
+	}
+	if config.EmailAttribute == "" {
+		config.EmailAttribute = "mail"
+	}
+	if config.GroupAttribute == "" {
+		config.GroupAttribute = "memberOf"
+	}
+	if config.Timeout == 0 {
+		config.Timeout = 5 * time.Second
+	}
+	return &LDAPVerifier{config: config}, nil
+}
+
+func (v *LDAPVerifier) Source() string {
+	return SourceLDAP
+}
+
+// Verify finds the entry of the login with the service account and binds as that entry with the password.
+// Failures other than wrong credentials mean the password could not be checked and return
+// ErrCredentialBackendUnavailable.
+func (v *LDAPVerifier) Verify(login, password string) (models.User, error) {
+	user, err := v.verify(login, password)
+	if err != nil && !errors.Is(err, ErrInvalidCredentials) {
+		logrus.Errorf("LDAP login of %s failed: %v", login, err)
+		return models.User{}, fmt.Errorf("%w: %v", ErrCredentialBackendUnavailable, err)
+	}
+	return user, err
+}
+
+func (v *LDAPVerifier) verify(login, password string) (models.User, error) {
+	// an empty password would be an unauthenticated bind, which most servers accept
+	if password == "" || login == "" {
+		return models.User{}, ErrInvalidCredentials
+	}
+	client, err := ldap.Dial(v.config.URL, ldap.Options{
+		Timeout:   v.config.Timeout,
+		StartTLS:  v.config.StartTLS,
+		TLSConfig: v.config.TLSConfig,
+	})
+	if err != nil {
+		return models.User{}, fmt.Errorf("failed to connect to ldap server: %w", err)
+	}
+	defer client.Close()
+	if v.config.BindDN != "" {
+		if err := client.Bind(v.config.BindDN, v.config.BindPassword); err != nil {
+			return models.User{}, fmt.Errorf("failed to bind ldap service account: %w", err)
+		}
+	}
+	entries, err := client.Search(ldap.SearchRequest{
+		BaseDN: v.config.BaseDN,
+		Filter: strings.Replace(v.config.UserFilter, "%s", ldap.EscapeFilter(login), 1),
+		Attributes: []string{
+			v.config.UsernameAttribute,
+			v.config.FirstNameAttribute,
+			v.config.LastNameAttribute,
+			v.config.EmailAttribute,
+			v.config.GroupAttribute,
+		},
+	})
+	if err != nil {
+		return models.User{}, fmt.Errorf("failed to search ldap user: %w", err)
+	}
+	if len(entries) != 1 {
+		if len(entries) > 1 {
+			logrus.Warnf("LDAP user filter matches %d entries for %s", len(entries), login)
+		}
+		return models.User{}, ErrInvalidCredentials
+	}
+	entry := entries[0]
+	if err := client.Bind(entry.DN, password); err != nil {
+		if errors.Is(err, ldap.ErrInvalidCredentials) {
+			return models.User{}, ErrInvalidCredentials
+		}
+		return models.User{}, fmt.Errorf("failed to bind ldap user: %w", err)
+	}
+	user := v.mapEntry(entry)
+	if user.Username == "" {
+		return models.User{}, fmt.Errorf("ldap entry %s has no %s attribute", entry.DN, v.config.UsernameAttribute)
+	}
+	return user, nil
+}
+
+// mapEntry converts a directory entry into a user
+func (v *LDAPVerifier) mapEntry(entry ldap.Entry) models.User {
+	user := models.User{
+		Username:  entry.Get(v.config.UsernameAttribute),
+		FirstName: entry.Get(v.config.FirstNameAttribute),
+		LastName:  entry.Get(v.config.LastNameAttribute),
+		Email:     entry.Get(v.config.EmailAttribute),
+		Source:    SourceLDAP,
+	}
+	if len(v.config.RoleGroups) == 0 {
+		return user
+	}
+	groups := entry.Values(v.config.GroupAttribute)
+	user.Roles = append(user.Roles, DefaultRoles...)
+	// a fixed order keeps the roles stable across logins
+	for _, role := range []string{RoleAdmin, RoleService} {
+		group, ok := v.config.RoleGroups[role]
+		if !ok {
+			continue
+		}
+		for _, g := range groups {
+			if strings.EqualFold(g, group) {
+				user.Roles = append(user.Roles, role)
+				break
+			}
+		}
+	}
+	return user
+}
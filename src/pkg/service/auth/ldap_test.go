@@ -0,0 +1,152 @@
+package auth
+
+import (
+	"github.com/BieggerM/userservice/pkg/adapter/out/ldap/ldaptest"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+var ldapEntries = []ldaptest.Entry{
+	{DN: "cn=service,dc=example,dc=com", Password: "service-secret"},
+	{DN: "uid=jdoe,ou=people,dc=example,dc=com", Password: "correct horse", Attributes: map[string][]string{
+		"uid":       {"jdoe"},
+		"givenName": {"John"},
+		"sn":        {"Doe"},
+		"mail":      {"jdoe@example.com"},
+		"memberOf":  {"cn=admins,ou=groups,dc=example,dc=com"},
+	}},
+	{DN: "uid=asmith,ou=people,dc=example,dc=com", Password: "battery staple", Attributes: map[string][]string{
+		"uid": {"asmith"},
+	}},
+}
+
+// ldapConfig points to the server, upgrading ldap:// connections with StartTLS
+func ldapConfig(server *ldaptest.Server) LDAPConfig {
+	return LDAPConfig{
+		URL:          server.URL,
+		StartTLS:     strings.HasPrefix(server.URL, "ldap://"),
+		TLSConfig:    server.ClientTLSConfig(),
+		BindDN:       "cn=service,dc=example,dc=com",
+		BindPassword: "service-secret",
+		BaseDN:       "ou=people,dc=example,dc=com",
+		RoleGroups:   map[string]string{RoleAdmin: "cn=admins,ou=groups,dc=example,dc=com"},
+	}
+}
+
+func setupLDAP(t *testing.T) *LDAPVerifier {
+	server := ldaptest.NewServer(ldapEntries...)
+	t.Cleanup(server.Close)
+	verifier, err := NewLDAPVerifier(ldapConfig(server))
+	assert.NoError(t, err)
+	return verifier
+}
+
+func TestLDAPVerifierMapsEntry(t *testing.T) {
+	verifier := setupLDAP(t)
+
+	user, err := verifier.Verify("jdoe", "correct horse")
+	assert.NoError(t, err)
+	assert.Equal(t, "jdoe", user.Username)
+	assert.Equal(t, "John", user.FirstName)
+	assert.Equal(t, "Doe", user.LastName)
+	assert.Equal(t, "jdoe@example.com", user.Email)
+	assert.Equal(t, SourceLDAP, user.Source)
+	assert.Equal(t, []string{RoleUser, RoleAdmin}, user.Roles)
+
+	user, err = verifier.Verify("asmith", "battery staple")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{RoleUser}, user.Roles)
+}
+
+func TestLDAPVerifierRejectsInvalidCredentials(t *testing.T) {
+	verifier := setupLDAP(t)
+
+	for _, tc := range []struct{ name, login, password string }{
+		{"wrong password", "jdoe", "wrong"},
+		{"unknown login", "nobody", "correct horse"},
+		// the server accepts an empty password as unauthenticated bind
+		{"empty password", "jdoe", ""},
+		// escaped, the filter looks for a uid containing these characters
+		{"filter injection", "jd*", "correct horse"},
+		{"filter injection", "jdoe)(uid=*", "correct horse"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := verifier.Verify(tc.login, tc.password)
+			assert.ErrorIs(t, err, ErrInvalidCredentials)
+		})
+	}
+}
+
+func TestLDAPVerifierUsesTLS(t *testing.T) {
+	server := ldaptest.NewTLSServer(ldapEntries...)
+	t.Cleanup(server.Close)
+	verifier, err := NewLDAPVerifier(ldapConfig(server))
+	assert.NoError(t, err)
+	_, err = verifier.Verify("jdoe", "correct horse")
+	assert.NoError(t, err)
+
+	// a certificate that cannot be verified means the password is not sent
+	verifier.config.TLSConfig = nil
+	_, err = verifier.Verify("jdoe", "correct horse")
+	assert.ErrorIs(t, err, ErrCredentialBackendUnavailable)
+
+	plain := ldaptest.NewServer(ldapEntries...)
+	t.Cleanup(plain.Close)
+	verifier, err = NewLDAPVerifier(ldapConfig(plain))
+	assert.NoError(t, err)
+	verifier.config.TLSConfig = nil
+	_, err = verifier.Verify("jdoe", "correct horse")
+	assert.ErrorIs(t, err, ErrCredentialBackendUnavailable)
+}
+
+func TestLDAPVerifierRefusesPlaintext(t *testing.T) {
+	server := ldaptest.NewServer(ldapEntries...)
+	t.Cleanup(server.Close)
+	config := ldapConfig(server)
+	config.StartTLS = false
+	_, err := NewLDAPVerifier(config)
+	assert.Error(t, err)
+
+	config.AllowPlaintext = true
+	verifier, err := NewLDAPVerifier(config)
+	assert.NoError(t, err)
+	_, err = verifier.Verify("jdoe", "correct horse")
+	assert.NoError(t, err)
+
+	tlsServer := ldaptest.NewTLSServer()
+	t.Cleanup(tlsServer.Close)
+	config = ldapConfig(tlsServer)
+	config.StartTLS = true
+	_, err = NewLDAPVerifier(config)
+	assert.Error(t, err)
+}
+
+func TestLDAPVerifierReportsUnreachableServer(t *testing.T) {
+	verifier := setupLDAP(t)
+	verifier.config.URL = "ldap://127.0.0.1:1"
+
+	_, err := verifier.Verify("jdoe", "correct horse")
+	assert.ErrorIs(t, err, ErrCredentialBackendUnavailable)
+	assert.NotErrorIs(t, err, ErrInvalidCredentials)
+}
+
+func TestUnreachableLDAPDoesNotLockOut(t *testing.T) {
+	verifier := setupLDAP(t)
+	a, db, _ := setupService(t)
+	a.verifiers = append(a.verifiers, verifier)
+	_, err := a.Authenticate("jdoe", "correct horse", "192.0.2.1")
+	assert.NoError(t, err)
+
+	verifier.config.URL = "ldap://127.0.0.1:1"
+	for i := 0; i < 2*maxFailedLogins; i++ {
+		for _, login := range []string{"jdoe", "asmith"} {
+			_, err := a.Authenticate(login, "correct horse", "192.0.2.1")
+			assert.ErrorIs(t, err, ErrCredentialBackendUnavailable)
+		}
+	}
+	state, err := db.GetLoginState("jdoe")
+	assert.NoError(t, err)
+	assert.Zero(t, state.FailedLogins)
+	assert.True(t, state.LockedUntil.IsZero())
+}
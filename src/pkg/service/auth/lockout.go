@@ -0,0 +1,205 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// accountFreeAttempts failed logins are allowed before each further failure delays the next attempt
+	accountFreeAttempts = 3
+	// maxFailedLogins consecutive failures lock the account for lockoutDuration
+	maxFailedLogins = 10
+	lockoutDuration = 15 * time.Minute
+	// ipFreeAttempts is higher than for accounts, as several users may share an address
+	ipFreeAttempts = 20
+	maxBackoff     = 15 * time.Minute
+	// requestFreeAttempts password reset or login link requests per login are sent without delay,
+	// further ones are delayed like failed logins, so the service cannot be used to flood mailboxes
+	requestFreeAttempts = 3
+	// maxTrackedKeys bounds the memory used for per address and per login counters of a throttle
+	maxTrackedKeys = 10000
+
+	eventExchange = "recipemanagement"
+)
+
+// ErrInvalidCredentials is returned for unknown users and wrong passwords alike
+var ErrInvalidCredentials = errors.New("invalid credentials")
+
+// LockedError is returned while an account or client address has to wait before the next login attempt
+type LockedError struct {
+	Until time.Time
+}
+
+func (e *LockedError) Error() string {
+	return "too many failed login attempts"
+}
+
+// RetryAfter returns the time until the next login attempt is allowed
+func (e *LockedError) RetryAfter(now time.Time) time.Duration {
+	return e.Until.Sub(now).Round(time.Second)
+}
+
+// ThrottledError is returned while a login or client address has to wait before the next request
+type ThrottledError struct {
+	Until time.Time
+}
+
+func (e *ThrottledError) Error() string {
+	return "too many requests"
+}
+
+// RetryAfter returns the time until the next request is allowed
+func (e *ThrottledError) RetryAfter(now time.Time) time.Duration {
+	return e.Until.Sub(now).Round(time.Second)
+}
+
+// backoff returns the delay before the next attempt after the given number of consecutive failures
+func backoff(failures, freeAttempts int) time.Duration {
+	if failures < freeAttempts {
+		return 0
+	}
+	exponent := failures - freeAttempts
+	if exponent > 10 {
+		return maxBackoff
+	}
+	delay := time.Second << exponent
+	if delay > maxBackoff {
+		return maxBackoff
+	}
+	return delay
+}
+
+// throttle counts failed attempts per key in memory, such as a client address or a login
+type throttle struct {
+	freeAttempts int
+	// lockAfter consecutive failures block the key for lockoutDuration, 0 never locks
+	lockAfter int
+	mu        sync.Mutex
+	attempts  map[string]*attempts
+}
+
+type attempts struct {
+	failures     int
+	blockedUntil time.Time
+	lastFailure  time.Time
+}
+
+func newThrottle(freeAttempts, lockAfter int) *throttle {
+	return &throttle{freeAttempts: freeAttempts, lockAfter: lockAfter, attempts: make(map[string]*attempts)}
+}
+
+// blockedUntil returns the time until which the key may not be used for another attempt
+func (t *throttle) blockedUntil(key string, now time.Time) (time.Time, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if attempts, ok := t.attempts[key]; ok && now.Before(attempts.blockedUntil) {
+		return attempts.blockedUntil, true
+	}
+	return time.Time{}, false
+}
+
+func (t *throttle) fail(key string, now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.attempts) >= maxTrackedKeys {
+		t.sweep(now)
+	}
+	a, ok := t.attempts[key]
+	if !ok {
+		a = &attempts{}
+		t.attempts[key] = a
+	}
+	a.failures++
+	a.lastFailure = now
+	if t.lockAfter > 0 && a.failures >= t.lockAfter {
+		// like an account lockout, which starts counting anew
+		a.blockedUntil = now.Add(lockoutDuration)
+		a.failures = 0
+		return
+	}
+	a.blockedUntil = now.Add(backoff(a.failures, t.freeAttempts))
+}
+
+func (t *throttle) succeed(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.attempts, key)
+}
+
+// sweep forgets keys without failures for longer than the maximum backoff
+func (t *throttle) sweep(now time.Time) {
+	for key, attempts := range t.attempts {
+		if now.Sub(attempts.lastFailure) > maxBackoff {
+			delete(t.attempts, key)
+		}
+	}
+}
+
+// recordFailure counts a failed login of an existing account, delays the next attempt
+// and locks the account once maxFailedLogins is reached
+func (a *Auth) recordFailure(username string, now time.Time) {
+	failures, err := a.DB.RecordFailedLogin(username)
+	if err != nil {
+		logrus.Errorf("Failed to record failed login of %s: %v", username, err)
+		return
+	}
+	if failures >= maxFailedLogins {
+		until := now.Add(lockoutDuration)
+		if err := a.DB.LockUser(username, until, true); err != nil {
+			logrus.Errorf("Failed to lock user %s: %v", username, err)
+			return
+		}
+		a.publishLocked(username, until, failures)
+		return
+	}
+	if delay := backoff(failures, accountFreeAttempts); delay > 0 {
+		if err := a.DB.LockUser(username, now.Add(delay), false); err != nil {
+			logrus.Errorf("Failed to delay logins of %s: %v", username, err)
+		}
+	}
+}
+
+func (a *Auth) publishLocked(username string, until time.Time, failures int) {
+	msgBody, err := json.Marshal(map[string]interface{}{
+		"username":      username,
+		"locked_until":  until.UTC().Format(time.RFC3339),
+		"failed_logins": failures,
+	})
+	if err != nil {
+		logrus.Errorf("Failed to marshal lock event: %v", err)
+		return
+	}
+	if err := a.MB.Publish(eventExchange, "users.locked", msgBody); err != nil {
+		logrus.Errorf("Failed to publish lock event of %s: %v", username, err)
+	}
+}
+
+// Unlock lifts a lockout and resets the failed login counter of a user
+func (a *Auth) Unlock(username string) error {
+	if _, err := a.DB.GetUser(username); err != nil {
+		return fmt.Errorf("%w: %s", ErrUserNotFound, username)
+	}
+	return a.DB.ResetLoginState(username)
+}
+
+// throttleRequest counts a request that sends mail for a login, whether the login exists or not.
+// It fails while the login or the client address has sent too many requests recently.
+func (a *Auth) throttleRequest(login, clientIP string) error {
+	now := time.Now()
+	login = strings.ToLower(login)
+	if until, blocked := a.requestIPThrottle.blockedUntil(clientIP, now); blocked {
+		return &ThrottledError{Until: until}
+	}
+	if until, blocked := a.requestLoginThrottle.blockedUntil(login, now); blocked {
+		return &ThrottledError{Until: until}
+	}
+	a.requestIPThrottle.fail(clientIP, now)
+	a.requestLoginThrottle.fail(login, now)
+	return nil
+}
@@ -0,0 +1,93 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/BieggerM/userservice/pkg/models"
+	"github.com/sirupsen/logrus"
+	"time"
+)
+
+const purposeMagicLink = "magic_link"
+
+// ErrInvalidMagicLink is returned for unknown, expired and already used login links
+var ErrInvalidMagicLink = errors.New("invalid or expired login link")
+
+// RequestMagicLink creates a single-use login token and publishes it for delivery by the mail service.
+// Requests are throttled per login and client address like password resets. Only local users with
+// a verified email address can log in by link, others are ignored without an error. Every request
+// does the same work before it returns and the link is stored and published afterwards, so neither
+// the answer nor its timing tells which accounts exist.
+func (a *Auth) RequestMagicLink(login, clientIP string) error {
+	if err := a.throttleRequest(login, clientIP); err != nil {
+		return err
+	}
+	if err := a.DB.DeleteExpiredOneTimeTokens(); err != nil {
+		logrus.Errorf("Failed to delete expired one-time tokens: %v", err)
+	}
+	token, err := randomToken()
+	if err != nil {
+		return err
+	}
+	user, err := a.lookupLogin(login)
+	if err != nil || user.Email == "" || !user.EmailVerified {
+		return nil
+	}
+	// directory users have to pass the checks of the directory on every login
+	if user.Source != "" && user.Source != SourceLocal {
+		return nil
+	}
+	a.deliveries.Add(1)
+	go func() {
+		defer a.deliveries.Done()
+		if err := a.sendMagicLink(user, token); err != nil {
+			logrus.Errorf("Failed to send login link to %s: %v", user.Username, err)
+		}
+	}()
+	return nil
+}
+
+// sendMagicLink stores the login token of the user, replacing earlier ones, and publishes it
+func (a *Auth) sendMagicLink(user models.User, token string) error {
+	// only the latest link works
+	if err := a.DB.InvalidateOneTimeTokens(user.Username, purposeMagicLink); err != nil {
+		return err
+	}
+	expiresAt := time.Now().Add(a.config.MagicLinkTTL)
+	if err := a.DB.SaveOneTimeToken(models.OneTimeToken{
+		TokenHash: hashToken(token),
+		Purpose:   purposeMagicLink,
+		Username:  user.Username,
+		ExpiresAt: expiresAt,
+	}); err != nil {
+		return err
+	}
+	// the event is the only place the token appears in plain text, it must never be logged
+	msgBody, err := json.Marshal(map[string]interface{}{
+		"username":   user.Username,
+		"email":      user.Email,
+		"token":      token,
+		"expires_at": expiresAt.UTC().Format(time.RFC3339),
+	})
+	if err != nil {
+		return err
+	}
+	return a.MB.Publish(eventExchange, "users.magic_link_requested", msgBody)
+}
+
+// RedeemMagicLink consumes a login token and returns its user, who is logged in like after
+// a password check: users with two-factor authentication still have to provide their second factor.
+func (a *Auth) RedeemMagicLink(token string) (models.User, error) {
+	stored, err := a.DB.ConsumeOneTimeToken(hashToken(token), purposeMagicLink)
+	if err != nil {
+		return models.User{}, ErrInvalidMagicLink
+	}
+	state, err := a.DB.GetLoginState(stored.Username)
+	if err != nil {
+		return models.User{}, err
+	}
+	if time.Now().Before(state.LockedUntil) {
+		return models.User{}, &LockedError{Until: state.LockedUntil}
+	}
+	return a.DB.GetUser(stored.Username)
+}
@@ -0,0 +1,105 @@
+package auth
+
+import (
+	"encoding/json"
+	"github.com/BieggerM/userservice/pkg/adapter/out/broker/brokertest"
+	"github.com/BieggerM/userservice/pkg/adapter/out/database/databasetest"
+	"github.com/BieggerM/userservice/pkg/models"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+// setupMagicLink gives user1 a verified email address so it can log in by link
+func setupMagicLink(t *testing.T) (*Auth, *databasetest.Memory, *brokertest.Recorder) {
+	a, db, mb := setupService(t)
+	a.config.MagicLinkTTL = 15 * time.Minute
+	assert.NoError(t, db.SetEmail("user1", "user1@example.com"))
+	assert.NoError(t, db.MarkEmailVerified("user1"))
+	return a, db, mb
+}
+
+// requestMagicLink requests a login link for the login and returns the token delivered to the mail service, if any
+func requestMagicLink(t *testing.T, a *Auth, mb *brokertest.Recorder, login string) string {
+	sent := len(mb.Messages("users.magic_link_requested"))
+	assert.NoError(t, a.RequestMagicLink(login, "10.0.0.1"))
+	a.deliveries.Wait()
+	messages := mb.Messages("users.magic_link_requested")
+	if len(messages) == sent {
+		return ""
+	}
+	var event struct {
+		Email string `json:"email"`
+		Token string `json:"token"`
+	}
+	assert.NoError(t, json.Unmarshal(messages[len(messages)-1].Body, &event))
+	assert.Equal(t, "user1@example.com", event.Email)
+	return event.Token
+}
+
+func TestMagicLinkLogsIn(t *testing.T) {
+	a, db, mb := setupMagicLink(t)
+	token := requestMagicLink(t, a, mb, "user1")
+	assert.NotEmpty(t, token)
+
+	// only the hash is stored
+	stored := db.OneTimeTokens("user1")
+	assert.Len(t, stored, 1)
+	assert.Equal(t, hashToken(token), stored[0].TokenHash)
+
+	user, err := a.RedeemMagicLink(token)
+	assert.NoError(t, err)
+	assert.Equal(t, "user1", user.Username)
+	_, err = a.RedeemMagicLink(token)
+	assert.ErrorIs(t, err, ErrInvalidMagicLink)
+}
+
+func TestMagicLinkExpires(t *testing.T) {
+	a, db, mb := setupMagicLink(t)
+	token := requestMagicLink(t, a, mb, "user1")
+
+	db.Now = func() time.Time { return time.Now().Add(time.Hour) }
+	_, err := a.RedeemMagicLink(token)
+	assert.ErrorIs(t, err, ErrInvalidMagicLink)
+}
+
+func TestMagicLinkReplacesEarlierLinks(t *testing.T) {
+	a, _, mb := setupMagicLink(t)
+	first := requestMagicLink(t, a, mb, "user1")
+	second := requestMagicLink(t, a, mb, "user1")
+
+	_, err := a.RedeemMagicLink(first)
+	assert.ErrorIs(t, err, ErrInvalidMagicLink)
+	user, err := a.RedeemMagicLink(second)
+	assert.NoError(t, err)
+	assert.Equal(t, "user1", user.Username)
+}
+
+func TestMagicLinkOnlyForVerifiedLocalUsers(t *testing.T) {
+	a, db, mb := setupMagicLink(t)
+	assert.NoError(t, db.SaveUser(models.User{Username: "unverified", Email: "unverified@example.com", Roles: []string{RoleUser}}))
+	assert.NoError(t, db.SaveUser(models.User{Username: "jdoe", Email: "jdoe@example.com", Source: SourceLDAP, Roles: []string{RoleUser}}))
+	assert.NoError(t, db.MarkEmailVerified("jdoe"))
+
+	for _, login := range []string{"nobody", "unverified", "jdoe"} {
+		assert.Empty(t, requestMagicLink(t, a, mb, login), login)
+		assert.Empty(t, db.OneTimeTokens(login), login)
+	}
+}
+
+func TestMagicLinkRequestsAreThrottled(t *testing.T) {
+	a, _, mb := setupMagicLink(t)
+	for i := 0; i < requestFreeAttempts; i++ {
+		assert.NotEmpty(t, requestMagicLink(t, a, mb, "user1"))
+	}
+	err := a.RequestMagicLink("USER1", "10.0.0.2")
+	var throttled *ThrottledError
+	assert.ErrorAs(t, err, &throttled)
+	assert.Positive(t, throttled.RetryAfter(time.Now()))
+
+	// unknown logins count the same, so throttling does not reveal accounts either
+	for i := 0; i < requestFreeAttempts; i++ {
+		assert.NoError(t, a.RequestMagicLink("nobody", "10.0.0.3"))
+	}
+	assert.ErrorAs(t, a.RequestMagicLink("nobody", "10.0.0.3"), &throttled)
+}
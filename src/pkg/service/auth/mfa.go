@@ -0,0 +1,227 @@
+package auth
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"github.com/BieggerM/userservice/pkg/models"
+	"github.com/sirupsen/logrus"
+	"strings"
+	"time"
+)
+
+const (
+	purposeMFA = "mfa"
+	// mfaTokenTTL is how long a user has to enter the second factor after the password was checked
+	mfaTokenTTL       = 5 * time.Minute
+	recoveryCodeCount = 10
+)
+
+var (
+	ErrMFAAlreadyEnabled = errors.New("two-factor authentication is already enabled")
+	ErrMFANotEnrolled    = errors.New("two-factor authentication is not enrolled")
+	ErrInvalidMFACode    = errors.New("invalid two-factor code")
+	ErrInvalidMFAToken   = errors.New("invalid or expired mfa token")
+	// ErrMFARequired is returned when tokens are requested for a user with two-factor authentication
+	// who has not passed the second factor
+	ErrMFARequired = errors.New("two-factor authentication required")
+)
+
+// MFARequiredError is returned instead of tokens when a user with two-factor authentication logs in.
+// The login continues with VerifyMFA and the MFAToken.
+type MFARequiredError struct {
+	MFAToken string
+}
+
+func (e *MFARequiredError) Error() string {
+	return ErrMFARequired.Error()
+}
+
+func (e *MFARequiredError) Unwrap() error {
+	return ErrMFARequired
+}
+
+// TOTPEnrollment is shown to the user once to set up an authenticator app
+type TOTPEnrollment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"otpauth_uri"`
+}
+
+// EnrollTOTP creates a new TOTP secret for the user. It has to be confirmed with a code
+// before it is required on login; enrolling again replaces an unconfirmed secret.
+func (a *Auth) EnrollTOTP(username string) (TOTPEnrollment, error) {
+	enabled, err := a.MFAEnabled(username)
+	if err != nil {
+		return TOTPEnrollment{}, err
+	}
+	if enabled {
+		return TOTPEnrollment{}, ErrMFAAlreadyEnabled
+	}
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		return TOTPEnrollment{}, err
+	}
+	if err := a.DB.SaveTOTPSecret(models.TOTPSecret{Username: username, Secret: secret}); err != nil {
+		return TOTPEnrollment{}, err
+	}
+	return TOTPEnrollment{Secret: secret, URI: totpURI(a.config.Issuer, username, secret)}, nil
+}
+
+// ConfirmTOTP enables two-factor authentication with the first code of the authenticator app
+// and returns recovery codes, which are only stored hashed and cannot be shown again
+func (a *Auth) ConfirmTOTP(username, code string) ([]string, error) {
+	secret, err := a.DB.GetTOTPSecret(username)
+	if err != nil {
+		return nil, ErrMFANotEnrolled
+	}
+	if secret.Confirmed {
+		return nil, ErrMFAAlreadyEnabled
+	}
+	counter, ok := verifyTOTP(secret.Secret, code, time.Now(), secret.LastCounter)
+	if !ok {
+		return nil, ErrInvalidMFACode
+	}
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		if codes[i], err = randomRecoveryCode(); err != nil {
+			return nil, err
+		}
+		hashes[i] = hashToken(normalizeRecoveryCode(codes[i]))
+	}
+	if err := a.DB.ConfirmTOTPSecret(username, counter, hashes); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// MFAEnabled reports whether the user has to provide a second factor on login.
+// Errors other than a missing secret are returned, so a failing database never skips the second factor.
+func (a *Auth) MFAEnabled(username string) (bool, error) {
+	secret, err := a.DB.GetTOTPSecret(username)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return secret.Confirmed, nil
+}
+
+// requireSecondFactor fails with ErrMFARequired for users with two-factor authentication,
+// unless the grant is issued after their second factor was checked
+func (a *Auth) requireSecondFactor(user models.User, g grant) error {
+	if g.secondFactor {
+		return nil
+	}
+	enabled, err := a.MFAEnabled(user.Username)
+	if err != nil {
+		return err
+	}
+	if enabled {
+		return ErrMFARequired
+	}
+	return nil
+}
+
+// StartMFA is called after the password of a user with two-factor authentication was checked.
+// It returns a short-lived token that has to be presented together with the second factor.
+func (a *Auth) StartMFA(user models.User) (string, error) {
+	token, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+	err = a.DB.SaveOneTimeToken(models.OneTimeToken{
+		TokenHash: hashToken(token),
+		Purpose:   purposeMFA,
+		Username:  user.Username,
+		ExpiresAt: time.Now().Add(mfaTokenTTL),
+	})
+	return token, err
+}
+
+// VerifyMFA completes a login with a TOTP code or an unused recovery code and issues the tokens
+// for the audience. The mfa token is consumed even if the code is wrong, and failures count
+// towards the account lockout.
+func (a *Auth) VerifyMFA(mfaToken, code, audience string, client ClientInfo) (TokenPair, error) {
+	// a wrong audience must not use up the mfa token
+	if _, err := a.audience(audience); err != nil {
+		return TokenPair{}, err
+	}
+	stored, err := a.DB.ConsumeOneTimeToken(hashToken(mfaToken), purposeMFA)
+	if err != nil {
+		return TokenPair{}, ErrInvalidMFAToken
+	}
+	now := time.Now()
+	state, err := a.DB.GetLoginState(stored.Username)
+	if err != nil {
+		return TokenPair{}, err
+	}
+	if now.Before(state.LockedUntil) {
+		return TokenPair{}, &LockedError{Until: state.LockedUntil}
+	}
+	if !a.checkSecondFactor(stored.Username, code, now) {
+		a.recordFailure(stored.Username, now)
+		return TokenPair{}, ErrInvalidMFACode
+	}
+	user, err := a.DB.GetUser(stored.Username)
+	if err != nil {
+		return TokenPair{}, err
+	}
+	return a.startSession(user, grant{audience: audience, secondFactor: true}, client)
+}
+
+func (a *Auth) checkSecondFactor(username, code string, now time.Time) bool {
+	secret, err := a.DB.GetTOTPSecret(username)
+	if err != nil || !secret.Confirmed {
+		return false
+	}
+	if counter, ok := verifyTOTP(secret.Secret, code, now, secret.LastCounter); ok {
+		// the update fails if the same code was accepted concurrently
+		used, err := a.DB.UseTOTPCounter(username, counter)
+		return err == nil && used
+	}
+	used, err := a.DB.UseRecoveryCode(username, hashToken(normalizeRecoveryCode(code)))
+	if err == nil && used {
+		logrus.Infof("Recovery code used by %s", username)
+	}
+	return err == nil && used
+}
+
+// ResetMFA removes the second factor of a user, e.g. after the authenticator app was lost
+func (a *Auth) ResetMFA(username string) error {
+	if _, err := a.DB.GetUser(username); err != nil {
+		return ErrUserNotFound
+	}
+	if err := a.DB.DeleteMFA(username); err != nil {
+		return err
+	}
+	msgBody, err := json.Marshal(map[string]interface{}{
+		"username": username,
+	})
+	if err != nil {
+		return err
+	}
+	if err := a.MB.Publish(eventExchange, "users.mfa_reset", msgBody); err != nil {
+		logrus.Errorf("Failed to publish mfa reset event of %s: %v", username, err)
+	}
+	return nil
+}
+
+// randomRecoveryCode returns a code like "k3x9q-7mw2p" with 50 bits of entropy
+func randomRecoveryCode() (string, error) {
+	const alphabet = "abcdefghijkmnpqrstuvwxyz23456789"
+	b := make([]byte, 10)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	for i := range b {
+		b[i] = alphabet[int(b[i])%len(alphabet)]
+	}
+	return string(b[:5]) + "-" + string(b[5:]), nil
+}
+
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
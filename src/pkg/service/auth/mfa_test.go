@@ -0,0 +1,158 @@
+package auth
+
+import (
+	"database/sql"
+	"errors"
+	"github.com/BieggerM/userservice/pkg/adapter/out/database/databasetest"
+	"github.com/BieggerM/userservice/pkg/models"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+	"time"
+)
+
+// enrollMFA enables two-factor authentication for user1 and returns the secret and the recovery codes
+func enrollMFA(t *testing.T, a *Auth) (string, []string) {
+	enrollment, err := a.EnrollTOTP("user1")
+	assert.NoError(t, err)
+	code, err := totpCode(enrollment.Secret, time.Now().Unix()/totpPeriod-1)
+	assert.NoError(t, err)
+	recoveryCodes, err := a.ConfirmTOTP("user1", code)
+	assert.NoError(t, err)
+	assert.Len(t, recoveryCodes, recoveryCodeCount)
+	return enrollment.Secret, recoveryCodes
+}
+
+// startLogin checks the password of user1 and returns the mfa token of the challenge
+func startLogin(t *testing.T, a *Auth) string {
+	user, err := a.Authenticate("user1", "correct horse", "")
+	assert.NoError(t, err)
+	_, err = a.IssueTokens(user, "", ClientInfo{})
+	var mfa *MFARequiredError
+	assert.ErrorAs(t, err, &mfa)
+	return mfa.MFAToken
+}
+
+func TestConfirmTOTPWithWrongCode(t *testing.T) {
+	a, _, _ := setupService(t)
+	_, err := a.ConfirmTOTP("user1", "123456")
+	assert.ErrorIs(t, err, ErrMFANotEnrolled)
+
+	_, err = a.EnrollTOTP("user1")
+	assert.NoError(t, err)
+	_, err = a.ConfirmTOTP("user1", "000000")
+	assert.ErrorIs(t, err, ErrInvalidMFACode)
+	enabled, err := a.MFAEnabled("user1")
+	assert.NoError(t, err)
+	assert.False(t, enabled)
+}
+
+func TestNoTokensWithoutSecondFactor(t *testing.T) {
+	a, db, _ := setupService(t)
+	enrollMFA(t, a)
+	user, err := db.GetUser("user1")
+	assert.NoError(t, err)
+
+	_, err = a.GenerateJWT(user, "")
+	assert.ErrorIs(t, err, ErrMFARequired)
+	_, err = a.IssueTokens(user, "", ClientInfo{})
+	assert.ErrorIs(t, err, ErrMFARequired)
+	sessions, err := db.ListSessions("user1")
+	assert.NoError(t, err)
+	assert.Empty(t, sessions)
+}
+
+func TestMFATokenIsSingleUse(t *testing.T) {
+	a, _, _ := setupService(t)
+	secret, _ := enrollMFA(t, a)
+	mfaToken := startLogin(t, a)
+	code, err := totpCode(secret, time.Now().Unix()/totpPeriod)
+	assert.NoError(t, err)
+
+	pair, err := a.VerifyMFA(mfaToken, code, "", ClientInfo{})
+	assert.NoError(t, err)
+	claims, err := a.ValidateJWT(pair.AccessToken)
+	assert.NoError(t, err)
+	assert.Equal(t, "user1", claims.Subject)
+	assert.NotEmpty(t, claims.SessionID)
+
+	_, err = a.VerifyMFA(mfaToken, code, "", ClientInfo{})
+	assert.ErrorIs(t, err, ErrInvalidMFAToken)
+
+	// a wrong code uses up the token as well
+	mfaToken = startLogin(t, a)
+	_, err = a.VerifyMFA(mfaToken, "000000", "", ClientInfo{})
+	assert.ErrorIs(t, err, ErrInvalidMFACode)
+	next, err := totpCode(secret, time.Now().Unix()/totpPeriod+1)
+	assert.NoError(t, err)
+	_, err = a.VerifyMFA(mfaToken, next, "", ClientInfo{})
+	assert.ErrorIs(t, err, ErrInvalidMFAToken)
+}
+
+func TestMFATokenExpires(t *testing.T) {
+	a, db, _ := setupService(t)
+	_, recoveryCodes := enrollMFA(t, a)
+	mfaToken := startLogin(t, a)
+
+	db.Now = func() time.Time { return time.Now().Add(mfaTokenTTL + time.Second) }
+	_, err := a.VerifyMFA(mfaToken, recoveryCodes[0], "", ClientInfo{})
+	assert.ErrorIs(t, err, ErrInvalidMFAToken)
+}
+
+func TestRecoveryCodeWorksOnce(t *testing.T) {
+	a, _, _ := setupService(t)
+	_, recoveryCodes := enrollMFA(t, a)
+
+	_, err := a.VerifyMFA(startLogin(t, a), recoveryCodes[0], "", ClientInfo{})
+	assert.NoError(t, err)
+	_, err = a.VerifyMFA(startLogin(t, a), recoveryCodes[0], "", ClientInfo{})
+	assert.ErrorIs(t, err, ErrInvalidMFACode)
+	// codes are accepted regardless of case and separators, still only once
+	_, err = a.VerifyMFA(startLogin(t, a), strings.ToUpper(recoveryCodes[1][:5]+" "+recoveryCodes[1][6:]), "", ClientInfo{})
+	assert.NoError(t, err)
+	_, err = a.VerifyMFA(startLogin(t, a), recoveryCodes[1], "", ClientInfo{})
+	assert.ErrorIs(t, err, ErrInvalidMFACode)
+}
+
+func TestResetMFA(t *testing.T) {
+	a, db, mb := setupService(t)
+	enrollMFA(t, a)
+	assert.ErrorIs(t, a.ResetMFA("nobody"), ErrUserNotFound)
+
+	assert.NoError(t, a.ResetMFA("user1"))
+	enabled, err := a.MFAEnabled("user1")
+	assert.NoError(t, err)
+	assert.False(t, enabled)
+	assert.Len(t, mb.Messages("users.mfa_reset"), 1)
+	user, err := db.GetUser("user1")
+	assert.NoError(t, err)
+	_, err = a.IssueTokens(user, "", ClientInfo{})
+	assert.NoError(t, err)
+
+	// the user can enroll again
+	enrollMFA(t, a)
+}
+
+// failingMFA is a database whose TOTP secrets cannot be read
+type failingMFA struct {
+	*databasetest.Memory
+}
+
+func (failingMFA) GetTOTPSecret(username string) (models.TOTPSecret, error) {
+	return models.TOTPSecret{}, errors.New("connection refused")
+}
+
+func TestMFAFailsClosed(t *testing.T) {
+	a, db, _ := setupService(t)
+	a.DB = failingMFA{db}
+	_, err := a.MFAEnabled("user1")
+	assert.Error(t, err)
+	assert.NotErrorIs(t, err, sql.ErrNoRows)
+
+	user, err := db.GetUser("user1")
+	assert.NoError(t, err)
+	_, err = a.IssueTokens(user, "", ClientInfo{})
+	assert.Error(t, err)
+	_, err = a.GenerateJWT(user, "")
+	assert.Error(t, err)
+}
@@ -0,0 +1,270 @@
+package auth
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"github.com/BieggerM/userservice/pkg/models"
+	"strings"
+	"time"
+)
+
+// Grant types supported by the token endpoint (RFC 6749 sections 4.3, 4.4 and 6)
+const (
+	GrantClientCredentials = "client_credentials"
+	GrantPassword          = "password"
+	GrantRefreshToken      = "refresh_token"
+)
+
+// oauthClientPrefix marks client ids, which look like "cl_<id>". Client ids become the subject of
+// their tokens, so usernames must not start with it or a user could act as a client and vice versa.
+const oauthClientPrefix = "cl_"
+
+// ErrReservedUsername is returned for usernames that could be mistaken for client ids
+var ErrReservedUsername = errors.New("usernames must not start with " + oauthClientPrefix)
+
+// ValidateUsername checks that a new username is not reserved for OAuth clients
+func ValidateUsername(username string) error {
+	if strings.HasPrefix(strings.ToLower(username), oauthClientPrefix) {
+		return ErrReservedUsername
+	}
+	return nil
+}
+
+// Error codes of the token endpoint (RFC 6749 section 5.2)
+const (
+	ErrCodeInvalidRequest       = "invalid_request"
+	ErrCodeInvalidClient        = "invalid_client"
+	ErrCodeInvalidGrant         = "invalid_grant"
+	ErrCodeUnauthorizedClient   = "unauthorized_client"
+	ErrCodeUnsupportedGrantType = "unsupported_grant_type"
+	ErrCodeInvalidScope         = "invalid_scope"
+)
+
+// OAuthError is an error response of the token endpoint
+type OAuthError struct {
+	Code        string
+	Description string
+}
+
+func (e *OAuthError) Error() string {
+	return e.Code + ": " + e.Description
+}
+
+// TokenRequest holds the parameters of a request to the token endpoint. Audience is an
+// extension selecting one of the audiences of the client, the first one if empty.
+type TokenRequest struct {
+	GrantType    string
+	ClientID     string
+	ClientSecret string
+	Scope        string
+	Audience     string
+	Username     string
+	Password     string
+	RefreshToken string
+	Client       ClientInfo
+}
+
+// OAuthToken is the successful response of the token endpoint (RFC 6749 section 5.1)
+type OAuthToken struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int64  `json:"expires_in"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	Scope        string `json:"scope,omitempty"`
+}
+
+// NewOAuthClient creates a client allowed to request tokens for the given roles, audiences and grant types.
+// The returned secret is shown once and cannot be recovered.
+func NewOAuthClient(name string, scopes, audiences, grantTypes []string) (models.OAuthClient, string, error) {
+	if len(scopes) == 0 || len(audiences) == 0 || len(grantTypes) == 0 {
+		return models.OAuthClient{}, "", errors.New("a client needs at least one scope, audience and grant type")
+	}
+	for _, scope := range scopes {
+		if !IsKnownRole(scope) {
+			return models.OAuthClient{}, "", fmt.Errorf("unknown scope %q", scope)
+		}
+	}
+	for _, grantType := range grantTypes {
+		if grantType != GrantClientCredentials && grantType != GrantPassword && grantType != GrantRefreshToken {
+			return models.OAuthClient{}, "", fmt.Errorf("unsupported grant type %q", grantType)
+		}
+	}
+	id, err := randomHex(8)
+	if err != nil {
+		return models.OAuthClient{}, "", err
+	}
+	secret, err := randomToken()
+	if err != nil {
+		return models.OAuthClient{}, "", err
+	}
+	client := models.OAuthClient{
+		ClientID:   oauthClientPrefix + id,
+		Name:       name,
+		SecretHash: hashToken(secret),
+		Scopes:     scopes,
+		Audiences:  audiences,
+		GrantTypes: grantTypes,
+		CreatedAt:  time.Now(),
+	}
+	return client, secret, nil
+}
+
+// Token authenticates the client and issues tokens for the requested grant
+func (a *Auth) Token(req TokenRequest) (OAuthToken, error) {
+	client, err := a.authenticateClient(req.ClientID, req.ClientSecret)
+	if err != nil {
+		return OAuthToken{}, err
+	}
+	switch req.GrantType {
+	case "":
+		return OAuthToken{}, &OAuthError{ErrCodeInvalidRequest, "grant_type is missing"}
+	case GrantClientCredentials, GrantPassword, GrantRefreshToken:
+		if !containsRole(client.GrantTypes, req.GrantType) {
+			return OAuthToken{}, &OAuthError{ErrCodeUnauthorizedClient, "the client may not use this grant type"}
+		}
+	default:
+		return OAuthToken{}, &OAuthError{ErrCodeUnsupportedGrantType, "grant type is not supported"}
+	}
+
+	var pair TokenPair
+	switch req.GrantType {
+	case GrantClientCredentials:
+		pair, err = a.clientCredentialsGrant(client, req)
+	case GrantPassword:
+		pair, err = a.passwordGrant(client, req)
+	case GrantRefreshToken:
+		pair, err = a.refreshTokenGrant(client, req)
+	}
+	if errors.Is(err, ErrInvalidAudience) {
+		return OAuthToken{}, &OAuthError{ErrCodeInvalidRequest, "audience is not allowed"}
+	}
+	if err != nil {
+		return OAuthToken{}, err
+	}
+	return OAuthToken{
+		AccessToken:  pair.AccessToken,
+		TokenType:    "Bearer",
+		ExpiresIn:    pair.ExpiresIn,
+		RefreshToken: pair.RefreshToken,
+		Scope:        pair.Scope,
+	}, nil
+}
+
+// authenticateClient checks the client secret, unknown clients and wrong secrets are not distinguished
+func (a *Auth) authenticateClient(clientID, secret string) (models.OAuthClient, error) {
+	invalid := &OAuthError{ErrCodeInvalidClient, "client authentication failed"}
+	if clientID == "" || secret == "" {
+		return models.OAuthClient{}, invalid
+	}
+	client, err := a.DB.GetOAuthClient(clientID)
+	if err != nil {
+		return models.OAuthClient{}, invalid
+	}
+	if subtle.ConstantTimeCompare([]byte(hashToken(secret)), []byte(client.SecretHash)) != 1 {
+		return models.OAuthClient{}, invalid
+	}
+	return client, nil
+}
+
+// clientCredentialsGrant issues an access token to the client itself, its id is the subject.
+// No refresh token is issued as the client can always request a new token.
+func (a *Auth) clientCredentialsGrant(client models.OAuthClient, req TokenRequest) (TokenPair, error) {
+	g, err := clientGrant(client, client.Scopes, req)
+	if err != nil {
+		return TokenPair{}, err
+	}
+	accessToken, err := a.generateJWT(models.User{Username: client.ClientID, Roles: g.scope}, g, "")
+	if err != nil {
+		return TokenPair{}, err
+	}
+	return TokenPair{
+		AccessToken: accessToken,
+		ExpiresIn:   int64(a.config.TokenTTL.Seconds()),
+		Scope:       strings.Join(g.scope, " "),
+	}, nil
+}
+
+// passwordGrant logs the user in on behalf of the client. Accounts with a second factor
+// have to use the login endpoints as the grant has no step for it.
+func (a *Auth) passwordGrant(client models.OAuthClient, req TokenRequest) (TokenPair, error) {
+	if req.Username == "" || req.Password == "" {
+		return TokenPair{}, &OAuthError{ErrCodeInvalidRequest, "username and password are required"}
+	}
+	user, err := a.Authenticate(req.Username, req.Password, req.Client.IP)
+	var locked *LockedError
+	if errors.As(err, &locked) {
+		return TokenPair{}, &OAuthError{ErrCodeInvalidGrant, "account is temporarily locked"}
+	}
+	if errors.Is(err, ErrCredentialBackendUnavailable) {
+		return TokenPair{}, err
+	}
+	if err != nil {
+		return TokenPair{}, &OAuthError{ErrCodeInvalidGrant, "invalid username or password"}
+	}
+	g, err := clientGrant(client, user.Roles, req)
+	if err != nil {
+		return TokenPair{}, err
+	}
+	pair, err := a.startSession(user, g, req.Client)
+	if errors.Is(err, ErrMFARequired) {
+		return TokenPair{}, &OAuthError{ErrCodeInvalidGrant, "the account requires a second factor"}
+	}
+	return pair, err
+}
+
+// refreshTokenGrant rotates a refresh token issued to the same client, keeping its scope
+func (a *Auth) refreshTokenGrant(client models.OAuthClient, req TokenRequest) (TokenPair, error) {
+	if req.RefreshToken == "" {
+		return TokenPair{}, &OAuthError{ErrCodeInvalidRequest, "refresh_token is required"}
+	}
+	pair, err := a.refreshTokens(req.RefreshToken, client.ClientID, req.Client)
+	if errors.Is(err, ErrInvalidRefreshToken) || errors.Is(err, ErrRefreshTokenReused) {
+		return TokenPair{}, &OAuthError{ErrCodeInvalidGrant, err.Error()}
+	}
+	return pair, err
+}
+
+// clientGrant resolves audience and scope of a request. The scope defaults to all roles that are
+// both allowed for the client and available to the subject; requesting any other role fails.
+func clientGrant(client models.OAuthClient, available []string, req TokenRequest) (grant, error) {
+	g := grant{audience: req.Audience, clientID: client.ClientID}
+	if g.audience == "" {
+		g.audience = client.Audiences[0]
+	}
+	if !containsRole(client.Audiences, g.audience) {
+		return grant{}, &OAuthError{ErrCodeInvalidRequest, "audience is not allowed for the client"}
+	}
+	allowed := intersectRoles(client.Scopes, available)
+	requested := []string{}
+	for _, scope := range strings.Fields(req.Scope) {
+		// openid grants no role, the userinfo endpoint is open to every token of a user
+		if scope != ScopeOpenID {
+			requested = append(requested, scope)
+		}
+	}
+	if len(requested) == 0 {
+		requested = allowed
+	}
+	for _, scope := range requested {
+		if !containsRole(allowed, scope) {
+			return grant{}, &OAuthError{ErrCodeInvalidScope, fmt.Sprintf("scope %q is not allowed", scope)}
+		}
+	}
+	if len(requested) == 0 {
+		return grant{}, &OAuthError{ErrCodeInvalidScope, "no scope can be granted"}
+	}
+	g.scope = requested
+	return g, nil
+}
+
+// intersectRoles returns the roles contained in both lists in the order of the first
+func intersectRoles(roles, other []string) []string {
+	result := []string{}
+	for _, role := range roles {
+		if containsRole(other, role) && !containsRole(result, role) {
+			result = append(result, role)
+		}
+	}
+	return result
+}
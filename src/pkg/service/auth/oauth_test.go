@@ -0,0 +1,146 @@
+package auth
+
+import (
+	"github.com/BieggerM/userservice/pkg/adapter/out/database/databasetest"
+	"github.com/BieggerM/userservice/pkg/adapter/out/ldap/ldaptest"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+// saveClient registers a client allowed to use the given grant types for the user and service scopes
+func saveClient(t *testing.T, db *databasetest.Memory, grantTypes ...string) (string, string) {
+	client, secret, err := NewOAuthClient("test client", []string{RoleUser, RoleService}, []string{"gateway"}, grantTypes)
+	assert.NoError(t, err)
+	assert.NoError(t, db.SaveOAuthClient(client))
+	return client.ClientID, secret
+}
+
+// assertOAuthError checks that err is a token endpoint error with the given code
+func assertOAuthError(t *testing.T, err error, code string) {
+	var oauthErr *OAuthError
+	if assert.ErrorAs(t, err, &oauthErr) {
+		assert.Equal(t, code, oauthErr.Code)
+	}
+}
+
+func TestClientCredentialsGrant(t *testing.T) {
+	a, db, _ := setupService(t)
+	clientID, secret := saveClient(t, db, GrantClientCredentials)
+
+	token, err := a.Token(TokenRequest{GrantType: GrantClientCredentials, ClientID: clientID, ClientSecret: secret})
+	assert.NoError(t, err)
+	assert.Equal(t, "Bearer", token.TokenType)
+	assert.Equal(t, "user service", token.Scope)
+	assert.Empty(t, token.RefreshToken)
+	claims, err := a.ValidateJWT(token.AccessToken)
+	assert.NoError(t, err)
+	assert.Equal(t, clientID, claims.UserID)
+	assert.Equal(t, clientID, claims.ClientID)
+	assert.Equal(t, []string{RoleUser, RoleService}, claims.Roles)
+
+	// a narrower scope can be requested, a wider one cannot
+	token, err = a.Token(TokenRequest{GrantType: GrantClientCredentials, ClientID: clientID, ClientSecret: secret, Scope: RoleService})
+	assert.NoError(t, err)
+	assert.Equal(t, "service", token.Scope)
+	_, err = a.Token(TokenRequest{GrantType: GrantClientCredentials, ClientID: clientID, ClientSecret: secret, Scope: RoleAdmin})
+	assertOAuthError(t, err, ErrCodeInvalidScope)
+}
+
+func TestPasswordGrantIntersectsScopes(t *testing.T) {
+	a, db, _ := setupService(t)
+	clientID, secret := saveClient(t, db, GrantPassword, GrantRefreshToken)
+
+	// user1 only holds the user role, the service scope of the client is not granted
+	token, err := a.Token(TokenRequest{GrantType: GrantPassword, ClientID: clientID, ClientSecret: secret, Username: "user1", Password: "correct horse"})
+	assert.NoError(t, err)
+	assert.Equal(t, "user", token.Scope)
+	assert.NotEmpty(t, token.RefreshToken)
+	claims, err := a.ValidateJWT(token.AccessToken)
+	assert.NoError(t, err)
+	assert.Equal(t, "user1", claims.UserID)
+	assert.Equal(t, clientID, claims.ClientID)
+	assert.Equal(t, []string{RoleUser}, claims.Roles)
+
+	_, err = a.Token(TokenRequest{GrantType: GrantPassword, ClientID: clientID, ClientSecret: secret, Username: "user1", Password: "correct horse", Scope: RoleService})
+	assertOAuthError(t, err, ErrCodeInvalidScope)
+	_, err = a.Token(TokenRequest{GrantType: GrantPassword, ClientID: clientID, ClientSecret: secret, Username: "user1", Password: "wrong"})
+	assertOAuthError(t, err, ErrCodeInvalidGrant)
+	_, err = a.Token(TokenRequest{GrantType: GrantPassword, ClientID: clientID, ClientSecret: secret})
+	assertOAuthError(t, err, ErrCodeInvalidRequest)
+}
+
+func TestRefreshTokenGrantKeepsClientAndScope(t *testing.T) {
+	a, db, _ := setupService(t)
+	clientID, secret := saveClient(t, db, GrantPassword, GrantRefreshToken)
+	otherID, otherSecret := saveClient(t, db, GrantRefreshToken)
+	token, err := a.Token(TokenRequest{GrantType: GrantPassword, ClientID: clientID, ClientSecret: secret, Username: "user1", Password: "correct horse"})
+	assert.NoError(t, err)
+
+	// refresh tokens only work for the client they were issued to
+	_, err = a.Token(TokenRequest{GrantType: GrantRefreshToken, ClientID: otherID, ClientSecret: otherSecret, RefreshToken: token.RefreshToken})
+	assertOAuthError(t, err, ErrCodeInvalidGrant)
+
+	refreshed, err := a.Token(TokenRequest{GrantType: GrantRefreshToken, ClientID: clientID, ClientSecret: secret, RefreshToken: token.RefreshToken})
+	assert.NoError(t, err)
+	assert.Equal(t, "user", refreshed.Scope)
+	assert.NotEqual(t, token.RefreshToken, refreshed.RefreshToken)
+	claims, err := a.ValidateJWT(refreshed.AccessToken)
+	assert.NoError(t, err)
+	assert.Equal(t, clientID, claims.ClientID)
+
+	_, err = a.Token(TokenRequest{GrantType: GrantRefreshToken, ClientID: clientID, ClientSecret: secret, RefreshToken: token.RefreshToken})
+	assertOAuthError(t, err, ErrCodeInvalidGrant)
+	_, err = a.Token(TokenRequest{GrantType: GrantRefreshToken, ClientID: clientID, ClientSecret: secret})
+	assertOAuthError(t, err, ErrCodeInvalidRequest)
+}
+
+func TestTokenRequiresClientAuthentication(t *testing.T) {
+	a, db, _ := setupService(t)
+	clientID, secret := saveClient(t, db, GrantClientCredentials)
+
+	for _, tc := range []struct{ name, clientID, secret string }{
+		{"unknown client", "cl_0000000000000000", secret},
+		{"wrong secret", clientID, secret + "x"},
+		{"missing secret", clientID, ""},
+		{"missing client", "", ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := a.Token(TokenRequest{GrantType: GrantClientCredentials, ClientID: tc.clientID, ClientSecret: tc.secret})
+			assertOAuthError(t, err, ErrCodeInvalidClient)
+		})
+	}
+}
+
+func TestTokenChecksGrantType(t *testing.T) {
+	a, db, _ := setupService(t)
+	clientID, secret := saveClient(t, db, GrantClientCredentials)
+
+	_, err := a.Token(TokenRequest{ClientID: clientID, ClientSecret: secret})
+	assertOAuthError(t, err, ErrCodeInvalidRequest)
+	_, err = a.Token(TokenRequest{GrantType: GrantPassword, ClientID: clientID, ClientSecret: secret, Username: "user1", Password: "correct horse"})
+	assertOAuthError(t, err, ErrCodeUnauthorizedClient)
+	_, err = a.Token(TokenRequest{GrantType: "authorization_code", ClientID: clientID, ClientSecret: secret})
+	assertOAuthError(t, err, ErrCodeUnsupportedGrantType)
+}
+
+func TestClientPrefixIsReservedForUsernames(t *testing.T) {
+	assert.NoError(t, ValidateUsername("user1"))
+	assert.ErrorIs(t, ValidateUsername("cl_0123456789abcdef"), ErrReservedUsername)
+	assert.ErrorIs(t, ValidateUsername("CL_0123456789abcdef"), ErrReservedUsername)
+
+	// directory accounts are not provisioned under a client id either
+	server := ldaptest.NewServer(append(ldapEntries, ldaptest.Entry{
+		DN:         "uid=cl_0123456789abcdef,ou=people,dc=example,dc=com",
+		Password:   "correct horse",
+		Attributes: map[string][]string{"uid": {"cl_0123456789abcdef"}},
+	})...)
+	t.Cleanup(server.Close)
+	verifier, err := NewLDAPVerifier(ldapConfig(server))
+	assert.NoError(t, err)
+	a, db, _ := setupService(t)
+	a.verifiers = append(a.verifiers, verifier)
+	_, err = a.Authenticate("cl_0123456789abcdef", "correct horse", "192.0.2.1")
+	assert.ErrorIs(t, err, ErrInvalidCredentials)
+	_, err = db.GetUser("cl_0123456789abcdef")
+	assert.Error(t, err)
+}
@@ -0,0 +1,92 @@
+package auth
+
+import (
+	"errors"
+	"net/url"
+	"strings"
+)
+
+// ScopeOpenID requests access to the userinfo endpoint, which tokens of a user have anyway
+const ScopeOpenID = "openid"
+
+// ErrDiscoveryUnavailable is returned when the issuer is not the public URL. OpenID Connect requires
+// the issuer to be the URL the discovery document is served at and to match the iss claim of tokens.
+var ErrDiscoveryUnavailable = errors.New("discovery requires the issuer to be the public URL")
+
+// OpenIDConfiguration is the OpenID Connect discovery document (OpenID Connect Discovery 1.0 section 3).
+// Tokens are only issued at the token endpoint, there is no authorization endpoint and there are
+// no ID tokens, so response types and ID token algorithms are not advertised.
+type OpenIDConfiguration struct {
+	Issuer                            string   `json:"issuer"`
+	TokenEndpoint                     string   `json:"token_endpoint"`
+	IntrospectionEndpoint             string   `json:"introspection_endpoint"`
+	JWKSURI                           string   `json:"jwks_uri"`
+	UserInfoEndpoint                  string   `json:"userinfo_endpoint"`
+	GrantTypesSupported               []string `json:"grant_types_supported"`
+	SubjectTypesSupported             []string `json:"subject_types_supported"`
+	TokenEndpointAuthMethodsSupported []string `json:"token_endpoint_auth_methods_supported"`
+	ScopesSupported                   []string `json:"scopes_supported"`
+	ClaimsSupported                   []string `json:"claims_supported"`
+	// IntrospectionEndpointAuthMethodsSupported is defined by RFC 8414 section 2
+	IntrospectionEndpointAuthMethodsSupported []string `json:"introspection_endpoint_auth_methods_supported"`
+}
+
+// UserInfo holds the standard claims of a user returned by the userinfo endpoint
+type UserInfo struct {
+	Subject           string `json:"sub"`
+	PreferredUsername string `json:"preferred_username"`
+	GivenName         string `json:"given_name,omitempty"`
+	FamilyName        string `json:"family_name,omitempty"`
+	Email             string `json:"email,omitempty"`
+	EmailVerified     *bool  `json:"email_verified,omitempty"`
+}
+
+// OpenIDConfiguration describes the issuer and its endpoints below the configured public URL.
+// It fails with ErrDiscoveryUnavailable unless the issuer is the public URL.
+func (a *Auth) OpenIDConfiguration() (OpenIDConfiguration, error) {
+	if !a.issuerIsPublicURL() {
+		return OpenIDConfiguration{}, ErrDiscoveryUnavailable
+	}
+	base := strings.TrimSuffix(a.config.PublicURL, "/")
+	return OpenIDConfiguration{
+		Issuer:                            a.config.Issuer,
+		TokenEndpoint:                     base + "/oauth/token",
+		IntrospectionEndpoint:             base + "/oauth/introspect",
+		JWKSURI:                           base + "/.well-known/jwks.json",
+		UserInfoEndpoint:                  base + "/userinfo",
+		GrantTypesSupported:               []string{GrantClientCredentials, GrantPassword, GrantRefreshToken},
+		SubjectTypesSupported:             []string{"public"},
+		TokenEndpointAuthMethodsSupported: []string{"client_secret_basic", "client_secret_post"},
+		ScopesSupported:                   []string{ScopeOpenID, RoleAdmin, RoleUser, RoleService},
+		ClaimsSupported:                   []string{"sub", "iss", "aud", "exp", "iat", "preferred_username", "given_name", "family_name", "email", "email_verified"},
+		IntrospectionEndpointAuthMethodsSupported: []string{"client_secret_basic", "client_secret_post"},
+	}, nil
+}
+
+// issuerIsPublicURL reports whether the issuer is an http(s) URL equal to the public URL
+func (a *Auth) issuerIsPublicURL() bool {
+	issuer, err := url.Parse(a.config.Issuer)
+	if err != nil || (issuer.Scheme != "https" && issuer.Scheme != "http") || issuer.Host == "" || issuer.RawQuery != "" || issuer.Fragment != "" {
+		return false
+	}
+	return strings.TrimSuffix(a.config.Issuer, "/") == strings.TrimSuffix(a.config.PublicURL, "/")
+}
+
+// UserInfo returns the standard claims of the user a token was issued to
+func (a *Auth) UserInfo(username string) (UserInfo, error) {
+	user, err := a.DB.GetUser(username)
+	if err != nil {
+		return UserInfo{}, ErrUserNotFound
+	}
+	info := UserInfo{
+		Subject:           user.Username,
+		PreferredUsername: user.Username,
+		GivenName:         user.FirstName,
+		FamilyName:        user.LastName,
+	}
+	if user.Email != "" {
+		info.Email = user.Email
+		info.EmailVerified = &user.EmailVerified
+	}
+	return info, nil
+}
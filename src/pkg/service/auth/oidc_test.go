@@ -0,0 +1,45 @@
+package auth
+
+import (
+	"github.com/BieggerM/userservice/pkg/models"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestDiscoveryRequiresIssuerToBePublicURL(t *testing.T) {
+	a, _, _ := setupService(t)
+	for issuer, ok := range map[string]bool{
+		"user-service":                        false,
+		"https://auth.example.com":            false,
+		"ftp://localhost:8082":                false,
+		"http://localhost:8082?tenant=1":      false,
+		"http://localhost:8082":               true,
+		"http://localhost:8082/":              true,
+		"https://localhost:8082/user-service": false,
+	} {
+		a.config.Issuer, a.config.PublicURL = issuer, "http://localhost:8082"
+		configuration, err := a.OpenIDConfiguration()
+		if !ok {
+			assert.ErrorIs(t, err, ErrDiscoveryUnavailable, issuer)
+			continue
+		}
+		assert.NoError(t, err, issuer)
+		assert.Equal(t, issuer, configuration.Issuer)
+		assert.Equal(t, "http://localhost:8082/oauth/token", configuration.TokenEndpoint)
+	}
+}
+
+func TestOpenIDScopeGrantsNoRole(t *testing.T) {
+	client := models.OAuthClient{ClientID: "cl_test", Scopes: []string{RoleUser, RoleService}, Audiences: []string{"recipemanagement"}}
+
+	g, err := clientGrant(client, []string{RoleUser, RoleService}, TokenRequest{Scope: "openid"})
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{RoleUser, RoleService}, g.scope)
+
+	g, err = clientGrant(client, []string{RoleUser, RoleService}, TokenRequest{Scope: "openid user"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{RoleUser}, g.scope)
+
+	_, err = clientGrant(client, []string{RoleUser}, TokenRequest{Scope: "openid admin"})
+	assert.Error(t, err)
+}
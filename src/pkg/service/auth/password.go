@@ -0,0 +1,225 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/BieggerM/userservice/pkg/models"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"strings"
+	"time"
+)
+
+var ErrInvalidHash = errors.New("invalid password hash")
+
+// Argon2Params are the argon2id parameters used to hash new passwords.
+// Hashes created with other parameters are upgraded on the next successful login.
+type Argon2Params struct {
+	Memory      uint32
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  uint32
+	KeyLength   uint32
+}
+
+// DefaultArgon2Params follow the OWASP recommendation for argon2id
+var DefaultArgon2Params = Argon2Params{
+	Memory:      64 * 1024,
+	Iterations:  3,
+	Parallelism: 2,
+	SaltLength:  16,
+	KeyLength:   32,
+}
+
+// HashPassword hashes a password with argon2id and encodes the parameters in the result
+func HashPassword(password string, params Argon2Params) (string, error) {
+	salt := make([]byte, params.SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, params.Iterations, params.Memory, params.Parallelism, params.KeyLength)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, params.Memory, params.Iterations, params.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// VerifyPassword compares a password with a stored hash in constant time.
+// needsRehash reports that the password matched but the hash should be replaced,
+// because it is a legacy plaintext value, a bcrypt hash or uses outdated parameters.
+func VerifyPassword(password, encoded string, params Argon2Params) (match bool, needsRehash bool) {
+	switch {
+	case encoded == "":
+		return false, false
+	case strings.HasPrefix(encoded, "$argon2id$"):
+		hashParams, salt, key, err := decodeArgon2Hash(encoded)
+		if err != nil {
+			return false, false
+		}
+		otherKey := argon2.IDKey([]byte(password), salt, hashParams.Iterations, hashParams.Memory, hashParams.Parallelism, uint32(len(key)))
+		if subtle.ConstantTimeCompare(key, otherKey) != 1 {
+			return false, false
+		}
+		hashParams.SaltLength = uint32(len(salt))
+		hashParams.KeyLength = uint32(len(key))
+		return true, hashParams != params
+	case isBcrypt(encoded):
+		return bcrypt.CompareHashAndPassword([]byte(encoded), []byte(password)) == nil, true
+	default:
+		// legacy rows from before passwords were hashed
+		return subtle.ConstantTimeCompare([]byte(password), []byte(encoded)) == 1, true
+	}
+}
+
+// IsHashed reports whether a stored password is already hashed
+func IsHashed(encoded string) bool {
+	return strings.HasPrefix(encoded, "$argon2id$") || isBcrypt(encoded)
+}
+
+// isBcrypt reports whether a stored password is a bcrypt hash of a version VerifyPassword accepts
+func isBcrypt(encoded string) bool {
+	return strings.HasPrefix(encoded, "$2a$") || strings.HasPrefix(encoded, "$2b$") || strings.HasPrefix(encoded, "$2y$")
+}
+
+func decodeArgon2Hash(encoded string) (Argon2Params, []byte, []byte, error) {
+	params := Argon2Params{}
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 {
+		return params, nil, nil, ErrInvalidHash
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return params, nil, nil, ErrInvalidHash
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Iterations, &params.Parallelism); err != nil {
+		return params, nil, nil, ErrInvalidHash
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return params, nil, nil, ErrInvalidHash
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return params, nil, nil, ErrInvalidHash
+	}
+	return params, salt, key, nil
+}
+
+var ErrUserNotFound = errors.New("user not found")
+
+// HashPassword hashes a password with the configured parameters
+func (a *Auth) HashPassword(password string) (string, error) {
+	return HashPassword(password, a.config.PasswordParams)
+}
+
+// Authenticate checks the password of a user with the credential backend of their account.
+// Logins unknown to the users table are tried against the external backends, which provision
+// the user on success. The user can be identified by username or by a verified email address.
+// Failed attempts are counted per account and per client address; after a few failures
+// every further attempt is delayed, and too many failures lock the account temporarily.
+// Logins without an account are delayed and locked the same way, so the answers do not
+// reveal which accounts exist.
+func (a *Auth) Authenticate(username, password, clientIP string) (models.User, error) {
+	now := time.Now()
+	if until, blocked := a.ipThrottle.blockedUntil(clientIP, now); blocked {
+		return models.User{}, &LockedError{Until: until}
+	}
+	user, err := a.lookupLogin(username)
+	if err != nil {
+		login := strings.ToLower(username)
+		if until, blocked := a.loginThrottle.blockedUntil(login, now); blocked {
+			return models.User{}, &LockedError{Until: until}
+		}
+		user, err = a.verifyExternal(username, password)
+		if err != nil {
+			if errors.Is(err, ErrInvalidCredentials) {
+				a.ipThrottle.fail(clientIP, now)
+				a.loginThrottle.fail(login, now)
+			}
+			return models.User{}, err
+		}
+		a.ipThrottle.succeed(clientIP)
+		a.loginThrottle.succeed(login)
+		return user, nil
+	}
+	username = user.Username
+	state, err := a.DB.GetLoginState(username)
+	if err != nil {
+		return models.User{}, err
+	}
+	if now.Before(state.LockedUntil) {
+		return models.User{}, &LockedError{Until: state.LockedUntil}
+	}
+	verifier := a.verifier(user.Source)
+	if verifier == nil {
+		logrus.Errorf("Rejecting login of %s, the %s credential backend is not configured", username, user.Source)
+		return models.User{}, ErrInvalidCredentials
+	}
+	verified, err := verifier.Verify(username, password)
+	if errors.Is(err, ErrInvalidCredentials) {
+		a.ipThrottle.fail(clientIP, now)
+		a.recordFailure(username, now)
+		return models.User{}, ErrInvalidCredentials
+	}
+	if err != nil {
+		return models.User{}, err
+	}
+	a.ipThrottle.succeed(clientIP)
+	if state.FailedLogins > 0 || !state.LockedUntil.IsZero() {
+		if err := a.DB.ResetLoginState(username); err != nil {
+			logrus.Errorf("Failed to reset failed logins of %s: %v", username, err)
+		}
+	}
+	if verifier.Source() == SourceLocal {
+		return verified, nil
+	}
+	if verified.Username != username {
+		// the directory entry found for the login belongs to someone else
+		logrus.Warnf("Rejecting %s login of %s, the directory returned %s", verifier.Source(), username, verified.Username)
+		return models.User{}, ErrInvalidCredentials
+	}
+	return a.syncExternal(user, verified)
+}
+
+// ChangePassword checks a new password against the policy, stores it for the user
+// and revokes all tokens issued to them
+func (a *Auth) ChangePassword(username, password string) error {
+	if err := a.requireLocal(username); err != nil {
+		return err
+	}
+	if err := a.CheckPassword(username, password); err != nil {
+		return err
+	}
+	hash, err := a.HashPassword(password)
+	if err != nil {
+		return err
+	}
+	if err := a.DB.UpdatePassword(username, hash); err != nil {
+		return err
+	}
+	return a.RevokeUserTokens(username)
+}
+
+// requireLocal fails for users whose password is managed by an external backend
+func (a *Auth) requireLocal(username string) error {
+	user, err := a.DB.GetUser(username)
+	if err != nil {
+		return err
+	}
+	if user.Source != "" && user.Source != SourceLocal {
+		return ErrExternalCredentials
+	}
+	return nil
+}
+
+func (a *Auth) rehashPassword(username, password string) error {
+	hash, err := a.HashPassword(password)
+	if err != nil {
+		return err
+	}
+	return a.DB.UpdatePassword(username, hash)
+}
@@ -0,0 +1,73 @@
+package auth
+
+import (
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+	"testing"
+)
+
+var testParams = Argon2Params{Memory: 1024, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32}
+
+func TestHashAndVerifyPassword(t *testing.T) {
+	hash, err := HashPassword("secret", testParams)
+	assert.NoError(t, err)
+	assert.True(t, IsHashed(hash))
+
+	match, needsRehash := VerifyPassword("secret", hash, testParams)
+	assert.True(t, match)
+	assert.False(t, needsRehash)
+
+	match, _ = VerifyPassword("wrong", hash, testParams)
+	assert.False(t, match)
+}
+
+func TestChangedParamsNeedRehash(t *testing.T) {
+	hash, err := HashPassword("secret", testParams)
+	assert.NoError(t, err)
+
+	stronger := testParams
+	stronger.Iterations = 2
+	match, needsRehash := VerifyPassword("secret", hash, stronger)
+	assert.True(t, match)
+	assert.True(t, needsRehash)
+}
+
+func TestLegacyPasswordsNeedRehash(t *testing.T) {
+	match, needsRehash := VerifyPassword("password", "password", testParams)
+	assert.True(t, match)
+	assert.True(t, needsRehash)
+
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.MinCost)
+	assert.NoError(t, err)
+	match, needsRehash = VerifyPassword("password", string(bcryptHash), testParams)
+	assert.True(t, match)
+	assert.True(t, needsRehash)
+
+	match, _ = VerifyPassword("", "", testParams)
+	assert.False(t, match)
+}
+
+func TestIsHashedMatchesVerifiedFormats(t *testing.T) {
+	for _, tc := range []struct {
+		encoded string
+		hashed  bool
+	}{
+		{"$2a$10$abcdefghijklmnopqrstuv", true},
+		{"$2b$10$abcdefghijklmnopqrstuv", true},
+		{"$2y$10$abcdefghijklmnopqrstuv", true},
+		// legacy plaintext passwords that merely look like bcrypt must still be migrated
+		{"$2x$10$abcdefghijklmnopqrstuv", false},
+		{"$2secret", false},
+		{"$argon2id$v=19$m=1024,t=1,p=1$c2FsdA$a2V5", true},
+		{"password", false},
+	} {
+		t.Run(tc.encoded, func(t *testing.T) {
+			assert.Equal(t, tc.hashed, IsHashed(tc.encoded))
+		})
+	}
+
+	// a plaintext password that looks like an unsupported bcrypt version still logs in
+	match, needsRehash := VerifyPassword("$2secret", "$2secret", testParams)
+	assert.True(t, match)
+	assert.True(t, needsRehash)
+}
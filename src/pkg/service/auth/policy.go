@@ -0,0 +1,109 @@
+package auth
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// PasswordPolicy defines the requirements for new passwords
+type PasswordPolicy struct {
+	MinLength int
+	// MaxLength bounds the work of hashing, argon2 accepts any length
+	MaxLength int
+	// MinCharClasses is the number of classes (lower case, upper case, digits, symbols) a password has to mix
+	MinCharClasses int
+	// DisallowUsername rejects passwords containing the username
+	DisallowUsername bool
+	// BreachedListFile is a file with one known breached password per line, empty disables the check
+	BreachedListFile string
+}
+
+// DefaultPasswordPolicy follows common recommendations for user chosen passwords
+var DefaultPasswordPolicy = PasswordPolicy{
+	MinLength:        12,
+	MaxLength:        128,
+	MinCharClasses:   3,
+	DisallowUsername: true,
+}
+
+// PolicyError lists every requirement a password does not meet
+type PolicyError struct {
+	Violations []string
+}
+
+func (e *PolicyError) Error() string {
+	return "password does not meet the policy: " + strings.Join(e.Violations, ", ")
+}
+
+// loadBreachedPasswords reads the blocklist, lines starting with # are comments
+func loadBreachedPasswords(path string) (map[string]struct{}, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open breached password list: %w", err)
+	}
+	defer file.Close()
+	breached := make(map[string]struct{})
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		breached[strings.ToLower(line)] = struct{}{}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read breached password list: %w", err)
+	}
+	return breached, nil
+}
+
+// checkPasswordPolicy returns a PolicyError if the password of the user does not meet the policy
+func checkPasswordPolicy(policy PasswordPolicy, breached map[string]struct{}, username, password string) error {
+	var violations []string
+	length := utf8.RuneCountInString(password)
+	if length < policy.MinLength {
+		violations = append(violations, fmt.Sprintf("must be at least %d characters long", policy.MinLength))
+	}
+	if policy.MaxLength > 0 && length > policy.MaxLength {
+		violations = append(violations, fmt.Sprintf("must be at most %d characters long", policy.MaxLength))
+	}
+	if classes := charClasses(password); classes < policy.MinCharClasses {
+		violations = append(violations, fmt.Sprintf("must contain at least %d of lower case letters, upper case letters, digits and symbols", policy.MinCharClasses))
+	}
+	if policy.DisallowUsername && username != "" && strings.Contains(strings.ToLower(password), strings.ToLower(username)) {
+		violations = append(violations, "must not contain the username")
+	}
+	if _, ok := breached[strings.ToLower(password)]; ok {
+		violations = append(violations, "is known from a data breach")
+	}
+	if len(violations) > 0 {
+		return &PolicyError{Violations: violations}
+	}
+	return nil
+}
+
+func charClasses(password string) int {
+	var lower, upper, digit, symbol int
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = 1
+		case unicode.IsUpper(r):
+			upper = 1
+		case unicode.IsDigit(r):
+			digit = 1
+		default:
+			symbol = 1
+		}
+	}
+	return lower + upper + digit + symbol
+}
+
+// CheckPassword checks a new password of the user against the password policy
+func (a *Auth) CheckPassword(username, password string) error {
+	return checkPasswordPolicy(a.config.PasswordPolicy, a.breached, username, password)
+}
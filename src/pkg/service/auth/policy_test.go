@@ -0,0 +1,23 @@
+package auth
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestPasswordPolicy(t *testing.T) {
+	breached := map[string]struct{}{"correcthorse1!": {}}
+	check := func(username, password string) []string {
+		err := checkPasswordPolicy(DefaultPasswordPolicy, breached, username, password)
+		if err == nil {
+			return nil
+		}
+		return err.(*PolicyError).Violations
+	}
+
+	assert.Empty(t, check("jane", "Recipes-for-2024"))
+	assert.Len(t, check("jane", ""), 2)
+	assert.Equal(t, []string{"must not contain the username"}, check("jane", "Jane-Doe-2024!"))
+	assert.Equal(t, []string{"is known from a data breach"}, check("jane", "CorrectHorse1!"))
+	assert.Len(t, check("jane", "alllowercaseletters"), 1)
+}
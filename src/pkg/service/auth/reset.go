@@ -0,0 +1,94 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/BieggerM/userservice/pkg/models"
+	"github.com/sirupsen/logrus"
+	"time"
+)
+
+const purposePasswordReset = "password_reset"
+
+// ErrInvalidResetToken is returned for unknown, expired and already used reset tokens
+var ErrInvalidResetToken = errors.New("invalid or expired reset token")
+
+// RequestPasswordReset creates a reset token for the user and publishes it for delivery by the mail service.
+// Requests are limited per username and client address, known or not, see throttleRequest.
+// Unknown users are ignored without an error. Like for login links, every request does the same work
+// before it returns and the token is stored and published afterwards, so callers can find out which
+// usernames exist neither from the answer nor from its timing.
+func (a *Auth) RequestPasswordReset(username, clientIP string) error {
+	if err := a.throttleRequest(username, clientIP); err != nil {
+		return err
+	}
+	if err := a.DB.DeleteExpiredOneTimeTokens(); err != nil {
+		logrus.Errorf("Failed to delete expired one-time tokens: %v", err)
+	}
+	token, err := randomToken()
+	if err != nil {
+		return err
+	}
+	// passwords of external users cannot be reset here, which is not revealed either
+	if err := a.requireLocal(username); err != nil {
+		return nil
+	}
+	a.deliveries.Add(1)
+	go func() {
+		defer a.deliveries.Done()
+		if err := a.sendPasswordReset(username, token); err != nil {
+			logrus.Errorf("Failed to send password reset to %s: %v", username, err)
+		}
+	}()
+	return nil
+}
+
+// sendPasswordReset stores the reset token of the user and publishes it
+func (a *Auth) sendPasswordReset(username, token string) error {
+	expiresAt := time.Now().Add(a.config.PasswordResetTTL)
+	if err := a.DB.SaveOneTimeToken(models.OneTimeToken{
+		TokenHash: hashToken(token),
+		Purpose:   purposePasswordReset,
+		Username:  username,
+		ExpiresAt: expiresAt,
+	}); err != nil {
+		return err
+	}
+	// the event is the only place the token appears in plain text, it must never be logged
+	msgBody, err := json.Marshal(map[string]interface{}{
+		"username":   username,
+		"token":      token,
+		"expires_at": expiresAt.UTC().Format(time.RFC3339),
+	})
+	if err != nil {
+		return err
+	}
+	return a.MB.Publish(eventExchange, "users.password_reset_requested", msgBody)
+}
+
+// ResetPassword sets a new password using a reset token. The token can be used once,
+// other outstanding reset tokens of the user are invalidated and a lockout is lifted.
+func (a *Auth) ResetPassword(token, password string) (string, error) {
+	// the policy is checked before the token is consumed, so a rejected password can be corrected
+	pending, err := a.DB.GetOneTimeToken(hashToken(token), purposePasswordReset)
+	if err != nil {
+		return "", ErrInvalidResetToken
+	}
+	if err := a.CheckPassword(pending.Username, password); err != nil {
+		return "", err
+	}
+	stored, err := a.DB.ConsumeOneTimeToken(hashToken(token), purposePasswordReset)
+	if err != nil {
+		return "", ErrInvalidResetToken
+	}
+	if err := a.ChangePassword(stored.Username, password); err != nil {
+		return "", err
+	}
+	if err := a.DB.InvalidateOneTimeTokens(stored.Username, purposePasswordReset); err != nil {
+		logrus.Errorf("Failed to invalidate reset tokens of %s: %v", stored.Username, err)
+	}
+	if err := a.DB.ResetLoginState(stored.Username); err != nil {
+		logrus.Errorf("Failed to reset failed logins of %s: %v", stored.Username, err)
+	}
+	return stored.Username, nil
+}
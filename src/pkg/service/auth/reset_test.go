@@ -0,0 +1,133 @@
+package auth
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/BieggerM/userservice/pkg/adapter/out/broker/brokertest"
+	"github.com/BieggerM/userservice/pkg/models"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+// requestReset requests a password reset for user1 and returns the token delivered to the mail service
+func requestReset(t *testing.T, a *Auth, mb *brokertest.Recorder) string {
+	assert.NoError(t, a.RequestPasswordReset("user1", "10.0.0.1"))
+	a.deliveries.Wait()
+	messages := mb.Messages("users.password_reset_requested")
+	assert.NotEmpty(t, messages)
+	var event struct {
+		Token string `json:"token"`
+	}
+	assert.NoError(t, json.Unmarshal(messages[len(messages)-1].Body, &event))
+	assert.NotEmpty(t, event.Token)
+	return event.Token
+}
+
+func TestResetTokenIsSingleUse(t *testing.T) {
+	a, db, mb := setupService(t)
+	a.config.PasswordResetTTL = time.Hour
+	token := requestReset(t, a, mb)
+
+	// only the hash is stored
+	stored := db.OneTimeTokens("user1")
+	assert.Len(t, stored, 1)
+	assert.Equal(t, hashToken(token), stored[0].TokenHash)
+	assert.NotEqual(t, token, stored[0].TokenHash)
+
+	username, err := a.ResetPassword(token, "Brand new passphrase 42")
+	assert.NoError(t, err)
+	assert.Equal(t, "user1", username)
+	_, err = a.ResetPassword(token, "Another passphrase 42")
+	assert.ErrorIs(t, err, ErrInvalidResetToken)
+	_, err = a.Authenticate("user1", "Brand new passphrase 42", "")
+	assert.NoError(t, err)
+}
+
+func TestResetTokenExpires(t *testing.T) {
+	a, db, mb := setupService(t)
+	a.config.PasswordResetTTL = time.Hour
+	token := requestReset(t, a, mb)
+
+	db.Now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+	_, err := a.ResetPassword(token, "Brand new passphrase 42")
+	assert.ErrorIs(t, err, ErrInvalidResetToken)
+}
+
+func TestResetRevokesTokensAndOtherResets(t *testing.T) {
+	a, db, mb := setupService(t)
+	a.config.PasswordResetTTL = time.Hour
+	user, err := db.GetUser("user1")
+	assert.NoError(t, err)
+	pair, err := a.IssueTokens(user, "", ClientInfo{})
+	assert.NoError(t, err)
+	first := requestReset(t, a, mb)
+	second := requestReset(t, a, mb)
+	for i := 0; i < maxFailedLogins; i++ {
+		a.Authenticate("user1", "wrong password", "")
+	}
+
+	_, err = a.ResetPassword(second, "Brand new passphrase 42")
+	assert.NoError(t, err)
+	_, err = a.ValidateJWT(pair.AccessToken)
+	assert.Error(t, err)
+	_, err = a.RefreshTokens(pair.RefreshToken, ClientInfo{})
+	assert.Error(t, err)
+	_, err = a.ResetPassword(first, "Another passphrase 42")
+	assert.ErrorIs(t, err, ErrInvalidResetToken)
+	// the lockout is lifted
+	_, err = a.Authenticate("user1", "Brand new passphrase 42", "")
+	assert.NoError(t, err)
+}
+
+func TestResetTokenIsNotLogged(t *testing.T) {
+	var logs bytes.Buffer
+	output, level := logrus.StandardLogger().Out, logrus.GetLevel()
+	logrus.SetOutput(&logs)
+	logrus.SetLevel(logrus.TraceLevel)
+	defer func() {
+		logrus.SetOutput(output)
+		logrus.SetLevel(level)
+	}()
+
+	a, _, mb := setupService(t)
+	a.config.PasswordResetTTL = time.Hour
+	token := requestReset(t, a, mb)
+	_, err := a.ResetPassword(token, "Brand new passphrase 42")
+	assert.NoError(t, err)
+	assert.NotContains(t, logs.String(), token)
+	assert.NotContains(t, logs.String(), hashToken(token))
+}
+
+func TestResetOnlyForLocalUsers(t *testing.T) {
+	a, db, mb := setupService(t)
+	a.config.PasswordResetTTL = time.Hour
+	assert.NoError(t, db.SaveUser(models.User{Username: "jdoe", Source: SourceLDAP, Roles: []string{RoleUser}}))
+	for _, username := range []string{"nobody", "jdoe"} {
+		assert.NoError(t, a.RequestPasswordReset(username, "10.0.0.1"))
+	}
+	a.deliveries.Wait()
+	assert.Empty(t, mb.Messages("users.password_reset_requested"))
+	assert.Empty(t, db.OneTimeTokens("jdoe"))
+}
+
+func TestResetRequestsAreThrottled(t *testing.T) {
+	a, _, _ := setupService(t)
+	a.config.PasswordResetTTL = time.Hour
+	for _, username := range []string{"user1", "nobody"} {
+		for i := 0; i < requestFreeAttempts; i++ {
+			assert.NoError(t, a.RequestPasswordReset(username, fmt.Sprintf("10.0.0.%d", i)))
+		}
+		var throttled *ThrottledError
+		assert.ErrorAs(t, a.RequestPasswordReset(username, "10.0.1.1"), &throttled)
+	}
+
+	// and per client address across usernames
+	for i := 0; i < ipFreeAttempts; i++ {
+		assert.NoError(t, a.RequestPasswordReset(fmt.Sprintf("someone%d", i), "10.0.2.1"))
+	}
+	var throttled *ThrottledError
+	assert.ErrorAs(t, a.RequestPasswordReset("someone else", "10.0.2.1"), &throttled)
+}
@@ -0,0 +1,123 @@
+package auth
+
+import (
+	"errors"
+	"github.com/BieggerM/userservice/pkg/adapter/out/database"
+	"github.com/BieggerM/userservice/pkg/models"
+	"github.com/sirupsen/logrus"
+	"sync"
+	"time"
+)
+
+// revocationReloadInterval defines how often revocations made by other replicas are picked up
+const revocationReloadInterval = 30 * time.Second
+
+var ErrTokenRevoked = errors.New("token has been revoked")
+
+// RevocationStore is the denylist of revoked access tokens. Revocations are persisted
+// in the database and cached in memory, so validating a token needs no database query.
+type RevocationStore struct {
+	DB database.Database
+	// MaxTokenAge is the time after which access tokens of a revoked session have expired
+	MaxTokenAge time.Duration
+	mu          sync.RWMutex
+	tokens      map[string]time.Time
+	users       map[string]time.Time
+	sessions    map[string]time.Time
+}
+
+// Load replaces the cache with the revocations stored in the database
+func (r *RevocationStore) Load() error {
+	revokedTokens, err := r.DB.ListRevokedTokens()
+	if err != nil {
+		return err
+	}
+	users, err := r.DB.ListUserTokenRevocations()
+	if err != nil {
+		return err
+	}
+	sessions, err := r.DB.ListRevokedSessions(time.Now().Add(-r.MaxTokenAge))
+	if err != nil {
+		return err
+	}
+	tokens := make(map[string]time.Time, len(revokedTokens))
+	for _, token := range revokedTokens {
+		tokens[token.JTI] = token.ExpiresAt
+	}
+	r.mu.Lock()
+	r.tokens = tokens
+	r.users = users
+	r.sessions = sessions
+	r.mu.Unlock()
+	return nil
+}
+
+// watch periodically reloads the cache and removes expired entries from the database
+func (r *RevocationStore) watch() {
+	for range time.Tick(revocationReloadInterval) {
+		if err := r.DB.DeleteExpiredRevokedTokens(); err != nil {
+			logrus.Errorf("Failed to delete expired revocations: %v", err)
+		}
+		if err := r.Load(); err != nil {
+			logrus.Errorf("Failed to reload revocations: %v", err)
+		}
+	}
+}
+
+// IsRevoked reports whether the token itself, its session or all tokens of its user have been revoked
+func (r *RevocationStore) IsRevoked(claims *Claims) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if _, ok := r.tokens[claims.Id]; ok {
+		return true
+	}
+	if _, ok := r.sessions[claims.SessionID]; ok && claims.SessionID != "" {
+		return true
+	}
+	revokedAt, ok := r.users[claims.UserID]
+	if !ok {
+		return false
+	}
+	if claims.IssuedAtMillis == 0 {
+		// tokens issued before iat_ms was added
+		return claims.IssuedAt <= revokedAt.Unix()
+	}
+	return claims.IssuedAtMillis <= revokedAt.UnixMilli()
+}
+
+// RevokeToken adds a single access token to the denylist
+func (r *RevocationStore) RevokeToken(claims *Claims) error {
+	expiresAt := time.Unix(claims.ExpiresAt, 0)
+	err := r.DB.RevokeToken(models.RevokedToken{JTI: claims.Id, Username: claims.UserID, ExpiresAt: expiresAt})
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	r.tokens[claims.Id] = expiresAt
+	r.mu.Unlock()
+	return nil
+}
+
+// RevokeUser revokes all access and refresh tokens issued to a user until now
+func (r *RevocationStore) RevokeUser(username string) error {
+	now := time.Now()
+	if err := r.DB.RevokeUserTokens(username, now); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	r.users[username] = now
+	r.mu.Unlock()
+	return nil
+}
+
+// RevokeSession revokes a session with its refresh tokens and rejects its access tokens
+func (r *RevocationStore) RevokeSession(id string) error {
+	now := time.Now()
+	if err := r.DB.RevokeSession(id, now); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	r.sessions[id] = now
+	r.mu.Unlock()
+	return nil
+}
@@ -0,0 +1,123 @@
+package auth
+
+import (
+	"github.com/BieggerM/userservice/pkg/models"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestTokensIssuedAfterUserRevocationInSameSecondAreValid(t *testing.T) {
+	a, db, _ := setupService(t)
+	user, err := db.GetUser("user1")
+	assert.NoError(t, err)
+	before, err := a.GenerateJWT(user, "")
+	assert.NoError(t, err)
+
+	assert.NoError(t, a.revocations.RevokeUser("user1"))
+	time.Sleep(2 * time.Millisecond)
+	after, err := a.GenerateJWT(user, "")
+	assert.NoError(t, err)
+
+	_, err = a.ValidateJWT(before)
+	assert.ErrorIs(t, err, ErrTokenRevoked)
+	_, err = a.ValidateJWT(after)
+	assert.NoError(t, err)
+}
+
+func TestUserRevocationComparesMilliseconds(t *testing.T) {
+	revokedAt := time.Unix(1700000000, int64(500*time.Millisecond))
+	store := &RevocationStore{users: map[string]time.Time{"user1": revokedAt}}
+
+	for _, tc := range []struct {
+		name     string
+		issuedAt time.Time
+		revoked  bool
+	}{
+		{"same second before", revokedAt.Add(-time.Millisecond), true},
+		{"same millisecond", revokedAt, true},
+		{"same second after", revokedAt.Add(time.Millisecond), false},
+		{"later second", revokedAt.Add(time.Second), false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			claims := &Claims{UserID: "user1", IssuedAtMillis: tc.issuedAt.UnixMilli()}
+			claims.IssuedAt = tc.issuedAt.Unix()
+			assert.Equal(t, tc.revoked, store.IsRevoked(claims))
+		})
+	}
+
+	// tokens without iat_ms can only be compared by the second
+	claims := &Claims{UserID: "user1"}
+	claims.IssuedAt = revokedAt.Unix()
+	assert.True(t, store.IsRevoked(claims))
+}
+
+func TestLogoutRevokesTokenAndSession(t *testing.T) {
+	a, db, _ := setupService(t)
+	user, err := db.GetUser("user1")
+	assert.NoError(t, err)
+	pair, err := a.IssueTokens(user, "", ClientInfo{})
+	assert.NoError(t, err)
+	other, err := a.IssueTokens(user, "", ClientInfo{})
+	assert.NoError(t, err)
+
+	assert.NoError(t, a.Logout(pair.AccessToken, ""))
+	_, err = a.ValidateJWT(pair.AccessToken)
+	assert.ErrorIs(t, err, ErrTokenRevoked)
+	_, err = a.RefreshTokens(pair.RefreshToken, ClientInfo{})
+	assert.ErrorIs(t, err, ErrInvalidRefreshToken)
+	assert.ErrorIs(t, a.Logout(pair.AccessToken, ""), ErrTokenRevoked)
+
+	// other logins of the user are not affected
+	_, err = a.ValidateJWT(other.AccessToken)
+	assert.NoError(t, err)
+	_, err = a.RefreshTokens(other.RefreshToken, ClientInfo{})
+	assert.NoError(t, err)
+}
+
+func TestLogoutWithoutSessionRevokesGivenRefreshToken(t *testing.T) {
+	a, db, _ := setupService(t)
+	assert.NoError(t, db.SaveUser(models.User{Username: "user2", Roles: []string{RoleUser}}))
+	user, err := db.GetUser("user1")
+	assert.NoError(t, err)
+	token, err := a.GenerateJWT(user, "")
+	assert.NoError(t, err)
+	pair, err := a.IssueTokens(user, "", ClientInfo{})
+	assert.NoError(t, err)
+	user2, err := db.GetUser("user2")
+	assert.NoError(t, err)
+	foreign, err := a.IssueTokens(user2, "", ClientInfo{})
+	assert.NoError(t, err)
+
+	// refresh tokens of other users cannot be revoked
+	assert.ErrorIs(t, a.Logout(token, foreign.RefreshToken), ErrInvalidRefreshToken)
+	_, err = a.RefreshTokens(foreign.RefreshToken, ClientInfo{})
+	assert.NoError(t, err)
+
+	token, err = a.GenerateJWT(user, "")
+	assert.NoError(t, err)
+	assert.NoError(t, a.Logout(token, pair.RefreshToken))
+	_, err = a.ValidateJWT(token)
+	assert.ErrorIs(t, err, ErrTokenRevoked)
+	_, err = a.RefreshTokens(pair.RefreshToken, ClientInfo{})
+	assert.ErrorIs(t, err, ErrInvalidRefreshToken)
+}
+
+func TestRevocationsReachOtherReplicas(t *testing.T) {
+	a, db, _ := setupService(t)
+	user, err := db.GetUser("user1")
+	assert.NoError(t, err)
+	token, err := a.GenerateJWT(user, "")
+	assert.NoError(t, err)
+	claims, err := a.ValidateJWT(token)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, claims.Id)
+
+	replica := &RevocationStore{DB: db, MaxTokenAge: time.Hour}
+	assert.NoError(t, replica.Load())
+	assert.False(t, replica.IsRevoked(claims))
+
+	assert.NoError(t, a.Logout(token, ""))
+	assert.NoError(t, replica.Load())
+	assert.True(t, replica.IsRevoked(claims))
+}
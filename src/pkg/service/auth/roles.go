@@ -0,0 +1,54 @@
+package auth
+
+import "errors"
+
+// ErrImpersonated is returned for changes to credentials or identity made with an impersonation token
+var ErrImpersonated = errors.New("impersonation tokens cannot change credentials, email addresses or sessions")
+
+const (
+	RoleAdmin   = "admin"
+	RoleUser    = "user"
+	RoleService = "service"
+)
+
+// DefaultRoles are assigned to users created without explicit roles
+var DefaultRoles = []string{RoleUser}
+
+// IsKnownRole reports whether a role can be assigned to users
+func IsKnownRole(role string) bool {
+	return role == RoleAdmin || role == RoleUser || role == RoleService
+}
+
+// HasAnyRole reports whether the claims contain at least one of the given roles
+func (c *Claims) HasAnyRole(roles ...string) bool {
+	for _, have := range c.Roles {
+		for _, want := range roles {
+			if have == want {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// CanRead reports whether the caller may read the account of target.
+// Users may only read their own account, admins and services may read any.
+func (c *Claims) CanRead(target string) bool {
+	return c.UserID == target || c.HasAnyRole(RoleAdmin, RoleService)
+}
+
+// CanModify reports whether the caller may change or delete the account of target.
+// Users may only modify their own account, admins may modify any.
+func (c *Claims) CanModify(target string) bool {
+	return c.UserID == target || c.HasAnyRole(RoleAdmin)
+}
+
+// CheckNotImpersonated rejects callers acting on behalf of someone else. Passwords, email addresses,
+// second factors, API keys and sessions stay under the control of their owner, support staff
+// impersonating a user may look but not take over the account.
+func (c *Claims) CheckNotImpersonated() error {
+	if c.Actor != nil {
+		return ErrImpersonated
+	}
+	return nil
+}
@@ -0,0 +1,29 @@
+package auth
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestAccountOwnership(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		roles     []string
+		target    string
+		canRead   bool
+		canModify bool
+	}{
+		{"user on own account", []string{RoleUser}, "user1", true, true},
+		{"user on other account", []string{RoleUser}, "user2", false, false},
+		{"service on own account", []string{RoleService}, "user1", true, true},
+		{"service on other account", []string{RoleService}, "user2", true, false},
+		{"admin on other account", []string{RoleAdmin}, "user2", true, true},
+		{"no roles on other account", nil, "user2", false, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			claims := &Claims{UserID: "user1", Roles: tc.roles}
+			assert.Equal(t, tc.canRead, claims.CanRead(tc.target))
+			assert.Equal(t, tc.canModify, claims.CanModify(tc.target))
+		})
+	}
+}
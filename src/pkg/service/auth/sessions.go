@@ -0,0 +1,68 @@
+package auth
+
+import (
+	"errors"
+	"github.com/BieggerM/userservice/pkg/models"
+	"github.com/sirupsen/logrus"
+	"sync"
+	"time"
+)
+
+const (
+	// touchInterval limits how often the last use of a session or API key is written to the database
+	touchInterval = time.Minute
+	// maxTrackedTouches bounds the memory used to remember recent writes, which are forgotten when it is reached
+	maxTrackedTouches = 10000
+)
+
+var ErrSessionNotFound = errors.New("session not found")
+
+// ClientInfo describes the client a login or refresh comes from
+type ClientInfo struct {
+	IP        string
+	UserAgent string
+}
+
+// ListSessions returns the active sessions of a user, most recently used first
+func (a *Auth) ListSessions(username string) ([]models.Session, error) {
+	return a.DB.ListSessions(username)
+}
+
+// RevokeSession ends a session of the user: its refresh tokens are revoked
+// and its access tokens are rejected from then on
+func (a *Auth) RevokeSession(username, id string) error {
+	session, err := a.DB.GetSession(id)
+	if err != nil || session.Username != username {
+		return ErrSessionNotFound
+	}
+	return a.revocations.RevokeSession(id)
+}
+
+// touches remembers when the last use of each session or API key was written
+type touches struct {
+	mu      sync.Mutex
+	touched map[string]time.Time
+}
+
+// due reports whether the last use of the session or key should be written again
+func (t *touches) due(id string, now time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.touched == nil || len(t.touched) >= maxTrackedTouches {
+		t.touched = make(map[string]time.Time)
+	}
+	if now.Sub(t.touched[id]) < touchInterval {
+		return false
+	}
+	t.touched[id] = now
+	return true
+}
+
+func (a *Auth) touchSession(id string) {
+	if !a.sessionTouches.due(id, time.Now()) {
+		return
+	}
+	if err := a.DB.TouchSession(id); err != nil {
+		logrus.Errorf("Failed to record use of session %s: %v", id, err)
+	}
+}
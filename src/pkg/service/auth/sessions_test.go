@@ -0,0 +1,109 @@
+package auth
+
+import (
+	"fmt"
+	"github.com/BieggerM/userservice/pkg/models"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestSessionsBelongToTheirUser(t *testing.T) {
+	a, db, _ := setupService(t)
+	assert.NoError(t, db.SaveUser(models.User{Username: "user2", Roles: []string{RoleUser}}))
+	user1, err := db.GetUser("user1")
+	assert.NoError(t, err)
+	user2, err := db.GetUser("user2")
+	assert.NoError(t, err)
+	_, err = a.IssueTokens(user1, "", ClientInfo{IP: "10.0.0.1", UserAgent: "firefox"})
+	assert.NoError(t, err)
+	_, err = a.IssueTokens(user2, "", ClientInfo{IP: "10.0.0.2"})
+	assert.NoError(t, err)
+
+	sessions, err := a.ListSessions("user1")
+	assert.NoError(t, err)
+	assert.Len(t, sessions, 1)
+	assert.Equal(t, "user1", sessions[0].Username)
+	assert.Equal(t, "10.0.0.1", sessions[0].IP)
+	assert.Equal(t, "firefox", sessions[0].UserAgent)
+	others, err := a.ListSessions("user2")
+	assert.NoError(t, err)
+	assert.Len(t, others, 1)
+
+	// a session of another user is reported as unknown and stays active
+	assert.ErrorIs(t, a.RevokeSession("user2", sessions[0].ID), ErrSessionNotFound)
+	assert.ErrorIs(t, a.RevokeSession("user1", "unknown"), ErrSessionNotFound)
+	sessions, err = a.ListSessions("user1")
+	assert.NoError(t, err)
+	assert.Len(t, sessions, 1)
+
+	assert.NoError(t, a.RevokeSession("user1", sessions[0].ID))
+	sessions, err = a.ListSessions("user1")
+	assert.NoError(t, err)
+	assert.Empty(t, sessions)
+	others, err = a.ListSessions("user2")
+	assert.NoError(t, err)
+	assert.Len(t, others, 1)
+}
+
+func TestRevokingSessionEndsItsLogin(t *testing.T) {
+	a, db, _ := setupService(t)
+	user, err := db.GetUser("user1")
+	assert.NoError(t, err)
+	first, err := a.IssueTokens(user, "", ClientInfo{})
+	assert.NoError(t, err)
+	// tokens rotated within the session belong to it as well
+	second, err := a.RefreshTokens(first.RefreshToken, ClientInfo{})
+	assert.NoError(t, err)
+	other, err := a.IssueTokens(user, "", ClientInfo{})
+	assert.NoError(t, err)
+	claims, err := a.ValidateJWT(second.AccessToken)
+	assert.NoError(t, err)
+
+	assert.NoError(t, a.RevokeSession("user1", claims.SessionID))
+	for _, token := range []string{first.AccessToken, second.AccessToken} {
+		_, err = a.ValidateJWT(token)
+		assert.ErrorIs(t, err, ErrTokenRevoked)
+	}
+	_, err = a.RefreshTokens(second.RefreshToken, ClientInfo{})
+	assert.ErrorIs(t, err, ErrInvalidRefreshToken)
+
+	_, err = a.ValidateJWT(other.AccessToken)
+	assert.NoError(t, err)
+	_, err = a.RefreshTokens(other.RefreshToken, ClientInfo{})
+	assert.NoError(t, err)
+
+	// other replicas learn of the revocation from the database
+	replica := &RevocationStore{DB: db, MaxTokenAge: time.Hour}
+	assert.NoError(t, replica.Load())
+	assert.True(t, replica.IsRevoked(claims))
+}
+
+func TestSessionUseIsRecordedOncePerInterval(t *testing.T) {
+	a, db, _ := setupService(t)
+	user, err := db.GetUser("user1")
+	assert.NoError(t, err)
+	pair, err := a.IssueTokens(user, "", ClientInfo{})
+	assert.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		_, err = a.ValidateJWT(pair.AccessToken)
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, 1, db.SessionTouches())
+}
+
+func TestTouchesAreDebounced(t *testing.T) {
+	var touched touches
+	now := time.Now()
+	assert.True(t, touched.due("s1", now))
+	assert.False(t, touched.due("s1", now.Add(touchInterval-time.Second)))
+	assert.True(t, touched.due("s2", now))
+	assert.True(t, touched.due("s1", now.Add(touchInterval)))
+
+	// the memory is bounded, forgetting everything at worst writes once more
+	for i := 0; len(touched.touched) < maxTrackedTouches; i++ {
+		touched.due(fmt.Sprintf("id%d", i), now)
+	}
+	assert.True(t, touched.due("s2", now.Add(time.Second)))
+	assert.Len(t, touched.touched, 1)
+}
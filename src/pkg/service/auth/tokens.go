@@ -0,0 +1,184 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/BieggerM/userservice/pkg/models"
+	"strings"
+	"time"
+)
+
+var (
+	ErrInvalidRefreshToken = errors.New("invalid refresh token")
+	ErrRefreshTokenReused  = errors.New("refresh token reuse detected")
+)
+
+// TokenPair is the result of a successful login or refresh
+type TokenPair struct {
+	AccessToken  string `json:"jwt"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int64  `json:"expires_in"`
+	// Scope is only set for tokens issued to an OAuth2 client
+	Scope string `json:"scope,omitempty"`
+}
+
+// grant describes what an access token is issued for. A nil scope grants all roles of the user,
+// a zero ttl the configured token lifetime.
+type grant struct {
+	audience string
+	clientID string
+	scope    []string
+	actor    *Actor
+	ttl      time.Duration
+	// secondFactor is set once the user passed two-factor authentication
+	secondFactor bool
+}
+
+// IssueTokens creates an access token and a refresh token for the audience, starting a new session
+// whose id is used as token family. Users with two-factor authentication get an MFARequiredError
+// instead, their tokens are issued by VerifyMFA.
+func (a *Auth) IssueTokens(user models.User, audience string, client ClientInfo) (TokenPair, error) {
+	pair, err := a.startSession(user, grant{audience: audience}, client)
+	if !errors.Is(err, ErrMFARequired) {
+		return pair, err
+	}
+	mfaToken, err := a.StartMFA(user)
+	if err != nil {
+		return TokenPair{}, err
+	}
+	return TokenPair{}, &MFARequiredError{MFAToken: mfaToken}
+}
+
+// startSession issues the tokens of a new login, which requires the second factor of users with two-factor authentication
+func (a *Auth) startSession(user models.User, g grant, client ClientInfo) (TokenPair, error) {
+	audience, err := a.audience(g.audience)
+	if err != nil {
+		return TokenPair{}, err
+	}
+	if err := a.requireSecondFactor(user, g); err != nil {
+		return TokenPair{}, err
+	}
+	familyID, err := randomHex(16)
+	if err != nil {
+		return TokenPair{}, err
+	}
+	err = a.DB.SaveSession(models.Session{
+		ID:        familyID,
+		Username:  user.Username,
+		Audience:  audience,
+		IP:        client.IP,
+		UserAgent: client.UserAgent,
+		ExpiresAt: time.Now().Add(a.config.RefreshTokenTTL),
+	})
+	if err != nil {
+		return TokenPair{}, fmt.Errorf("failed to save session: %w", err)
+	}
+	g.audience = audience
+	return a.issueTokens(user, g, familyID)
+}
+
+// RefreshTokens exchanges a refresh token for a new token pair. Every refresh token
+// can be used once; presenting a used token again revokes its whole family and session.
+// Tokens issued to an OAuth2 client can only be refreshed at the token endpoint.
+func (a *Auth) RefreshTokens(refreshToken string, client ClientInfo) (TokenPair, error) {
+	return a.refreshTokens(refreshToken, "", client)
+}
+
+func (a *Auth) refreshTokens(refreshToken, clientID string, client ClientInfo) (TokenPair, error) {
+	stored, err := a.DB.GetRefreshToken(hashToken(refreshToken))
+	if err != nil || stored.Revoked || time.Now().After(stored.ExpiresAt) || stored.ClientID != clientID {
+		return TokenPair{}, ErrInvalidRefreshToken
+	}
+	if stored.Used {
+		return TokenPair{}, a.revokeFamily(stored.FamilyID)
+	}
+	marked, err := a.DB.MarkRefreshTokenUsed(stored.TokenHash)
+	if err != nil {
+		return TokenPair{}, err
+	}
+	if !marked {
+		// another request used the token at the same time
+		return TokenPair{}, a.revokeFamily(stored.FamilyID)
+	}
+	// load the user again so changed roles take effect on refresh
+	user, err := a.DB.GetUser(stored.Username)
+	if err != nil {
+		return TokenPair{}, ErrInvalidRefreshToken
+	}
+	if err := a.DB.RefreshSession(stored.FamilyID, client.IP, client.UserAgent, time.Now().Add(a.config.RefreshTokenTTL)); err != nil {
+		return TokenPair{}, fmt.Errorf("failed to update session: %w", err)
+	}
+	g := grant{audience: stored.Audience, clientID: stored.ClientID}
+	if stored.Scope != "" {
+		g.scope = strings.Fields(stored.Scope)
+	}
+	return a.issueTokens(user, g, stored.FamilyID)
+}
+
+func (a *Auth) issueTokens(user models.User, g grant, familyID string) (TokenPair, error) {
+	accessToken, err := a.generateJWT(user, g, familyID)
+	if err != nil {
+		return TokenPair{}, err
+	}
+	refreshToken, err := randomToken()
+	if err != nil {
+		return TokenPair{}, err
+	}
+	err = a.DB.SaveRefreshToken(models.RefreshToken{
+		TokenHash: hashToken(refreshToken),
+		FamilyID:  familyID,
+		Username:  user.Username,
+		Audience:  g.audience,
+		ClientID:  g.clientID,
+		Scope:     strings.Join(g.scope, " "),
+		ExpiresAt: time.Now().Add(a.config.RefreshTokenTTL),
+	})
+	if err != nil {
+		return TokenPair{}, fmt.Errorf("failed to save refresh token: %w", err)
+	}
+	pair := TokenPair{
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
+		ExpiresIn:    int64(a.config.TokenTTL.Seconds()),
+	}
+	if g.scope != nil {
+		pair.Scope = strings.Join(intersectRoles(user.Roles, g.scope), " ")
+	}
+	return pair, nil
+}
+
+// revokeFamily ends the session a reused refresh token belongs to, which revokes its refresh tokens
+// and rejects the access tokens issued to the thief as well as those of the user
+func (a *Auth) revokeFamily(familyID string) error {
+	if err := a.revocations.RevokeSession(familyID); err != nil {
+		return fmt.Errorf("failed to revoke token family: %w", err)
+	}
+	return ErrRefreshTokenReused
+}
+
+// randomToken returns a URL safe token with 256 bits of entropy
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// hashToken hashes high-entropy tokens for storage, a fast hash is sufficient for those
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,87 @@
+package auth
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestRefreshRotatesTokens(t *testing.T) {
+	a, db, _ := setupService(t)
+	user, err := db.GetUser("user1")
+	assert.NoError(t, err)
+	first, err := a.IssueTokens(user, "", ClientInfo{IP: "10.0.0.1"})
+	assert.NoError(t, err)
+
+	second, err := a.RefreshTokens(first.RefreshToken, ClientInfo{IP: "10.0.0.2"})
+	assert.NoError(t, err)
+	assert.NotEqual(t, first.RefreshToken, second.RefreshToken)
+	claims, err := a.ValidateJWT(second.AccessToken)
+	assert.NoError(t, err)
+	assert.Equal(t, "user1", claims.Subject)
+
+	// the rotated token stays in the family and the session follows the client
+	stored, err := db.GetRefreshToken(hashToken(second.RefreshToken))
+	assert.NoError(t, err)
+	assert.Equal(t, claims.SessionID, stored.FamilyID)
+	session, err := db.GetSession(claims.SessionID)
+	assert.NoError(t, err)
+	assert.Equal(t, "10.0.0.2", session.IP)
+
+	_, err = a.RefreshTokens(second.RefreshToken, ClientInfo{})
+	assert.NoError(t, err)
+}
+
+func TestRefreshTokenReuseRevokesFamily(t *testing.T) {
+	a, db, _ := setupService(t)
+	user, err := db.GetUser("user1")
+	assert.NoError(t, err)
+	first, err := a.IssueTokens(user, "", ClientInfo{})
+	assert.NoError(t, err)
+	second, err := a.RefreshTokens(first.RefreshToken, ClientInfo{})
+	assert.NoError(t, err)
+	other, err := a.IssueTokens(user, "", ClientInfo{})
+	assert.NoError(t, err)
+
+	// a replayed token means it was stolen, so neither the thief nor the user may continue
+	_, err = a.RefreshTokens(first.RefreshToken, ClientInfo{})
+	assert.ErrorIs(t, err, ErrRefreshTokenReused)
+	_, err = a.RefreshTokens(second.RefreshToken, ClientInfo{})
+	assert.ErrorIs(t, err, ErrInvalidRefreshToken)
+	for _, token := range []string{first.AccessToken, second.AccessToken} {
+		_, err = a.ValidateJWT(token)
+		assert.ErrorIs(t, err, ErrTokenRevoked)
+	}
+	sessions, err := db.ListSessions("user1")
+	assert.NoError(t, err)
+	assert.Len(t, sessions, 1)
+
+	// other logins of the user are not affected
+	_, err = a.ValidateJWT(other.AccessToken)
+	assert.NoError(t, err)
+	_, err = a.RefreshTokens(other.RefreshToken, ClientInfo{})
+	assert.NoError(t, err)
+}
+
+func TestRefreshUsesCurrentRoles(t *testing.T) {
+	a, db, _ := setupService(t)
+	user, err := db.GetUser("user1")
+	assert.NoError(t, err)
+	user.Roles = []string{RoleUser, RoleAdmin}
+	pair, err := a.IssueTokens(user, "", ClientInfo{})
+	assert.NoError(t, err)
+
+	pair, err = a.RefreshTokens(pair.RefreshToken, ClientInfo{})
+	assert.NoError(t, err)
+	claims, err := a.ValidateJWT(pair.AccessToken)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{RoleUser}, claims.Roles)
+}
+
+func TestUnknownRefreshTokenIsRejected(t *testing.T) {
+	a, _, _ := setupService(t)
+	_, err := a.RefreshTokens("unknown", ClientInfo{})
+	assert.ErrorIs(t, err, ErrInvalidRefreshToken)
+
+	_, err = a.RefreshTokens("", ClientInfo{})
+	assert.ErrorIs(t, err, ErrInvalidRefreshToken)
+}
@@ -0,0 +1,38 @@
+package auth
+
+import (
+	"encoding/base32"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestTOTPMatchesRFC6238Vectors(t *testing.T) {
+	// test secret "12345678901234567890" from RFC 6238 appendix B, truncated to 6 digits
+	secret := base32.StdEncoding.EncodeToString([]byte("12345678901234567890"))
+	for unix, code := range map[int64]string{
+		59:         "287082",
+		1111111109: "081804",
+		1234567890: "005924",
+		2000000000: "279037",
+	} {
+		actual, err := totpCode(secret, unix/totpPeriod)
+		assert.NoError(t, err)
+		assert.Equal(t, code, actual)
+	}
+}
+
+func TestTOTPCodesCannotBeReused(t *testing.T) {
+	secret, err := generateTOTPSecret()
+	assert.NoError(t, err)
+	now := time.Now()
+	code, err := totpCode(secret, now.Unix()/totpPeriod)
+	assert.NoError(t, err)
+
+	counter, ok := verifyTOTP(secret, code, now, 0)
+	assert.True(t, ok)
+	_, ok = verifyTOTP(secret, code, now, counter)
+	assert.False(t, ok)
+	_, ok = verifyTOTP(secret, "000000", now.Add(time.Hour), 0)
+	assert.False(t, ok)
+}